@@ -0,0 +1,51 @@
+package gdddc
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+)
+
+// serveAdmin serves the admin endpoints on the given address (or systemd's socket), in the background: health (at
+// /healthz), status (at /status), recent history (at /history), a stream of progress events (at /events), & a trigger
+// for an immediate check & update cycle (POST /update).
+func (d *Daemon) serveAdmin(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", d.metrics.serveHealth)
+	mux.HandleFunc("/status", d.metrics.serveStatus)
+	mux.HandleFunc("/update", d.serveUpdate)
+	mux.HandleFunc("/history", d.history.serveHistory)
+	mux.HandleFunc("/events", d.progress.serve)
+	var l net.Listener
+	var err error
+	if addr == "systemd" {
+		l, err = sdListener()
+	} else {
+		l, err = net.Listen("tcp", addr)
+	}
+	if err != nil {
+		errorf("Could not serve admin endpoints: %v", err)
+		return
+	}
+	go func() {
+		infof("Serving admin endpoints on %s", l.Addr())
+		if err := http.Serve(l, mux); err != nil {
+			errorf("Could not serve admin endpoints: %v", err)
+		}
+	}()
+}
+
+// serveUpdate requests an immediate check & update cycle, unless one is already requested.
+func (d *Daemon) serveUpdate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	select {
+	case d.trigger <- struct{}{}:
+	default:
+	}
+	w.WriteHeader(http.StatusAccepted)
+	fmt.Fprintln(w, "cycle requested")
+}
@@ -0,0 +1,63 @@
+package gdddc
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// annotationFields lists the fields of an IP lookup service's JSON response included in annotations, covering the
+// field names used by common services (e.g. ipinfo.io, ip-api.com).
+var annotationFields = []string{"asn", "as", "org", "isp", "country", "country_code", "countryCode"}
+
+// annotateIP looks up the given IP with the config's IP annotation service, logging its network & location info.
+// Lookup is best-effort: it runs in the background, and failures are only logged.
+func annotateIP(cfg *Config, ip string) {
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		info, err := lookupIPAnnotation(ctx, cfg, ip)
+		if err != nil {
+			warnf("Could not annotate IP %v: %v", ip, err)
+			return
+		}
+		infof("IP %v: %s", ip, info)
+	}()
+}
+
+// lookupIPAnnotation queries the config's IP annotation service about the given IP, returning a summary.
+func lookupIPAnnotation(ctx context.Context, cfg *Config, ip string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", strings.Replace(cfg.IPAnnotateURL, "%s", ip, -1), nil)
+	if err != nil {
+		return "", fmt.Errorf("could not create request: %v", err)
+	}
+	req.Header.Set("User-Agent", cfg.UserAgent)
+	req.Header.Set("Accept", "application/json")
+	resp, err := cfg.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("could not make request: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return "", fmt.Errorf("HTTP error: %v", resp.Status)
+	}
+	var fields map[string]interface{}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&fields); err != nil {
+		return "", fmt.Errorf("could not parse response: %v", err)
+	}
+
+	var parts []string
+	for _, f := range annotationFields {
+		if v, ok := fields[f]; ok && v != "" {
+			parts = append(parts, fmt.Sprintf("%s=%v", f, v))
+		}
+	}
+	if len(parts) == 0 {
+		return "", fmt.Errorf("response contains none of the fields %v", annotationFields)
+	}
+	return strings.Join(parts, " "), nil
+}
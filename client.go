@@ -0,0 +1,93 @@
+package gdddc
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// captureHeaders returns the values of the config-specified headers present in the given response.
+func captureHeaders(cfg *Config, resp *http.Response) map[string]string {
+	hdrs := map[string]string{}
+	for _, h := range cfg.CaptureHeaders {
+		if v := resp.Header.Get(h); v != "" {
+			hdrs[http.CanonicalHeaderKey(h)] = v
+		}
+	}
+	return hdrs
+}
+
+// formatHeaders formats captured headers for inclusion in a log message.
+func formatHeaders(hdrs map[string]string) string {
+	if len(hdrs) == 0 {
+		return ""
+	}
+	var parts []string
+	for k, v := range hdrs {
+		parts = append(parts, fmt.Sprintf("%s=%s", k, v))
+	}
+	sort.Strings(parts)
+	return fmt.Sprintf(" [%s]", strings.Join(parts, ", "))
+}
+
+// Client updates DNS records as configured by a Config, using each hostname's provider.
+type Client struct {
+	cfg        *Config
+	httpClient *http.Client
+}
+
+// NewClient creates a Client that sends updates with the given HTTP client. If httpClient is nil, a client set up
+// per the config (e.g. its timeout, CA bundle, & pinned certificates) is used.
+func NewClient(cfg *Config, httpClient *http.Client) *Client {
+	if httpClient == nil {
+		httpClient = cfg.updateClient
+	}
+	return &Client{cfg: cfg, httpClient: httpClient}
+}
+
+// Response describes a provider's response to a successful update.
+type Response struct {
+	Body    string            // with surrounding whitespace trimmed
+	Headers map[string]string // the config's capture_headers that were present
+}
+
+// newResponse creates a Response with the given body & captured headers.
+func newResponse(body string, hdrs map[string]string) *Response {
+	return &Response{Body: strings.TrimSpace(body), Headers: hdrs}
+}
+
+// Update updates the given hostname's record of the given family to newIP, returning the provider's response.
+// Errors reported by the provider via a documented response code are returned as a *responseError.
+func (c *Client) Update(ctx context.Context, hostname string, family Family, newIP string) (*Response, error) {
+	hc, ok := c.cfg.hosts[hostname]
+	if !ok {
+		return nil, fmt.Errorf("hostname %q is not in the config", hostname)
+	}
+	return hc.provider.update(ctx, c, hc, family, newIP)
+}
+
+// UpdateTXT sets the content of the given hostname's TXT record (its txt_record). The hostname's provider must
+// support TXT records, which is checked when the config is read.
+func (c *Client) UpdateTXT(ctx context.Context, hostname, content string) error {
+	hc, ok := c.cfg.hosts[hostname]
+	if !ok {
+		return fmt.Errorf("hostname %q is not in the config", hostname)
+	}
+	p, ok := hc.provider.(txtProvider)
+	if !ok || hc.TXTRecord == "" {
+		return fmt.Errorf("hostname %q has no TXT record", hostname)
+	}
+	return p.updateTXT(ctx, c, hc, content)
+}
+
+// Check returns an error unless the given hostname's provider can be reached. For providers whose credentials can
+// be checked without updating a record (cloudflare), it also checks the credentials.
+func (c *Client) Check(ctx context.Context, hostname string) error {
+	hc, ok := c.cfg.hosts[hostname]
+	if !ok {
+		return fmt.Errorf("hostname %q is not in the config", hostname)
+	}
+	return hc.provider.check(ctx, c, hc)
+}
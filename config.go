@@ -0,0 +1,1074 @@
+// Package gdddc implements a dynamic DNS client: it detects the current IP address & publishes it to DNS records
+// at Google Domains or other providers. The gdddcd command runs it as a daemon.
+package gdddc
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// ReadOptions controls how config & state files are read.
+type ReadOptions struct {
+	// ConfigFormat is the format of config files: "json", "yaml", or "toml". If empty, the format is implied by the
+	// file's extension: .yaml or .yml for YAML, .toml for TOML, & JSON otherwise.
+	ConfigFormat string
+	// Retries & RetryDelay control how a file whose content cannot be parsed is re-read, in case it is being replaced.
+	Retries    int
+	RetryDelay time.Duration
+}
+
+// Config stores read-only configuration information. It is created by ReadConfig.
+type Config struct {
+	Hostnames       stringList   `json:"hostname"` // may be given as a single string
+	Hosts           []hostConfig `json:"hosts"`    // hostnames with their own credentials, in addition to Hostnames
+	Username        string       `json:"username"`
+	Password        string       `json:"password"`
+	UpdateFrequency float64      `json:"update_freq_s"`
+	IPCheckURL      stringList   `json:"ip_check_url"` // may be given as a single string
+
+	// StartJitter, if set, delays each hostname's first check & update by a random time of up to this long, so that
+	// hostnames (& instances) do not all contact the provider at once. IPCache is how long a detected IP is reused
+	// by the checks of other hostnames; it defaults to the smaller of 10s & half the shortest update_freq_s.
+	StartJitter float64 `json:"start_jitter_s"`
+	IPCache     float64 `json:"ip_cache_s"`
+	UserAgent   string  `json:"user_agent"`
+
+	// The username & password may be given in place of inline values by: the _file fields, which name files holding
+	// them; the _env fields, which name environment variables holding them (by default, GDDDCD_USERNAME &
+	// GDDDCD_PASSWORD); or the _command fields, commands (& arguments) which print them. These are resolved
+	// whenever the config is read.
+	UsernameFile    string   `json:"username_file"`
+	PasswordFile    string   `json:"password_file"`
+	UsernameEnv     string   `json:"username_env"`
+	PasswordEnv     string   `json:"password_env"`
+	UsernameCommand []string `json:"username_command"`
+	PasswordCommand []string `json:"password_command"`
+
+	// Provider selects the DNS provider whose records are updated: "google" (Google Domains), "dyndns2" (any
+	// dyndns2-compatible service at UpdateURL), "duckdns", "namecheap", or "cloudflare".
+	Provider  string `json:"provider"`
+	UpdateURL string `json:"update_url"`
+
+	// Protocol selects which records are updated: "ipv4" (A), "ipv6" (AAAA), or "both".
+	Protocol string `json:"protocol"`
+	// FamilyPreference selects which records of hostnames with protocol both are updated: "both", or "ipv6-first" or
+	// "ipv4-first" to update only the record of the preferred family while its IP can be detected, & otherwise only
+	// the record of the other family.
+	FamilyPreference string `json:"family_preference"`
+	// IPCheckURLv6 is used in place of IPCheckURL to check the IPv6 address.
+	IPCheckURLv6 stringList `json:"ip_check_url_v6"`
+
+	// Consensus is how many IP check URLs must report the same IP for it to be used.
+	Consensus int `json:"consensus"`
+
+	// IPSource selects how the current IP is detected: "url" asks the IP check URLs, "interface:<name>" reads the
+	// first global address of the named network interface (e.g. a router's WAN interface), & "stun:<host[:port]>"
+	// asks a STUN server. "interface" alone uses the interface named by InterfaceName, & "stun" alone the servers
+	// of STUNServers. "upnp" asks the router for its external IPv4 address, by UPnP or else NAT-PMP or PCP (sent to
+	// RouterAddr, by default the default gateway). A list of sources is tried in order until one succeeds.
+	// IPSourceV6, if set, is used in place of IPSource for the IPv6 address.
+	IPSource      stringList `json:"ip_source"`
+	IPSourceV6    stringList `json:"ip_source_v6"`
+	InterfaceName string     `json:"interface_name"`
+	STUNServers   stringList `json:"stun_servers"`
+	RouterAddr    string     `json:"router_addr"`
+
+	// IPCheckMatch controls how the IP check response is interpreted: "exact" requires the (whitespace-trimmed)
+	// body to be an IP address, "extract" uses the first IP address found anywhere in the body.
+	IPCheckMatch string `json:"ip_check_match"`
+
+	// FollowRedirects, if set, lets the IP check follow HTTP redirects. By default a redirect fails the check,
+	// since it usually means a captive portal is intercepting requests.
+	FollowRedirects bool `json:"follow_redirects"`
+
+	// InstanceLabel, if set, tags every log line, to distinguish instances in aggregated logs.
+	InstanceLabel string `json:"instance_label"`
+
+	// ChangeWindow, if set, is a daily window in which the IP is expected to change, using its own check frequency.
+	ChangeWindow *changeWindow `json:"change_window"`
+
+	// ScheduledUpdateAt, if set, is a daily local time (HH:MM) at which the IP is re-sent even if unchanged.
+	ScheduledUpdateAt string `json:"scheduled_update_at"`
+
+	// ForceUpdateInterval, if set, re-sends the IP of any hostname not updated within this long, even if unchanged,
+	// for providers that expire records which are not refreshed (or records changed outside of gdddcd).
+	ForceUpdateInterval float64 `json:"force_update_interval_s"`
+
+	// RequestTimeout bounds the time spent on each outbound HTTP request.
+	RequestTimeout float64 `json:"request_timeout_s"`
+
+	// MaxBackoff caps the delay between cycles when backing off after consecutive failures.
+	MaxBackoff float64 `json:"max_backoff_s"`
+
+	// CycleDeadline bounds the total time spent in one check & update cycle, including retries.
+	CycleDeadline float64 `json:"cycle_deadline_s"`
+
+	// Comment, if set, is the comment of hostnames without their own; see hostConfig.
+	Comment string `json:"comment"`
+
+	// RetryPolicy controls how IP checks & updates are retried within a single cycle.
+	RetryPolicy retryPolicy `json:"retry_policy"`
+
+	// DoHURL, if set, is a DNS-over-HTTPS server used for all name resolution done by the daemon.
+	DoHURL string `json:"doh_url"`
+
+	// RequireDefaultRoute, if set, skips cycles in which the system has no route to the internet.
+	RequireDefaultRoute bool `json:"require_default_route"`
+
+	// CABundleFile, if set, is a PEM file of root CAs trusted for outbound TLS in addition to the system roots.
+	CABundleFile string `json:"ca_bundle_file"`
+
+	// HTTP configures outbound HTTP requests. Its timeout_s & ca_bundle_file may be given in place of the top-level
+	// request_timeout_s & ca_bundle_file.
+	HTTP httpConfig `json:"http"`
+
+	// PinnedCertSHA256, if set, lists hex SHA-256 hashes of certificates (or their SubjectPublicKeyInfo), one of
+	// which must appear in the provider's certificate chain for an IP update to be sent. See README for caveats.
+	PinnedCertSHA256 []string `json:"pinned_cert_sha256"`
+
+	// WaitForClockSync, if set, delays startup until the system clock appears to have been set.
+	WaitForClockSync bool `json:"wait_for_clock_sync"`
+
+	// VerifyHostname, if set, checks that the hostname exists in DNS before each update, so that a mistyped
+	// hostname is reported as such rather than repeatedly sent to the provider.
+	VerifyHostname bool `json:"verify_hostname"`
+
+	// VerifyPropagation, if set, checks after each update that the record comes to resolve to the new IP, reporting
+	// records that do not within a time window.
+	VerifyPropagation *propagationConfig `json:"verify_propagation"`
+
+	// History, if set, records each update attempt in a history log.
+	History *historyConfig `json:"history"`
+
+	// CaptureHeaders lists response headers of IP updates (e.g. request IDs) to include in logs & state.
+	CaptureHeaders []string `json:"capture_headers"`
+
+	// EmptyResponsePolicy controls how an IP update answered by an HTTP 200 with an empty body is treated:
+	// "assume_success" treats it as (unconfirmed) success, "verify" succeeds only if the record comes to resolve to
+	// the new IP within a few seconds, at the servers queried by propagation checks (see verify_propagation).
+	EmptyResponsePolicy string `json:"empty_response_policy"`
+
+	// PublishOnce, if set, skips any update whose IP the hostname already resolves to, even if state says otherwise.
+	PublishOnce bool `json:"publish_once"`
+	// ReconcileAtStartup, if set, checks each record's IP in DNS (at verify_propagation's resolver, or else the
+	// authoritative servers) before its first update, so that changes made elsewhere while stopped are not missed.
+	ReconcileAtStartup bool `json:"reconcile_at_startup"`
+
+	// IPAnnotateURL, if set, is a lookup service (with "%s" standing for the IP) returning JSON network & location
+	// info about an IP, e.g. "https://ipinfo.io/%s/json". Newly detected IPs are annotated with this info in the logs.
+	IPAnnotateURL string `json:"ip_annotate_url"`
+
+	// StatsdAddr, if set, is a statsd server (host:port) to which metrics are pushed over UDP.
+	StatsdAddr   string   `json:"statsd_addr"`
+	StatsdPrefix string   `json:"statsd_prefix"`
+	StatsdTags   []string `json:"statsd_tags"`
+
+	// Notifications configures notifications of events such as IP changes & failed updates.
+	Notifications []notification `json:"notifications"`
+	// NotifyURL, if set, is a webhook to which a JSON description of each event in the notify_on classes is POSTed;
+	// it is shorthand for a notification with this webhook_url.
+	NotifyURL string `json:"notify_url"`
+	// NotifyOn lists the classes of events notified by notifications that do not list their own events (& counted
+	// in statsd): change, error, permanent_error, stale_dns, recovery, & startup.
+	NotifyOn []string `json:"notify_on"`
+	// NotifyBatchWindow, if set, merges the ip_changed events notified within this long of the first into one
+	// event per family & new IP, listing every hostname changed to it.
+	NotifyBatchWindow float64 `json:"notify_batch_window_s"`
+	// WatchConfig, if set, makes gdddcd reload the config (as on SIGHUP) whenever the config file changes. It takes
+	// effect on restart; gdddcd's -watch_config flag overrides it.
+	WatchConfig bool `json:"watch_config"`
+	// ReloadGraceCycles is the number of cycles after a config reload that take the new config's detected IPs as
+	// the baseline: their ip_changed events are notified at once rather than batched, & records that propagation
+	// verification found resolving to other IPs are not cross-checked, since the IP sources may have changed.
+	ReloadGraceCycles int `json:"reload_grace_cycles"`
+
+	// MetricsAddr, if set, is an address (host:port) on which Prometheus metrics (/metrics) & a health check
+	// (/healthz) are served over HTTP.
+	MetricsAddr string `json:"metrics_addr"`
+	// ServeState, if set, also serves a read-only JSON snapshot of the state (/state) on MetricsAddr. The snapshot
+	// holds the published IPs & the providers' last responses (with credentials redacted), but no credentials.
+	ServeState bool `json:"serve_state"`
+
+	// AdminAddr, if set, is a local address (host:port) on which a health check (/healthz), a JSON status report
+	// (/status), recent history (/history), & a trigger for an immediate cycle (POST /update) are served over HTTP.
+	// If "systemd", they are served on the socket passed by systemd socket activation.
+	AdminAddr string `json:"admin_addr"`
+
+	// HealthMaxAge is the longest time without a successful cycle for which /healthz reports healthy.
+	// HealthMaxUpdateFailures, if set, makes /healthz report unhealthy once this many consecutive updates have failed.
+	HealthMaxAge            float64 `json:"health_max_age_s"`
+	HealthMaxUpdateFailures int     `json:"health_max_update_failures"`
+
+	// PersistCounters, if set, keeps lifetime activity totals in the state file so they survive restarts.
+	// Writes caused only by changed totals are limited by state_write_interval_s.
+	PersistCounters bool `json:"persist_counters"`
+
+	// StateWriteInterval is the minimum time between state writes for changes other than a new IP.
+	StateWriteInterval float64 `json:"state_write_interval_s"`
+
+	// Derived fields, filled in by ReadConfig.
+	hosts             map[string]hostConfig // every hostname, with the credentials used to update it
+	ipSources         map[Family][]ipSource // sources from which each family's IP is detected, in order
+	notifications     []notification        // Notifications, plus any given by NotifyURL
+	secretEnvs        []string              // environment variables holding credentials
+	inlineUsername    string                // Username & Password as given in the config, before credentials are read
+	inlinePassword    string
+	families          []Family
+	scheduledUpdateAt time.Duration // offset of ScheduledUpdateAt from midnight
+	resolver          *net.Resolver
+	rootCAs           *x509.CertPool
+	proxyURL          *url.URL // nil to use the proxy given by the environment
+	minTLSVersion     uint16   // 0 for the default
+	pins              map[[sha256.Size]byte]bool
+	statsd            *statsdClient
+	checkClients      map[Family]*http.Client // used for IP checks of each family
+	updateClient      *http.Client            // used for IP updates
+	client            *http.Client            // used for other requests
+}
+
+// httpConfig configures outbound HTTP requests.
+type httpConfig struct {
+	Timeout      float64 `json:"timeout_s"`
+	CABundleFile string  `json:"ca_bundle_file"`
+	// ProxyURL, if set, is a proxy through which requests are made. Otherwise, the HTTP_PROXY, HTTPS_PROXY, &
+	// NO_PROXY environment variables are honored.
+	ProxyURL string `json:"proxy_url"`
+	// MinTLSVersion, if set, is the minimum TLS version ("1.0", "1.1", "1.2", or "1.3") used for HTTPS requests.
+	MinTLSVersion string `json:"min_tls_version"`
+}
+
+// tlsVersions maps each supported min_tls_version value to its TLS version.
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// hostConfig configures a single hostname. Settings left unset default to the config's top-level ones.
+type hostConfig struct {
+	Hostname  string `json:"hostname"`
+	Username  string `json:"username"`
+	Password  string `json:"password"` // or API token, depending on the provider
+	Protocol  string `json:"protocol"`
+	Provider  string `json:"provider"`
+	UpdateURL string `json:"update_url"` // for the dyndns2 provider
+	Zone      string `json:"zone"`       // registered domain containing the hostname, for some providers
+
+	// UpdateFrequency, if set, is how often this hostname is checked & updated, in place of the top-level
+	// update_freq_s.
+	UpdateFrequency float64 `json:"update_freq_s"`
+
+	// FixedIP, if set, is published as-is to this hostname's record of its family, instead of the detected IP.
+	FixedIP string `json:"fixed_ip"`
+
+	// RetryPolicy, if set, controls how this hostname's updates are retried within a cycle; unset fields are those of
+	// the top-level retry_policy.
+	RetryPolicy *retryPolicy `json:"retry_policy"`
+
+	// TXTRecord, if set, names a TXT record kept in sync with this hostname's published IPs & when they were last
+	// updated, e.g. "ip=203.0.113.7;updated=2021-06-01T12:00:00Z". Only supported by the cloudflare provider.
+	TXTRecord string `json:"txt_record"`
+
+	// Comment, if set, is a text/template for the comment set on this hostname's records by each update, e.g.
+	// "updated by gdddcd at {{.Time}}"; it is given the update's Time (RFC 3339), IP, & Hostname. Only supported by
+	// the cloudflare provider.
+	Comment string `json:"comment"`
+
+	// Derived fields, filled in by ReadConfig.
+	comment       *template.Template
+	families      []Family
+	fixedIPFamily Family
+	provider      provider
+}
+
+// stringList is a list of strings, which may also be specified in JSON as a single string (or null, for none).
+type stringList []string
+
+func (l *stringList) UnmarshalJSON(b []byte) error {
+	if string(b) == "null" {
+		*l = nil
+		return nil
+	}
+	var s string
+	if err := json.Unmarshal(b, &s); err == nil {
+		*l = stringList{s}
+		return nil
+	}
+	var ss []string
+	if err := json.Unmarshal(b, &ss); err != nil {
+		return fmt.Errorf("expected a string or a list of strings")
+	}
+	*l = ss
+	return nil
+}
+
+// readJSONFile reads the given file, which is expected to contain JSON.
+// If the content is not valid JSON, the file may be mid-replacement, so it is re-read (per opts) before giving up.
+func readJSONFile(filename string, opts ReadOptions) ([]byte, error) {
+	for attempt := 1; ; attempt++ {
+		b, err := ioutil.ReadFile(filename)
+		if err != nil || json.Valid(b) || attempt > opts.Retries {
+			return b, err
+		}
+		warnf("%s is not valid JSON (attempt %d of %d), re-reading in %v", filename, attempt, opts.Retries+1, opts.RetryDelay)
+		time.Sleep(opts.RetryDelay)
+	}
+}
+
+// ReadConfig reads the config from the given file and returns it; it will fill in default values for unspecified fields.
+func ReadConfig(filename string, opts ReadOptions) (*Config, error) {
+	// Read config off disk.
+	configBytes, err := readConfigFile(filename, opts)
+	if err != nil {
+		return nil, fmt.Errorf("could not read config: %v", err)
+	}
+	return parseConfig(configBytes, filename)
+}
+
+// ParseConfig reads a config in the given format ("json", "yaml", or "toml"; JSON if empty) from r and returns it,
+// like ReadConfig.
+func ParseConfig(r io.Reader, format string) (*Config, error) {
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("could not read config: %v", err)
+	}
+	if format == "" {
+		format = "json"
+	}
+	configBytes, err := configJSON(b, format)
+	if err != nil {
+		return nil, fmt.Errorf("could not read config: %v", err)
+	}
+	return parseConfig(configBytes, "")
+}
+
+// parseConfig parses the given JSON config, read from the named file (or "" if not read from a file), filling in
+// default values for unspecified fields.
+func parseConfig(configBytes []byte, filename string) (*Config, error) {
+	var err error
+	c := &Config{}
+	if err := json.Unmarshal(configBytes, c); err != nil {
+		return nil, fmt.Errorf("could not parse config: %v", err)
+	}
+
+	// Check required fields.
+	if len(c.Hostnames) == 0 && len(c.Hosts) == 0 {
+		return nil, fmt.Errorf("hostname (or hosts) is a required field")
+	}
+	for _, h := range c.Hosts {
+		if h.Hostname == "" {
+			return nil, fmt.Errorf("hosts must not contain hosts without a hostname")
+		}
+		c.Hostnames = append(c.Hostnames, h.Hostname)
+	}
+	seenHostnames := map[string]bool{}
+	for _, h := range c.Hostnames {
+		if h == "" {
+			return nil, fmt.Errorf("hostname must not contain empty hostnames")
+		}
+		if seenHostnames[h] {
+			return nil, fmt.Errorf("hostname %q is listed more than once", h)
+		}
+		seenHostnames[h] = true
+	}
+
+	// Resolve each hostname's settings, which default to the top-level ones.
+	if c.Provider == "" {
+		debugf("provider unspecified in config, using default of google")
+		c.Provider = "google"
+	}
+	c.hosts = map[string]hostConfig{}
+	for _, h := range c.Hostnames {
+		c.hosts[h] = hostConfig{Hostname: h, Provider: c.Provider, UpdateURL: c.UpdateURL, Comment: c.Comment}
+	}
+	for _, hc := range c.Hosts {
+		if hc.UpdateFrequency < 0 {
+			return nil, fmt.Errorf("update_freq_s of %s must not be negative", hc.Hostname)
+		}
+		if hc.Provider == "" {
+			hc.Provider = c.Provider
+		}
+		if hc.UpdateURL == "" {
+			hc.UpdateURL = c.UpdateURL
+		}
+		if hc.Comment == "" {
+			hc.Comment = c.Comment
+		}
+		c.hosts[hc.Hostname] = hc
+	}
+	// Hostnames without their own credentials use the top-level ones, which are then required.
+	var needUsername, needPassword bool
+	for _, h := range c.Hostnames {
+		hc := c.hosts[h]
+		if hc.provider, err = newProvider(hc); err != nil {
+			return nil, fmt.Errorf("could not configure provider of %s: %v", h, err)
+		}
+		if _, ok := hc.provider.(txtProvider); hc.TXTRecord != "" && !ok {
+			return nil, fmt.Errorf("txt_record of %s is not supported by the %s provider", h, hc.Provider)
+		}
+		switch {
+		case hc.Comment == "":
+		case !hc.provider.supportsComments():
+			warnf("Ignoring comment of %s, which is not supported by the %s provider", h, hc.Provider)
+		default:
+			if hc.comment, err = template.New("comment").Parse(hc.Comment); err != nil {
+				return nil, fmt.Errorf("could not parse comment of %s: %v", h, err)
+			}
+		}
+		needUsername = needUsername || (hc.Username == "" && hc.provider.usesUsername())
+		needPassword = needPassword || hc.Password == ""
+		c.hosts[h] = hc
+	}
+	secrets := []string{c.Password}
+	for _, hc := range c.Hosts {
+		secrets = append(secrets, hc.Password)
+	}
+	for _, n := range c.Notifications {
+		if n.Email != nil {
+			secrets = append(secrets, n.Email.Password)
+		}
+	}
+	if filename != "" {
+		warnIfExposed(filename, secrets...)
+	}
+	c.inlineUsername, c.inlinePassword = c.Username, c.Password
+	if c.Username, err = readSecret("username", c.Username, c.UsernameFile, c.UsernameEnv, c.UsernameCommand, "GDDDCD_USERNAME", needUsername); err != nil {
+		return nil, err
+	}
+	if c.Password, err = readSecret("password", c.Password, c.PasswordFile, c.PasswordEnv, c.PasswordCommand, "GDDDCD_PASSWORD", needPassword); err != nil {
+		return nil, err
+	}
+	c.secretEnvs = []string{"GDDDCD_USERNAME", "GDDDCD_PASSWORD"}
+	for _, e := range []string{c.UsernameEnv, c.PasswordEnv} {
+		if e != "" {
+			c.secretEnvs = append(c.secretEnvs, e)
+		}
+	}
+	for _, h := range c.Hostnames {
+		hc := c.hosts[h]
+		if hc.Username == "" && hc.provider.usesUsername() {
+			hc.Username = c.Username
+		}
+		if hc.Password == "" {
+			hc.Password = c.Password
+		}
+		c.hosts[h] = hc
+	}
+	// Keep credentials out of the logs, e.g. if they appear in an error.
+	for _, hc := range c.hosts {
+		addSecrets(hc.Username, hc.Password)
+	}
+	for _, n := range c.Notifications {
+		if n.Email != nil {
+			addSecrets(n.Email.Password)
+		}
+	}
+
+	// Validate optional fields.
+	if c.ChangeWindow != nil {
+		if err := c.ChangeWindow.parse(); err != nil {
+			return nil, err
+		}
+	}
+	if c.ForceUpdateInterval < 0 {
+		return nil, fmt.Errorf("force_update_interval_s must not be negative")
+	}
+	if c.ScheduledUpdateAt != "" {
+		if c.scheduledUpdateAt, err = parseTimeOfDay(c.ScheduledUpdateAt); err != nil {
+			return nil, fmt.Errorf("could not parse scheduled_update_at: %v", err)
+		}
+	}
+	if c.Protocol == "" {
+		debugf("protocol unspecified in config, using default of ipv4")
+		c.Protocol = "ipv4"
+	}
+	defaultFamilies, err := parseProtocol(c.Protocol)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse protocol: %v", err)
+	}
+	if c.FamilyPreference == "" {
+		debugf("family_preference unspecified in config, using default of both")
+		c.FamilyPreference = "both"
+	}
+	if c.FamilyPreference != "both" && c.FamilyPreference != "ipv4-first" && c.FamilyPreference != "ipv6-first" {
+		return nil, fmt.Errorf("family_preference must be one of both, ipv4-first, or ipv6-first")
+	}
+	for _, h := range c.Hostnames {
+		hc := c.hosts[h]
+		hc.families = defaultFamilies
+		c.hosts[h] = hc
+	}
+	for _, h := range c.Hosts {
+		if h.Protocol == "" {
+			continue
+		}
+		hc := c.hosts[h.Hostname]
+		if hc.families, err = parseProtocol(h.Protocol); err != nil {
+			return nil, fmt.Errorf("could not parse protocol of %s: %v", h.Hostname, err)
+		}
+		c.hosts[h.Hostname] = hc
+	}
+	for _, f := range []Family{IPv4, IPv6} {
+		if len(c.HostnamesFor(f)) > 0 {
+			c.families = append(c.families, f)
+		}
+		for _, h := range c.HostnamesFor(f) {
+			if hc := c.hosts[h]; !hc.provider.supportsFamily(f) {
+				return nil, fmt.Errorf("the %s provider of %s does not support %s records", hc.Provider, h, f)
+			}
+		}
+	}
+	for _, h := range c.Hosts {
+		if h.FixedIP == "" {
+			continue
+		}
+		hc := c.hosts[h.Hostname]
+		ip, err := parseIP(hc.FixedIP, IPv4)
+		hc.fixedIPFamily = IPv4
+		if err != nil {
+			ip, err = parseIP(hc.FixedIP, IPv6)
+			hc.fixedIPFamily = IPv6
+		}
+		if err != nil {
+			return nil, fmt.Errorf("could not parse fixed_ip of %s: %v", h.Hostname, err)
+		}
+		if !hasFamily(hc.families, hc.fixedIPFamily) {
+			return nil, fmt.Errorf("fixed_ip of %s is an %s address, but its protocol does not include %s", h.Hostname, hc.fixedIPFamily, hc.fixedIPFamily)
+		}
+		hc.FixedIP = ip
+		c.hosts[h.Hostname] = hc
+	}
+
+	// Fill defaults for unspecified fields.
+	if c.UpdateFrequency <= 0 {
+		debugf("update_freq_s unspecified (or negative) in config, using default of 60")
+		c.UpdateFrequency = 60
+	}
+	if c.CycleDeadline <= 0 {
+		debugf("cycle_deadline_s unspecified (or negative) in config, using default of update_freq_s (%v)", c.UpdateFrequency)
+		c.CycleDeadline = c.UpdateFrequency
+	}
+	if c.MaxBackoff <= 0 {
+		debugf("max_backoff_s unspecified (or negative) in config, using default of 3600")
+		c.MaxBackoff = 3600
+	}
+	if c.HTTP.Timeout > 0 {
+		if c.RequestTimeout > 0 {
+			return nil, fmt.Errorf("only one of request_timeout_s and http.timeout_s may be used")
+		}
+		c.RequestTimeout = c.HTTP.Timeout
+	}
+	if c.HTTP.CABundleFile != "" {
+		if c.CABundleFile != "" {
+			return nil, fmt.Errorf("only one of ca_bundle_file and http.ca_bundle_file may be used")
+		}
+		c.CABundleFile = c.HTTP.CABundleFile
+	}
+	if c.RequestTimeout <= 0 {
+		debugf("request_timeout_s unspecified (or negative) in config, using default of 30")
+		c.RequestTimeout = 30
+	}
+	shortestFreq, longestFreq := c.UpdateFrequency, c.UpdateFrequency
+	for _, hc := range c.Hosts {
+		if f := hc.UpdateFrequency; f > 0 {
+			shortestFreq, longestFreq = math.Min(shortestFreq, f), math.Max(longestFreq, f)
+		}
+	}
+	if c.HealthMaxAge <= 0 {
+		c.HealthMaxAge = healthyCycleMultiple * longestFreq
+		debugf("health_max_age_s unspecified (or negative) in config, using default of %d * the longest update_freq_s (%v)", healthyCycleMultiple, c.HealthMaxAge)
+	}
+	if c.StartJitter < 0 {
+		return nil, fmt.Errorf("start_jitter_s must not be negative")
+	}
+	if c.IPCache <= 0 {
+		c.IPCache = math.Min(10, shortestFreq/2)
+		debugf("ip_cache_s unspecified (or negative) in config, using default of %v", c.IPCache)
+	}
+	if c.HealthMaxUpdateFailures < 0 {
+		return nil, fmt.Errorf("health_max_update_failures must not be negative")
+	}
+	if c.StateWriteInterval <= 0 {
+		debugf("state_write_interval_s unspecified (or negative) in config, using default of 600")
+		c.StateWriteInterval = 600
+	}
+	if len(c.IPCheckURL) == 0 {
+		debugf("ip_check_url unspecified in config, using default of https://domains.google.com/checkip")
+		c.IPCheckURL = stringList{"https://domains.google.com/checkip"}
+	}
+	if len(c.IPCheckURLv6) == 0 && c.hasFamily(IPv6) {
+		debugf("ip_check_url_v6 unspecified in config, using default of ip_check_url (%s)", strings.Join(c.IPCheckURL, ", "))
+		c.IPCheckURLv6 = c.IPCheckURL
+	}
+	for _, u := range append(append([]string{}, c.IPCheckURL...), c.IPCheckURLv6...) {
+		if u == "" {
+			return nil, fmt.Errorf("ip_check_url and ip_check_url_v6 must not contain empty URLs")
+		}
+	}
+	for i, n := range c.Notifications {
+		if err := n.validate(); err != nil {
+			return nil, fmt.Errorf("could not parse notifications[%d]: %v", i, err)
+		}
+	}
+	c.notifications = c.Notifications
+	if c.NotifyURL != "" {
+		c.notifications = append(c.notifications, notification{WebhookURL: c.NotifyURL})
+	}
+	if c.NotifyBatchWindow < 0 {
+		return nil, fmt.Errorf("notify_batch_window_s must not be negative")
+	}
+	if c.ReloadGraceCycles <= 0 {
+		debugf("reload_grace_cycles unspecified (or negative) in config, using default of 1")
+		c.ReloadGraceCycles = 1
+	}
+	if c.NotifyOn == nil {
+		debugf("notify_on unspecified in config, using default of [change permanent_error recovery]")
+		c.NotifyOn = []string{"change", "permanent_error", "recovery"}
+	}
+	for _, class := range c.NotifyOn {
+		if !contains(notifyClasses, class) {
+			return nil, fmt.Errorf("notify_on must contain only %s", strings.Join(notifyClasses, ", "))
+		}
+	}
+	if c.Consensus <= 0 {
+		debugf("consensus unspecified (or negative) in config, using default of 1")
+		c.Consensus = 1
+	}
+	if c.Consensus > len(c.IPCheckURL) || (c.hasFamily(IPv6) && c.Consensus > len(c.IPCheckURLv6)) {
+		return nil, fmt.Errorf("consensus (%d) must not exceed the number of IP check URLs", c.Consensus)
+	}
+	if len(c.IPSource) == 0 {
+		debugf("ip_source unspecified in config, using default of url")
+		c.IPSource = stringList{"url"}
+	}
+	if len(c.IPSourceV6) == 0 {
+		c.IPSourceV6 = c.IPSource
+	}
+	if len(c.STUNServers) == 0 {
+		c.STUNServers = stringList{"stun.l.google.com:19302", "stun.cloudflare.com:3478"}
+	}
+	c.ipSources = map[Family][]ipSource{}
+	for f, srcs := range map[Family]stringList{IPv4: c.IPSource, IPv6: c.IPSourceV6} {
+		for _, src := range srcs {
+			s := ipSource{name: src}
+			switch {
+			case src == "url":
+			case src == "interface":
+				if c.InterfaceName == "" {
+					return nil, fmt.Errorf("interface_name is required if ip_source is interface")
+				}
+				s.iface = c.InterfaceName
+			case strings.HasPrefix(src, "interface:") && src != "interface:":
+				s.iface = strings.TrimPrefix(src, "interface:")
+			case src == "stun":
+				debugf("Using STUN servers %v for %s IP", c.STUNServers, f)
+				s.stunServers = c.STUNServers
+			case strings.HasPrefix(src, "stun:") && src != "stun:":
+				server := strings.TrimPrefix(src, "stun:")
+				if _, _, err := net.SplitHostPort(server); err != nil {
+					server = net.JoinHostPort(server, "3478")
+				}
+				s.stunServers = []string{server}
+			case src == "upnp":
+				if f == IPv6 && c.hasFamily(IPv6) {
+					return nil, fmt.Errorf("ip_source_v6 must not be upnp, since routers report only their IPv4 address")
+				}
+				s.router = true
+			default:
+				return nil, fmt.Errorf("ip_source & ip_source_v6 must each be one of url, interface, interface:<name>, stun, stun:<host[:port]>, or upnp, or a list of these")
+			}
+			c.ipSources[f] = append(c.ipSources[f], s)
+		}
+	}
+	switch c.IPCheckMatch {
+	case "":
+		debugf("ip_check_match unspecified in config, using default of exact")
+		c.IPCheckMatch = "exact"
+	case "exact", "extract":
+	default:
+		return nil, fmt.Errorf("ip_check_match must be one of exact or extract")
+	}
+	if c.UserAgent == "" {
+		debugf("user_agent unspecified in config, using default of gdddcd 1.0")
+		c.UserAgent = "gdddcd 1.0"
+	}
+	if c.CaptureHeaders == nil {
+		debugf("capture_headers unspecified in config, using default of [X-Request-Id, X-Cloud-Trace-Context]")
+		c.CaptureHeaders = []string{"X-Request-Id", "X-Cloud-Trace-Context"}
+	}
+	switch c.EmptyResponsePolicy {
+	case "":
+		debugf("empty_response_policy unspecified in config, using default of assume_success")
+		c.EmptyResponsePolicy = "assume_success"
+	case "assume_success", "verify":
+	default:
+		return nil, fmt.Errorf("empty_response_policy must be one of assume_success or verify")
+	}
+	if err := c.RetryPolicy.fillDefaults(); err != nil {
+		return nil, err
+	}
+	for _, h := range c.Hosts {
+		if h.RetryPolicy == nil {
+			continue
+		}
+		hc := c.hosts[h.Hostname]
+		p := *h.RetryPolicy
+		if err := p.inherit(c.RetryPolicy); err != nil {
+			return nil, fmt.Errorf("invalid retry_policy of %s: %v", h.Hostname, err)
+		}
+		hc.RetryPolicy = &p
+		c.hosts[h.Hostname] = hc
+	}
+	if c.VerifyPropagation != nil {
+		if err := c.VerifyPropagation.fillDefaults(); err != nil {
+			return nil, err
+		}
+	}
+	if c.History != nil {
+		if err := c.History.fillDefaults(); err != nil {
+			return nil, err
+		}
+	}
+
+	// Fill derived fields.
+	c.resolver = net.DefaultResolver
+	if c.CABundleFile != "" {
+		pem, err := ioutil.ReadFile(c.CABundleFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not read ca_bundle_file: %v", err)
+		}
+		if c.rootCAs, err = x509.SystemCertPool(); err != nil {
+			warnf("Could not load system root CAs, trusting only ca_bundle_file: %v", err)
+			c.rootCAs = x509.NewCertPool()
+		}
+		if !c.rootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("ca_bundle_file contains no PEM certificates")
+		}
+	}
+	if c.HTTP.ProxyURL != "" {
+		if c.proxyURL, err = url.Parse(c.HTTP.ProxyURL); err != nil {
+			return nil, fmt.Errorf("could not parse http.proxy_url: %v", err)
+		}
+		if c.proxyURL.Scheme == "" || c.proxyURL.Host == "" {
+			return nil, fmt.Errorf("http.proxy_url must be an absolute URL, e.g. http://proxy:3128")
+		}
+	}
+	if v := c.HTTP.MinTLSVersion; v != "" {
+		var ok bool
+		if c.minTLSVersion, ok = tlsVersions[v]; !ok {
+			return nil, fmt.Errorf("http.min_tls_version must be one of 1.0, 1.1, 1.2, or 1.3")
+		}
+	}
+	if c.DoHURL != "" {
+		u, err := url.Parse(c.DoHURL)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse doh_url: %v", err)
+		}
+		if u.Scheme != "https" {
+			return nil, fmt.Errorf("doh_url must be an https URL")
+		}
+		// The DoH server is reached per the http settings (proxy, CA bundle, & TLS version), resolving its own
+		// hostname with the system resolver.
+		client := &http.Client{Transport: newTransport(c), Timeout: 10 * time.Second}
+		c.resolver = newDoHResolver(c.DoHURL, c.UserAgent, client)
+	}
+	if len(c.PinnedCertSHA256) > 0 {
+		c.pins = map[[sha256.Size]byte]bool{}
+		for _, p := range c.PinnedCertSHA256 {
+			b, err := hex.DecodeString(strings.Replace(p, ":", "", -1))
+			if err != nil || len(b) != sha256.Size {
+				return nil, fmt.Errorf("pinned_cert_sha256 entry %q is not a hex-encoded SHA-256 hash", p)
+			}
+			var h [sha256.Size]byte
+			copy(h[:], b)
+			c.pins[h] = true
+		}
+	}
+	if c.StatsdAddr != "" {
+		if c.StatsdPrefix == "" {
+			debugf("statsd_prefix unspecified in config, using default of gdddcd")
+			c.StatsdPrefix = "gdddcd"
+		}
+		if c.statsd, err = newStatsdClient(c.StatsdAddr, c.StatsdPrefix, c.StatsdTags); err != nil {
+			return nil, err
+		}
+	}
+
+	// Create HTTP clients. Each operation gets its own client, as they need differently-configured transports.
+	timeout := time.Duration(c.RequestTimeout * float64(time.Second))
+	c.checkClients = map[Family]*http.Client{}
+	for _, f := range c.families {
+		cl := &http.Client{Timeout: timeout, Transport: newFamilyTransport(c, f)}
+		if !c.FollowRedirects {
+			cl.CheckRedirect = func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }
+		}
+		c.checkClients[f] = cl
+	}
+	updateTransport := newTransport(c)
+	if len(c.pins) > 0 {
+		if updateTransport.TLSClientConfig == nil {
+			updateTransport.TLSClientConfig = &tls.Config{}
+		}
+		updateTransport.TLSClientConfig.VerifyPeerCertificate = verifyPins(c)
+	}
+	c.updateClient = &http.Client{Timeout: timeout, Transport: updateTransport}
+	c.client = &http.Client{Timeout: timeout, Transport: newTransport(c)}
+
+	return c, nil
+}
+
+// readSecret returns the value of a secret (e.g. the password), which may be given inline in the config, in a
+// file, in an environment variable (named by the config, or defaultEnv), or by the output of a command. At most one of
+// these may be used, and one must be if required. If none is, a systemd credential of the same name is used.
+func readSecret(name, inline, file, env string, command []string, defaultEnv string, required bool) (string, error) {
+	envVal := os.Getenv(defaultEnv)
+	if env != "" {
+		if envVal = os.Getenv(env); envVal == "" {
+			return "", fmt.Errorf("%s_env names environment variable %s, which is not set", name, env)
+		}
+	}
+	var n int
+	for _, set := range []bool{inline != "", file != "", envVal != "", len(command) > 0} {
+		if set {
+			n++
+		}
+	}
+	if cred := systemdCredential(name); n == 0 && cred != "" {
+		debugf("Reading %s from systemd credential %s", name, cred)
+		file, n = cred, 1
+	}
+	switch {
+	case n == 0 && !required:
+		return "", nil
+	case n == 0:
+		return "", fmt.Errorf("%s is a required field (or use %s_file, %s_env, %s_command, the %s environment variable, or a systemd credential)", name, name, name, name, defaultEnv)
+	case n > 1:
+		return "", fmt.Errorf("only one of %s, %s_file, %s_env, %s_command, and the %s environment variable may be used", name, name, name, name, defaultEnv)
+	case file != "":
+		secretBytes, err := ioutil.ReadFile(file)
+		if err != nil {
+			return "", fmt.Errorf("could not read %s_file: %v", name, err)
+		}
+		secret := strings.TrimSpace(string(secretBytes))
+		if secret == "" {
+			return "", fmt.Errorf("%s_file %q is empty", name, file)
+		}
+		return secret, nil
+	case envVal != "":
+		return envVal, nil
+	case len(command) > 0:
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		cmd := exec.CommandContext(ctx, command[0], command[1:]...)
+		cmd.Stderr = os.Stderr
+		out, err := cmd.Output()
+		if err != nil {
+			return "", fmt.Errorf("could not run %s_command: %v", name, err)
+		}
+		secret := strings.TrimSpace(string(out))
+		if secret == "" {
+			return "", fmt.Errorf("%s_command printed nothing", name)
+		}
+		return secret, nil
+	}
+	return inline, nil
+}
+
+// warnIfExposed logs a warning if the given config file, whose config has the given inline secrets, is readable by
+// any user.
+func warnIfExposed(filename string, secrets ...string) {
+	fi, err := os.Stat(filename)
+	if err != nil || fi.Mode().Perm()&0004 == 0 {
+		return
+	}
+	for _, s := range secrets {
+		if s != "" {
+			warnf("config file %s is world-readable (mode %v) but contains credentials; restrict its permissions, or use password_file, password_env, or password_command", filename, fi.Mode().Perm())
+			return
+		}
+	}
+}
+
+// hasFamily reports whether the config updates records of the given IP family.
+func (c *Config) hasFamily(family Family) bool {
+	return hasFamily(c.families, family)
+}
+
+// familyOrder returns the families checked & updated, in the order they are handled by each cycle: the preferred
+// family first, if family_preference sets one.
+func (c *Config) familyOrder() []Family {
+	if c.FamilyPreference == "ipv6-first" && len(c.families) == 2 {
+		return []Family{IPv6, IPv4}
+	}
+	return c.families
+}
+
+// singleRecord reports whether only one of the hostname's records is updated at a time, per family_preference.
+func (c *Config) singleRecord(hostname string) bool {
+	return c.FamilyPreference != "both" && len(c.hosts[hostname].families) == 2
+}
+
+// retryPolicy returns the retry policy of the given hostname's updates.
+func (c *Config) retryPolicy(hostname string) retryPolicy {
+	if p := c.hosts[hostname].RetryPolicy; p != nil {
+		return *p
+	}
+	return c.RetryPolicy
+}
+
+// fixedIP returns the IP fixed by the config for the given hostname's record of the given family, if any.
+func (c *Config) fixedIP(hostname string, family Family) string {
+	if hc := c.hosts[hostname]; hc.fixedIPFamily == family {
+		return hc.FixedIP
+	}
+	return ""
+}
+
+// Families returns the IP families of the records that are updated.
+func (c *Config) Families() []Family {
+	return c.families
+}
+
+// Normalized returns the config as indented JSON, with default values filled in & credentials redacted. It is
+// itself a valid config, with the same meaning other than the redacted credentials.
+func (c *Config) Normalized() ([]byte, error) {
+	n := *c
+	// Fields merged into others by ReadConfig are given once, as the user would write them.
+	n.Hostnames = nil
+	for _, h := range c.Hostnames {
+		if _, ok := c.hostEntry(h); !ok {
+			n.Hostnames = append(n.Hostnames, h)
+		}
+	}
+	n.HTTP.Timeout, n.HTTP.CABundleFile = 0, ""
+	n.Username, n.Password = c.inlineUsername, redactNonEmpty(c.inlinePassword)
+	n.Hosts = append([]hostConfig(nil), c.Hosts...)
+	for i := range n.Hosts {
+		n.Hosts[i].Password = redactNonEmpty(n.Hosts[i].Password)
+	}
+	if n.NotifyURL != "" {
+		n.NotifyURL = redactURL(n.NotifyURL)
+	}
+	n.Notifications = append([]notification(nil), c.Notifications...)
+	for i, nc := range n.Notifications {
+		if nc.WebhookURL != "" {
+			n.Notifications[i].WebhookURL = redactURL(nc.WebhookURL)
+		}
+		if nc.Email != nil {
+			e := *nc.Email
+			e.Password = redactNonEmpty(e.Password)
+			n.Notifications[i].Email = &e
+		}
+	}
+	b, err := json.MarshalIndent(&n, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("could not marshal config: %v", err)
+	}
+	return []byte(urlUserinfo.ReplaceAllString(string(b), "${1}REDACTED@")), nil
+}
+
+func redactNonEmpty(s string) string {
+	if s == "" {
+		return ""
+	}
+	return "REDACTED"
+}
+
+// redactURL redacts the userinfo, path, & query of the given URL, any of which may hold a secret (e.g. a webhook
+// token), leaving only its scheme & host.
+func redactURL(s string) string {
+	u, err := url.Parse(s)
+	if err != nil {
+		return "REDACTED"
+	}
+	if u.User != nil {
+		u.User = url.User("REDACTED")
+	}
+	if u.Opaque != "" || (u.Path != "" && u.Path != "/") || u.RawQuery != "" || u.Fragment != "" {
+		u.Opaque, u.Path, u.RawPath, u.RawQuery, u.Fragment = "", "/REDACTED", "", "", ""
+	}
+	return u.String()
+}
+
+// hostEntry returns the hosts entry of the given hostname, if it has one.
+func (c *Config) hostEntry(hostname string) (hostConfig, bool) {
+	for _, hc := range c.Hosts {
+		if hc.Hostname == hostname {
+			return hc, true
+		}
+	}
+	return hostConfig{}, false
+}
+
+// HostnamesFor returns the hostnames whose records of the given IP family are updated.
+func (c *Config) HostnamesFor(family Family) []string {
+	var hostnames []string
+	for _, h := range c.Hostnames {
+		if hasFamily(c.hosts[h].families, family) {
+			hostnames = append(hostnames, h)
+		}
+	}
+	return hostnames
+}
+
+// newTransport creates the HTTP transport used for outbound requests, which resolves names using the config's resolver
+// and applies its http settings.
+func newTransport(cfg *Config) *http.Transport {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.DialContext = (&net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+		Resolver:  cfg.resolver,
+	}).DialContext
+	if cfg.proxyURL != nil {
+		t.Proxy = http.ProxyURL(cfg.proxyURL)
+	}
+	if cfg.rootCAs != nil || cfg.minTLSVersion != 0 {
+		t.TLSClientConfig = &tls.Config{RootCAs: cfg.rootCAs, MinVersion: cfg.minTLSVersion}
+	}
+	return t
+}
+
+// newFamilyTransport creates an HTTP transport like newTransport, but which only connects over the given IP family.
+func newFamilyTransport(cfg *Config, family Family) *http.Transport {
+	t := newTransport(cfg)
+	dial := t.DialContext
+	t.DialContext = func(ctx context.Context, _, addr string) (net.Conn, error) {
+		return dial(ctx, family.network(), addr)
+	}
+	return t
+}
+
+// verifyPins returns a tls.Config.VerifyPeerCertificate callback that requires some certificate in a verified chain
+// to match one of the config's pins, either by the hash of the whole certificate or of its public key. It runs in
+// addition to normal certificate verification. Certificates the server sends outside its verified chains are
+// ignored: otherwise a server with any trusted certificate could pass by also sending the (public) pinned one.
+func verifyPins(cfg *Config) func([][]byte, [][]*x509.Certificate) error {
+	return func(_ [][]byte, verifiedChains [][]*x509.Certificate) error {
+		for _, chain := range verifiedChains {
+			for _, cert := range chain {
+				if cfg.pins[sha256.Sum256(cert.Raw)] || cfg.pins[sha256.Sum256(cert.RawSubjectPublicKeyInfo)] {
+					return nil
+				}
+			}
+		}
+		return fmt.Errorf("no certificate in the server's verified chain matches pinned_cert_sha256")
+	}
+}
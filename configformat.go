@@ -0,0 +1,72 @@
+package gdddc
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// configFormat returns the format of the given config file, per format (as in ReadOptions.ConfigFormat).
+func configFormat(filename, format string) (string, error) {
+	switch format {
+	case "json", "yaml", "toml":
+		return format, nil
+	case "":
+	default:
+		return "", fmt.Errorf("config format must be one of json, yaml, or toml")
+	}
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".yaml", ".yml":
+		return "yaml", nil
+	case ".toml":
+		return "toml", nil
+	}
+	return "json", nil
+}
+
+// readConfigFile reads the given config file & returns its content as JSON. Like readJSONFile, it re-reads a file
+// whose content cannot be parsed (per opts) before giving up.
+func readConfigFile(filename string, opts ReadOptions) ([]byte, error) {
+	format, err := configFormat(filename, opts.ConfigFormat)
+	if err != nil {
+		return nil, err
+	}
+	if format == "json" {
+		return readJSONFile(filename, opts)
+	}
+	for attempt := 1; ; attempt++ {
+		b, err := ioutil.ReadFile(filename)
+		if err != nil {
+			return nil, err
+		}
+		j, err := configJSON(b, format)
+		if err == nil || attempt > opts.Retries {
+			return j, err
+		}
+		warnf("%s is not valid %s (attempt %d of %d), re-reading in %v", filename, strings.ToUpper(format), attempt, opts.Retries+1, opts.RetryDelay)
+		time.Sleep(opts.RetryDelay)
+	}
+}
+
+// configJSON converts the given config content, in the given format, to JSON.
+func configJSON(b []byte, format string) ([]byte, error) {
+	var v interface{}
+	var err error
+	switch format {
+	case "json":
+		return b, nil
+	case "yaml":
+		v, err = parseYAML(string(b))
+	case "toml":
+		v, err = parseTOML(string(b))
+	default:
+		return nil, fmt.Errorf("config format must be one of json, yaml, or toml")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not parse %s: %v", strings.ToUpper(format), err)
+	}
+	return json.Marshal(v)
+}
@@ -0,0 +1,946 @@
+package gdddc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"net"
+	"runtime/debug"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrCheckFailed & ErrUpdateFailed are returned by RunOnce if an IP check or update failed during the cycle;
+// ErrCycleSkipped is returned if the cycle was skipped for lack of connectivity.
+var (
+	ErrCheckFailed  = errors.New("IP check failed")
+	ErrUpdateFailed = errors.New("IP update failed")
+	ErrCycleSkipped = errors.New("cycle skipped: no default route")
+)
+
+// Daemon periodically checks the IP & updates the configured records, holding the state that carries over between
+// cycles. It is not safe for concurrent use.
+type Daemon struct {
+	// DryRun, if set, makes the daemon log the updates that would be sent, without sending them or writing state.
+	DryRun bool
+
+	cfg      *Config
+	store    *Store
+	detector *Detector
+	client   *Client
+	metrics  *metrics
+	history  historyLog
+	trigger  chan struct{} // receives requests for an immediate cycle
+	started  bool          // set once start has run
+	watchdog time.Duration // how often to notify systemd's watchdog, if enabled
+	// servingState is set if the state snapshot is served (at /state); it is only set at startup.
+	servingState bool
+	// background tracks the notifications & propagation checks still running in the background.
+	background sync.WaitGroup
+	// batcher holds the ip_changed events waiting to be notified, if notify_batch_window_s is set.
+	batcher notifyBatcher
+	// progress streams the daemon's progress to the subscribers of the admin endpoint's /events.
+	progress progressStream
+	// graceCycles is the number of cycles still to run in the grace period after a config reload (see
+	// reload_grace_cycles).
+	graceCycles int
+
+	// detectedIPs holds the IP of each family found by the previous successful check (at detectedAt), to notice
+	// changes in detection & to be reused by checks shortly after.
+	detectedIPs map[Family]string
+	detectedAt  map[Family]time.Time
+	// lastRun & nextDue hold when each hostname was last & is next checked & updated; hostnames without a nextDue are
+	// due in the next cycle. due holds the hostnames checked & updated in the current cycle.
+	lastRun, nextDue map[string]time.Time
+	due              map[string]bool
+	// allDue is set if every hostname is due in the next cycle, e.g. when one is requested via the admin endpoint.
+	allDue bool
+	// nextScheduled is the next time at which the IP should be re-sent regardless of change, if configured.
+	nextScheduled time.Time
+	// checkFailed & updateFailed are set if an IP check or update fails during the current cycle; panicked is set
+	// if the cycle panics, which counts as a failed IP check, & skipped if it is skipped for lack of connectivity.
+	checkFailed, updateFailed, panicked, skipped bool
+	// checkFailures & updateFailures count the consecutive cycles with failed IP checks or updates.
+	checkFailures, updateFailures int
+	// serverError is set if Google Domains reports a server-side error (911) during the current cycle.
+	serverError bool
+	// blockedHosts maps each hostname whose updates can never succeed (e.g. bad credentials) to the error that showed
+	// it; no further updates are attempted for these hostnames.
+	blockedHosts map[string]error
+
+	// changed maps each change of IP made by the current family's updates to the hostnames whose records it changed.
+	changed map[ipChange][]string
+	// chosen maps each hostname whose records are updated one at a time (per family_preference) to the family whose
+	// record is updated in the current cycle, once chosen; lastChosen holds the family last chosen.
+	chosen, lastChosen map[string]Family
+
+	// scheduledPending holds the records still to be re-sent for the current scheduled update, if one is due.
+	scheduledPending map[record]bool
+	// keepalivePending holds the records still to be re-sent because their hostname has not been updated within the
+	// config's force_update_interval_s.
+	keepalivePending map[record]bool
+	// reconciled holds the records whose published IP has been checked against DNS since startup, if configured.
+	reconciled map[record]bool
+	// txtPending holds the hostnames whose TXT record is out of date, because an update of their records has
+	// succeeded since it was last written.
+	txtPending map[string]bool
+	// mismatches receives the records found by propagation verification to resolve to other IPs than the ones
+	// published, to be cross-checked by the next cycle.
+	mismatches chan propagationMismatch
+}
+
+// propagationMismatch is a record found by propagation verification to resolve to dnsIPs rather than to ip, which
+// was published after being detected by the IP check URL url.
+type propagationMismatch struct {
+	r       record
+	ip, url string
+	dnsIPs  []string
+}
+
+// NewDaemon creates a Daemon that updates records as configured by cfg, tracking what it has published in store.
+func NewDaemon(cfg *Config, store *Store) *Daemon {
+	store.state.migrate(cfg.Hostnames)
+	d := &Daemon{
+		cfg:              cfg,
+		store:            store,
+		detector:         NewDetector(cfg, nil),
+		client:           NewClient(cfg, nil),
+		detectedIPs:      map[Family]string{},
+		detectedAt:       map[Family]time.Time{},
+		lastRun:          map[string]time.Time{},
+		nextDue:          map[string]time.Time{},
+		blockedHosts:     map[string]error{},
+		keepalivePending: map[record]bool{},
+		reconciled:       map[record]bool{},
+		txtPending:       map[string]bool{},
+		lastChosen:       map[string]Family{},
+		mismatches:       make(chan propagationMismatch, 16),
+		trigger:          make(chan struct{}, 1),
+	}
+	var lifetime counters
+	if cfg.PersistCounters {
+		lifetime = store.state.Lifetime
+	}
+	d.metrics = newMetrics(time.Duration(cfg.HealthMaxAge*float64(time.Second)), cfg.HealthMaxUpdateFailures, lifetime)
+	d.history.setConfig(cfg.History)
+	for _, f := range cfg.families {
+		for _, h := range cfg.HostnamesFor(f) {
+			if ip := store.IP(h, f); ip != "" {
+				d.metrics.recordPublished(record{h, f}, ip)
+			}
+		}
+	}
+	return d
+}
+
+// start prepares the daemon to run its first cycle: it waits for the clock to be set & starts serving metrics,
+// if configured. It returns ctx's error if ctx is done while waiting for the clock.
+func (d *Daemon) start(ctx context.Context) error {
+	if d.started {
+		return nil
+	}
+	cfg := d.cfg
+	setLogPrefix(cfg.InstanceLabel)
+	if cfg.WaitForClockSync {
+		if err := waitForClockSync(ctx); err != nil {
+			return err
+		}
+	}
+	d.started = true
+	if cfg.MetricsAddr != "" {
+		d.metrics.serve(cfg.MetricsAddr, cfg.ServeState)
+		d.servingState = cfg.ServeState
+		d.snapshotState()
+	}
+	if cfg.AdminAddr != "" {
+		d.serveAdmin(cfg.AdminAddr)
+	}
+	updateFreq := time.Duration(cfg.UpdateFrequency * float64(time.Second))
+	if w := cfg.ChangeWindow; w != nil {
+		infof("Starting: will check & update %v IP of %v every %v (every %v between %s and %s)", cfg.families, cfg.Hostnames, updateFreq, time.Duration(w.UpdateFrequency*float64(time.Second)), w.Start, w.End)
+	} else {
+		infof("Starting: will check & update %v IP of %v every %v", cfg.families, cfg.Hostnames, updateFreq)
+	}
+	if cfg.ScheduledUpdateAt != "" {
+		// Scheduled only once the clock is known to be set, so that the first scheduled update is not far off.
+		d.nextScheduled = nextTimeOfDay(time.Now(), cfg.scheduledUpdateAt)
+		infof("Will also re-send IP daily at %s (next at %v)", cfg.ScheduledUpdateAt, d.nextScheduled.Format(time.RFC3339))
+	}
+	for _, hc := range cfg.Hosts {
+		if hc.UpdateFrequency > 0 {
+			infof("Will check & update %s every %v", hc.Hostname, time.Duration(hc.UpdateFrequency*float64(time.Second)))
+		}
+	}
+	if cfg.StartJitter > 0 {
+		now := time.Now()
+		for _, h := range cfg.Hostnames {
+			d.nextDue[h] = now.Add(time.Duration(rand.Float64() * cfg.StartJitter * float64(time.Second)))
+			debugf("First check & update of %s at %v", h, d.nextDue[h].Format(time.RFC3339))
+		}
+	}
+	if d.watchdog = sdWatchdogInterval(); d.watchdog > 0 {
+		debugf("Notifying systemd watchdog every %v", d.watchdog)
+	}
+	notify(cfg, &d.background, event{Event: eventStarted, Hostnames: cfg.Hostnames, Timestamp: time.Now()})
+	return nil
+}
+
+// shutdownWait bounds how long Run waits for background work to finish when shutting down. Propagation checks may run
+// for much longer, so they are not waited for beyond it.
+const shutdownWait = 10 * time.Second
+
+// Run checks & updates immediately, then periodically until ctx is done, when it writes any state not yet on disk &
+// waits (for up to shutdownWait) for the notifications & propagation checks still running in the background.
+// Configs received from reload are used for subsequent cycles. If run by systemd, it reports readiness & notifies
+// the watchdog (if enabled) from the main loop, so that a wedged loop is restarted.
+func (d *Daemon) Run(ctx context.Context, reload <-chan *Config) error {
+	if err := d.start(ctx); err != nil {
+		return nil // shut down before the first cycle
+	}
+	sdNotify("READY=1")
+	var watchdog <-chan time.Time
+	if d.watchdog > 0 {
+		tk := time.NewTicker(d.watchdog)
+		defer tk.Stop()
+		watchdog = tk.C
+	}
+	for next := d.earliestDue(); ctx.Err() == nil; {
+		// Wait for the next check, which is rescheduled if the config is reloaded meanwhile.
+		for waiting := true; waiting; {
+			t := time.NewTimer(time.Until(next))
+			select {
+			case <-t.C:
+				waiting = false
+			case <-ctx.Done():
+				waiting = false
+			case cfg := <-reload:
+				sdNotify("RELOADING=1")
+				d.setConfig(cfg)
+				next = d.nextCycle(time.Now())
+				sdNotify("READY=1")
+			case <-watchdog:
+				sdNotify("WATCHDOG=1")
+			case <-d.trigger:
+				infof("Running cycle requested via admin endpoint")
+				waiting, next, d.allDue = false, time.Now(), true
+			}
+			t.Stop()
+		}
+		if ctx.Err() != nil {
+			break
+		}
+
+		// If we have fallen behind schedule, continue from now rather than catching up.
+		start := next
+		if time.Now().After(next) {
+			start = time.Now()
+		}
+		d.runOnce(ctx)
+		for h := range d.due {
+			d.lastRun[h] = start
+		}
+		if d.watchdog > 0 {
+			sdNotify("WATCHDOG=1")
+		}
+		next = d.nextCycle(start)
+	}
+
+	// Write any state not yet on disk (e.g. throttled writes), so the next run does not repeat updates.
+	infof("Shutting down")
+	sdNotify("STOPPING=1")
+	err := d.Flush()
+	done := make(chan struct{})
+	go func() {
+		d.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(shutdownWait):
+		warnf("Notifications or propagation checks still running after %v; shutting down without them", shutdownWait)
+	}
+	return err
+}
+
+// RunOnce runs a single check & update cycle. It returns ErrCycleSkipped if the cycle was skipped, or ErrCheckFailed
+// or ErrUpdateFailed if any IP check or update failed; a panicked cycle counts as a failed IP check. If ctx is done
+// while waiting for the clock to be set, it returns ctx's error without running the cycle. Notifications &
+// propagation checks started by the cycle continue in the background; see Wait.
+func (d *Daemon) RunOnce(ctx context.Context) error {
+	if err := d.start(ctx); err != nil {
+		return err
+	}
+	d.allDue = true
+	d.runOnce(ctx)
+	switch {
+	case d.skipped:
+		return ErrCycleSkipped
+	case d.checkFailed || d.panicked:
+		return ErrCheckFailed
+	case d.updateFailed:
+		return ErrUpdateFailed
+	}
+	return nil
+}
+
+// Wait waits for the notifications & propagation checks started by previous cycles to finish, e.g. before exiting
+// after RunOnce. Notifications waiting for their batch window are sent at once; propagation checks may take up to
+// the config's propagation window.
+func (d *Daemon) Wait() {
+	d.batcher.flush()
+	d.background.Wait()
+}
+
+// Flush writes any state not yet on disk, including changes whose writes are being limited.
+func (d *Daemon) Flush() error {
+	return d.flushState(true)
+}
+
+// record identifies a DNS record managed by the daemon: the A (IPv4) or AAAA (IPv6) record of a hostname.
+type record struct {
+	hostname string
+	family   Family
+}
+
+// runOnce runs a single check & update cycle. The whole cycle is bounded by the config's cycle deadline;
+// once it passes (or ctx is done), any in-flight work is cancelled. A panic during the cycle is logged and treated as a failure.
+func (d *Daemon) runOnce(ctx context.Context) {
+	cfg := d.cfg
+	deadline := time.Duration(cfg.CycleDeadline * float64(time.Second))
+	ctx, cancel := context.WithTimeout(ctx, deadline)
+	defer cancel()
+	defer func() {
+		if ctx.Err() == context.DeadlineExceeded {
+			warnf("Cycle deadline exceeded (%v); in-flight work was cancelled", deadline)
+		}
+	}()
+	defer d.metrics.emit(cfg.statsd)
+	d.checkFailed, d.updateFailed, d.panicked, d.skipped, d.serverError = false, false, false, false, false
+	defer func() {
+		failing := d.checkFailures > 0 || d.updateFailures > 0
+		d.countFailures()
+		if d.graceCycles > 0 && !d.skipped {
+			d.graceCycles--
+		}
+		d.metrics.recordCycle(!d.checkFailed && !d.updateFailed && !d.skipped, d.panicked)
+		if failing && d.checkFailures == 0 && d.updateFailures == 0 {
+			notify(cfg, &d.background, event{Event: eventRecovered, Hostnames: cfg.Hostnames, Timestamp: time.Now()})
+		}
+	}()
+	defer func() {
+		// Keep the daemon running if any part of the cycle panics; the next cycle may well succeed.
+		if r := recover(); r != nil {
+			errorf("Cycle panicked: %v\n%s", r, debug.Stack())
+			d.panicked = true
+			cfg.statsd.count("cycle.panic", 1)
+		}
+	}()
+
+	// Check & update the hostnames that are due; all are due for a scheduled update. The due hostnames are found
+	// before the connectivity check, so that a skipped cycle still counts as their run & is not immediately repeated.
+	now := time.Now()
+	scheduledDue := !d.nextScheduled.IsZero() && !now.Before(d.nextScheduled)
+	d.due = map[string]bool{}
+	for _, h := range cfg.Hostnames {
+		if d.allDue || scheduledDue || !now.Before(d.nextDue[h]) {
+			d.due[h] = true
+		}
+	}
+	d.allDue = false
+
+	// Once the scheduled update fires, every record is re-sent, by this cycle or (for those that fail) by the retries
+	// of later cycles, on their usual schedule; the next scheduled update is due a day later.
+	if scheduledDue {
+		if d.scheduledPending == nil {
+			d.scheduledPending = map[record]bool{}
+		}
+		for _, f := range cfg.families {
+			for _, h := range cfg.HostnamesFor(f) {
+				d.scheduledPending[record{h, f}] = true
+			}
+		}
+		d.nextScheduled = nextTimeOfDay(now, cfg.scheduledUpdateAt)
+	}
+
+	// Check connectivity, if requested.
+	if cfg.RequireDefaultRoute {
+		if err := checkDefaultRoute(cfg.families); err != nil {
+			warnf("No connectivity (no default route), skipping update: %v", err)
+			d.skipped = true
+			return
+		}
+	}
+
+	d.crossCheckMismatches(ctx)
+
+	// Check & update each IP family independently, so that a failure for one does not affect the other.
+	if cfg.ForceUpdateInterval > 0 {
+		interval := time.Duration(cfg.ForceUpdateInterval * float64(time.Second))
+		for _, f := range cfg.families {
+			for _, h := range cfg.HostnamesFor(f) {
+				if time.Since(d.store.lastUpdate(h)) >= interval {
+					d.keepalivePending[record{h, f}] = true
+				}
+			}
+		}
+	}
+	d.chosen = map[string]Family{}
+	for _, f := range cfg.familyOrder() {
+		for _, h := range cfg.HostnamesFor(f) {
+			if _, ok := d.chosen[h]; d.due[h] && !ok {
+				d.runFamily(ctx, f)
+				break
+			}
+		}
+	}
+	if len(d.scheduledPending) == 0 {
+		d.scheduledPending = nil
+	}
+	d.updateTXTRecords(ctx)
+
+	// Update lifetime totals, if persisted.
+	if lifetime := d.metrics.lifetime(); cfg.PersistCounters && d.store.state.Lifetime != lifetime {
+		d.store.state.Lifetime = lifetime
+		d.store.dirty = true
+	}
+	if err := d.flushState(false); err != nil {
+		errorf("Could not update on-disk state: %v", err)
+	}
+	d.snapshotState()
+}
+
+// snapshotState updates the state snapshot served at /state, if it is served.
+func (d *Daemon) snapshotState() {
+	if !d.servingState {
+		return
+	}
+	b, err := d.store.snapshot()
+	if err != nil {
+		errorf("Could not snapshot state: %v", err)
+		return
+	}
+	d.metrics.setState(b)
+}
+
+// nextCycle schedules each hostname's next check & update after its last (at the latest, the cycle started at
+// the given time), returning the time at which the next cycle should start. After failed cycles, every hostname
+// backs off alike.
+func (d *Daemon) nextCycle(start time.Time) time.Time {
+	wait := d.nextInterval(start)
+	backoff := d.serverError || d.checkFailures > 0 || d.updateFailures > 0
+	for _, h := range d.cfg.Hostnames {
+		last, ok := d.lastRun[h]
+		if !ok {
+			continue // due at its first (possibly jittered) time
+		}
+		if backoff {
+			d.nextDue[h] = last.Add(wait)
+		} else {
+			d.nextDue[h] = last.Add(d.cfg.hostCheckInterval(h, last))
+		}
+	}
+	return d.earliestDue()
+}
+
+// earliestDue returns the time at which the next cycle should start: when the first hostname is due, or the next
+// scheduled update if sooner.
+func (d *Daemon) earliestDue() time.Time {
+	var next time.Time
+	for i, h := range d.cfg.Hostnames {
+		if due := d.nextDue[h]; i == 0 || due.Before(next) {
+			next = due
+		}
+	}
+	if !d.nextScheduled.IsZero() && d.nextScheduled.Before(next) {
+		next = d.nextScheduled
+	}
+	return next
+}
+
+// setConfig switches the daemon to the given config, e.g. after it is reloaded.
+func (d *Daemon) setConfig(cfg *Config) {
+	if cfg.MetricsAddr != d.cfg.MetricsAddr || cfg.AdminAddr != d.cfg.AdminAddr || cfg.ServeState != d.cfg.ServeState || cfg.WatchConfig != d.cfg.WatchConfig {
+		warnf("metrics_addr, admin_addr, serve_state, or watch_config changed; the change takes effect on restart")
+	}
+	d.metrics.setHealthLimits(time.Duration(cfg.HealthMaxAge*float64(time.Second)), cfg.HealthMaxUpdateFailures)
+	d.cfg.statsd.close()
+	d.cfg = cfg
+	d.detector = NewDetector(cfg, nil)
+	d.client = NewClient(cfg, nil)
+
+	// The IP sources may have changed, so the next detections are taken as the new baseline: events batched under
+	// the old config are sent now, & mismatches found by propagation checks of IPs detected before are dropped.
+	d.detectedIPs, d.detectedAt = map[Family]string{}, map[Family]time.Time{}
+	d.batcher.flush()
+	d.dropMismatches()
+	d.graceCycles = cfg.ReloadGraceCycles
+	d.history.setConfig(cfg.History)
+	setLogPrefix(cfg.InstanceLabel)
+
+	// Hostnames blocked by permanent errors are retried, since the config change may have fixed them.
+	d.blockedHosts = map[string]error{}
+	d.scheduledPending = nil
+	d.keepalivePending = map[record]bool{}
+	d.nextScheduled = time.Time{}
+	if cfg.ScheduledUpdateAt != "" {
+		d.nextScheduled = nextTimeOfDay(time.Now(), cfg.scheduledUpdateAt)
+	}
+	infof("Reloaded config: will check & update %v IP of %v every %v", cfg.families, cfg.Hostnames, time.Duration(cfg.UpdateFrequency*float64(time.Second)))
+}
+
+// countFailures updates the consecutive failure counts at the end of a cycle. Update failures are only known to
+// have stopped once a cycle's IP checks succeed, since updates are not attempted otherwise.
+func (d *Daemon) countFailures() {
+	if d.checkFailed || d.panicked {
+		d.checkFailures++
+	} else {
+		d.checkFailures = 0
+	}
+	if d.updateFailed {
+		d.updateFailures++
+	} else if !d.checkFailed && !d.panicked {
+		d.updateFailures = 0
+	}
+}
+
+// nextInterval returns how long to wait after the given time before the next cycle: normally the config's check
+// interval, but backing off exponentially (with jitter) after consecutive failed cycles.
+func (d *Daemon) nextInterval(t time.Time) time.Duration {
+	failures := d.checkFailures
+	if d.updateFailures > failures {
+		failures = d.updateFailures
+	}
+	if d.serverError {
+		// Google asks clients to wait (at least five minutes) after a 911 before retrying.
+		wait := jittered(math.Max(d.cfg.MaxBackoff, 300))
+		infof("Backing off after server-side error: next attempt in %v", wait.Round(time.Second))
+		return wait
+	}
+	if failures == 0 {
+		return d.cfg.checkInterval(t)
+	}
+	wait := d.cfg.backoffInterval(failures)
+	infof("Backing off after %d consecutive failed IP checks and %d consecutive failed updates: next attempt in %v",
+		d.checkFailures, d.updateFailures, wait.Round(time.Second))
+	return wait
+}
+
+// ipChange is a change of a record's IP, from old to new.
+type ipChange struct {
+	old, new string
+}
+
+// runFamily gets the current IP of the given family and updates each hostname's record of that family, as needed.
+func (d *Daemon) runFamily(ctx context.Context, family Family) {
+	cfg := d.cfg
+
+	// Get current IP from service, unless every due hostname's IP is fixed by the config or it was just checked for
+	// other hostnames.
+	detect, fallback := false, true
+	for _, h := range cfg.HostnamesFor(family) {
+		if _, ok := d.chosen[h]; d.due[h] && !ok && cfg.fixedIP(h, family) == "" {
+			detect = true
+			fallback = fallback && cfg.singleRecord(h) && cfg.familyOrder()[0] == family
+		}
+	}
+	var curIP string
+	if !detect {
+		debugf("Every due %s record has a fixed IP, skipping %s IP check", family, family)
+	} else if at, ok := d.detectedAt[family]; ok && time.Since(at) < time.Duration(cfg.IPCache*float64(time.Second)) {
+		curIP = d.detectedIPs[family]
+		debugf("Using %s IP %v detected %v ago", family, curIP, time.Since(at).Round(time.Millisecond))
+	} else {
+		d.progress.publish(progress{Event: progressCheckStarted, Family: family})
+		if err := cfg.RetryPolicy.retry(ctx, "check "+string(family)+" IP", func() (err error) {
+			start := time.Now()
+			defer func() { cfg.statsd.outcome("check", start, err) }()
+			curIP, err = d.detector.Detect(ctx, family)
+			return err
+		}); err != nil {
+			d.metrics.recordCheck(family, "", err)
+			d.progress.publish(progress{Event: progressCheckResult, Family: family, Error: err.Error()})
+			if fallback {
+				// Every hostname checked has a record of the other family, which is updated instead.
+				infof("Could not check %s IP, so updating only %s records of %v: %v", family, cfg.familyOrder()[1], cfg.HostnamesFor(family), err)
+				return
+			}
+			d.checkFailed = true
+			warnf("Could not check %s IP: %v", family, err)
+			notify(cfg, &d.background, event{Event: eventCheckFailed, Family: family, Hostnames: cfg.HostnamesFor(family), Error: err.Error(), Timestamp: time.Now()})
+			return
+		}
+		d.metrics.recordCheck(family, curIP, nil)
+		d.progress.publish(progress{Event: progressCheckResult, Family: family, IP: curIP})
+		d.detectedAt[family] = time.Now()
+	}
+
+	if detect && curIP != d.detectedIPs[family] {
+		warnIfCGNAT(curIP)
+		if cfg.IPAnnotateURL != "" {
+			annotateIP(cfg, curIP)
+		}
+		d.detectedIPs[family] = curIP
+	}
+
+	// Update Google IP for each hostname, as needed. A failure for one hostname does not affect the others.
+	d.changed = map[ipChange][]string{}
+	for _, h := range cfg.HostnamesFor(family) {
+		if !d.due[h] {
+			continue
+		}
+		r, ip := record{h, family}, curIP
+		if cfg.singleRecord(h) {
+			if _, ok := d.chosen[h]; ok {
+				// Only the record of the family chosen earlier in the cycle is updated.
+				delete(d.scheduledPending, r)
+				delete(d.keepalivePending, r)
+				continue
+			}
+			d.chosen[h] = family
+			if last, ok := d.lastChosen[h]; !ok || last != family {
+				if family == cfg.familyOrder()[0] {
+					infof("Updating only %s record of %s: %s IP is available & preferred", family, h, family)
+				} else {
+					infof("Updating only %s record of %s: preferred %s IP is not available", family, h, cfg.familyOrder()[0])
+				}
+				d.lastChosen[h] = family
+			}
+		}
+		if fixed := cfg.fixedIP(h, family); fixed != "" {
+			ip = fixed
+		}
+		if cfg.ReconcileAtStartup && !d.reconciled[r] {
+			d.reconcile(ctx, r, ip)
+		}
+		if d.updateRecord(ctx, r, ip, d.scheduledPending[r] || d.keepalivePending[r]) {
+			delete(d.scheduledPending, r)
+			delete(d.keepalivePending, r)
+		}
+	}
+
+	// Notify of changes, grouping hostnames changed from & to the same IPs.
+	var changes []ipChange
+	for c := range d.changed {
+		changes = append(changes, c)
+	}
+	sort.Slice(changes, func(i, j int) bool {
+		if changes[i].new != changes[j].new {
+			return changes[i].new < changes[j].new
+		}
+		return changes[i].old < changes[j].old
+	})
+	for _, c := range changes {
+		ev := event{Event: eventIPChanged, OldIP: c.old, NewIP: c.new, Family: family, Hostnames: d.changed[c], Timestamp: time.Now()}
+		if cfg.NotifyBatchWindow > 0 && d.graceCycles == 0 {
+			d.batcher.add(cfg, &d.background, ev)
+		} else {
+			notify(cfg, &d.background, ev)
+		}
+	}
+}
+
+// updateRecord publishes the current IP to the given record if it differs from the record's last published IP
+// (or if force is set), reporting whether the record is now up to date.
+func (d *Daemon) updateRecord(ctx context.Context, r record, curIP string, force bool) bool {
+	cfg := d.cfg
+	hostname := r.hostname
+	if d.blockedHosts[hostname] != nil {
+		return true
+	}
+	// The state's IP tracks our conception of what Google thinks the record's IP is.
+	pubIP := d.store.IP(hostname, r.family)
+	if curIP != pubIP && cfg.PublishOnce {
+		live, err := ipIsLive(ctx, cfg, hostname, curIP)
+		if err != nil {
+			warnf("Could not check whether IP is already published for %s, updating anyway: %v", hostname, err)
+		} else if live {
+			infof("Detected new IP for %s (%v -> %v), but it already resolves to it; not re-publishing", hostname, pubIP, curIP)
+			d.store.SetIP(hostname, r.family, curIP)
+			d.metrics.recordPublished(r, curIP)
+			pubIP = curIP
+		}
+	}
+	if curIP == pubIP && !force {
+		return true
+	}
+
+	if curIP != pubIP {
+		infof("Detected new IP for %s (%v -> %v), updating", hostname, pubIP, curIP)
+	} else if d.keepalivePending[r] && !d.scheduledPending[r] {
+		infof("Forced update (not updated in %v), re-sending IP %v for %s", time.Duration(cfg.ForceUpdateInterval*float64(time.Second)), curIP, hostname)
+	} else {
+		infof("Scheduled update, re-sending IP %v for %s", curIP, hostname)
+	}
+	if cfg.VerifyHostname {
+		if err := checkHostnameExists(ctx, cfg, hostname); err != nil {
+			d.metrics.recordUpdate(r, cfg.hosts[hostname].Provider, err)
+			d.updateFailed = true
+			warnf("Not updating IP for %s: %v", hostname, err)
+			return false
+		}
+	}
+	if d.DryRun {
+		infof("Dry run: would update %s record of %s to %v with %s provider", r.family, hostname, curIP, cfg.hosts[hostname].Provider)
+		return true
+	}
+	var resp *Response
+	d.progress.publish(progress{Event: progressUpdateSent, Family: r.family, Hostname: hostname, IP: curIP})
+	err := cfg.retryPolicy(hostname).retry(ctx, "update IP for "+hostname, func() (err error) {
+		start := time.Now()
+		resp, err = d.client.Update(ctx, hostname, r.family, curIP)
+		cfg.statsd.outcome("update", start, err)
+		return err
+	})
+	d.metrics.recordUpdate(r, cfg.hosts[hostname].Provider, err)
+	res := progress{Event: progressUpdateResult, Family: r.family, Hostname: hostname, IP: curIP}
+	if err != nil {
+		res.Error = err.Error()
+	}
+	d.progress.publish(res)
+	entry := HistoryEntry{Time: time.Now(), Hostname: hostname, Family: r.family, Provider: cfg.hosts[hostname].Provider, OldIP: pubIP, NewIP: curIP, Forced: curIP == pubIP, Outcome: "success"}
+	if resp != nil {
+		entry.Response = resp.Body
+	}
+	if err != nil {
+		entry.Outcome, entry.Error = "failure", err.Error()
+	}
+	d.history.append(entry)
+	if err != nil {
+		d.updateFailed = true
+		ev := event{Event: eventUpdateFailed, OldIP: pubIP, NewIP: curIP, Family: r.family, Hostnames: []string{hostname}, Error: err.Error(), Timestamp: time.Now()}
+		respErr, ok := err.(*responseError)
+		if ok && respErr.code == "badauth" {
+			ev.Event = eventAuthFailed
+		}
+		ev.Permanent = ok && respErr.permanent()
+		notify(cfg, &d.background, ev)
+		if ok {
+			if respErr.permanent() {
+				errorf("Could not update IP for %s, and will not retry until restarted: %v", hostname, err)
+				d.blockedHosts[hostname] = err
+				return true
+			}
+			d.serverError = true
+		}
+		warnf("Could not update IP for %s: %v", hostname, err)
+		return false
+	}
+	if curIP != pubIP {
+		c := ipChange{pubIP, curIP}
+		d.changed[c] = append(d.changed[c], hostname)
+	}
+	d.store.SetIP(hostname, r.family, curIP)
+	d.metrics.recordPublished(r, curIP)
+	d.store.recordUpdate(hostname, resp, curIP == pubIP && d.keepalivePending[r])
+	if cfg.hosts[hostname].TXTRecord != "" {
+		d.txtPending[hostname] = true
+	}
+	if cfg.VerifyPropagation != nil {
+		var mismatched func([]string)
+		if url := d.detector.sourceURLs[r.family]; cfg.VerifyPropagation.CrossCheck && url != "" && cfg.fixedIP(hostname, r.family) == "" {
+			mismatched = func(dnsIPs []string) {
+				select {
+				case d.mismatches <- propagationMismatch{r, curIP, url, dnsIPs}:
+				default:
+					warnf("Too many propagation mismatches to cross-check, not cross-checking %s record of %s", r.family, hostname)
+				}
+			}
+		}
+		verifyPropagation(cfg, d.metrics, &d.background, r, curIP, mismatched)
+	}
+	return true
+}
+
+// crossCheckMismatches handles the records found by propagation verification to resolve to other IPs than the
+// ones published (if verify_propagation.cross_check is set). Each record's IP is detected again with the IP check
+// URLs other than the one that detected the published IP; if they agree with DNS, that URL is taken to have reported
+// a bad IP, so the record's state is corrected to the IP it resolves to & the agreeing URL is preferred by later
+// checks, rather than re-publishing the bad IP.
+func (d *Daemon) crossCheckMismatches(ctx context.Context) {
+	if d.graceCycles > 0 {
+		d.dropMismatches()
+		return
+	}
+	for {
+		var m propagationMismatch
+		select {
+		case m = <-d.mismatches:
+		default:
+			return
+		}
+		hostname, family := m.r.hostname, m.r.family
+		if _, ok := d.cfg.hosts[hostname]; !ok || d.store.IP(hostname, family) != m.ip {
+			continue // removed or updated since
+		}
+		ip, url, err := d.detector.checkIPExcluding(ctx, family, m.url)
+		if err != nil {
+			warnf("Could not cross-check %s IP after %s record of %s did not resolve to %v: %v", family, family, hostname, m.ip, err)
+			continue
+		}
+		if !contains(m.dnsIPs, ip) {
+			infof("Cross-checked %s IP with %s: %v, which %s record of %s does not resolve to (it resolves to %v); keeping state", family, url, ip, family, hostname, m.dnsIPs)
+			continue
+		}
+		warnf("IP check URL %s reported %s IP %v, but %s reports %v, which %s resolves to; correcting state to %v & preferring %s",
+			m.url, family, m.ip, url, ip, hostname, ip, url)
+		d.store.SetIP(hostname, family, ip)
+		d.metrics.recordPublished(m.r, ip)
+		d.detector.checkURLs[family] = url
+		delete(d.detectedAt, family) // don't reuse the bad IP
+	}
+}
+
+// dropMismatches discards the records waiting to be cross-checked, as they were found by propagation checks of IPs
+// detected before a config reload.
+func (d *Daemon) dropMismatches() {
+	for {
+		select {
+		case m := <-d.mismatches:
+			debugf("Not cross-checking %s record of %s, which was published before the config was reloaded", m.r.family, m.r.hostname)
+		default:
+			return
+		}
+	}
+}
+
+// updateTXTRecords writes the TXT record of each hostname whose records were updated since its TXT record was last
+// written, with the hostname's published IPs & the time of its last update. A failed write is retried by later
+// cycles.
+func (d *Daemon) updateTXTRecords(ctx context.Context) {
+	cfg := d.cfg
+	var hostnames []string
+	for h := range d.txtPending {
+		hostnames = append(hostnames, h)
+	}
+	sort.Strings(hostnames)
+	for _, h := range hostnames {
+		hc, ok := cfg.hosts[h]
+		if !ok || hc.TXTRecord == "" {
+			delete(d.txtPending, h) // no longer configured
+			continue
+		}
+		var parts []string
+		for _, f := range hc.families {
+			if ip := d.store.IP(h, f); ip != "" {
+				parts = append(parts, fmt.Sprintf("%s=%s", txtKeys[f], ip))
+			}
+		}
+		parts = append(parts, "updated="+d.store.lastUpdate(h).UTC().Format(time.RFC3339))
+		content := strings.Join(parts, ";")
+		err := cfg.retryPolicy(h).retry(ctx, "update TXT record of "+h, func() (err error) {
+			start := time.Now()
+			err = d.client.UpdateTXT(ctx, h, content)
+			cfg.statsd.outcome("update_txt", start, err)
+			return err
+		})
+		if err != nil {
+			d.updateFailed = true
+			warnf("Could not update TXT record %s of %s, will retry: %v", hc.TXTRecord, h, err)
+			continue
+		}
+		infof("Updated TXT record %s of %s to %q", hc.TXTRecord, h, content)
+		delete(d.txtPending, h)
+	}
+}
+
+// txtKeys maps each family to the key of its IP in TXT records.
+var txtKeys = map[Family]string{IPv4: "ip", IPv6: "ipv6"}
+
+// reconcile replaces the record's published IP in state with the IP it resolves to, so that the record is updated
+// if it was changed elsewhere (or updated from elsewhere) since the state was written. If the lookup fails, the state
+// is trusted.
+func (d *Daemon) reconcile(ctx context.Context, r record, curIP string) {
+	d.reconciled[r] = true
+	ips, err := resolveRecord(ctx, d.cfg, r)
+	if dnsErr, ok := err.(*net.DNSError); ok && dnsErr.IsNotFound {
+		ips, err = nil, nil
+	}
+	if err != nil {
+		warnf("Could not reconcile %s record of %s with DNS, trusting state: %v", r.family, r.hostname, err)
+		return
+	}
+	pubIP := d.store.IP(r.hostname, r.family)
+	var dnsIP string
+	for _, ip := range ips {
+		if ip == curIP || ip == pubIP {
+			dnsIP = ip
+		}
+		if ip == curIP {
+			break
+		}
+	}
+	if dnsIP == "" && len(ips) > 0 {
+		dnsIP = ips[0]
+	}
+	if dnsIP == pubIP {
+		debugf("%s record of %s resolves to %v, as in state", r.family, r.hostname, pubIP)
+		return
+	}
+	switch {
+	case dnsIP == "":
+		infof("%s record of %s does not resolve, though state has %v; will update", r.family, r.hostname, pubIP)
+	case pubIP == "":
+		infof("%s record of %s resolves to %v; using it as published IP", r.family, r.hostname, dnsIP)
+	default:
+		infof("%s record of %s resolves to %v, though state has %v; using it as published IP", r.family, r.hostname, dnsIP, pubIP)
+	}
+	if dnsIP != "" {
+		d.metrics.recordPublished(r, dnsIP)
+	}
+	d.store.SetIP(r.hostname, r.family, dnsIP)
+}
+
+// flushState writes the in-memory state to disk if it has changed. A changed IP is written immediately but other
+// changes are written at most every state_write_interval_s, unless force is set.
+func (d *Daemon) flushState(force bool) error {
+	if d.DryRun {
+		return nil
+	}
+	var interval time.Duration
+	if !force {
+		interval = time.Duration(d.cfg.StateWriteInterval * float64(time.Second))
+	}
+	return d.store.Flush(interval)
+}
+
+// checkDefaultRoute returns an error if the system has no route that could reach the internet over any of the given
+// families. Connecting a UDP socket sends no packets, but fails immediately if no route covers the destination;
+// a documentation address (TEST-NET-3, or 2001:db8::/32) is used as the destination so that only a default route
+// will match.
+func checkDefaultRoute(families []Family) error {
+	var errs []string
+	for _, f := range families {
+		network, addr := "udp4", "203.0.113.1:9"
+		if f == IPv6 {
+			network, addr = "udp6", "[2001:db8::1]:9"
+		}
+		conn, err := net.Dial(network, addr)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", f, err))
+			continue
+		}
+		return conn.Close()
+	}
+	return errors.New(strings.Join(errs, "; "))
+}
+
+// waitForClockSync blocks until the system clock appears sane, i.e. has been set by NTP or similar, or until ctx is
+// done, when it returns ctx's error. Devices without an RTC often boot with a clock far in the past.
+func waitForClockSync(ctx context.Context) error {
+	const minSaneYear = 2021
+	for now := time.Now(); now.Year() < minSaneYear; now = time.Now() {
+		warnf("System clock (%v) appears unset, waiting for time sync", now.Format(time.RFC3339))
+		t := time.NewTimer(10 * time.Second)
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			return ctx.Err()
+		}
+	}
+	return nil
+}
@@ -0,0 +1,269 @@
+package gdddc
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testProvider is a dyndns2 server that also serves an IP check (at /ip), reporting ip, & counts the updates it
+// receives (at /nic/update). Updates fail with a server error while fail is set.
+type testProvider struct {
+	*httptest.Server
+	mu      sync.Mutex
+	ip      string
+	fail    bool
+	updates int
+}
+
+func newTestProvider(ip string) *testProvider {
+	p := &testProvider{ip: ip}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ip", func(w http.ResponseWriter, r *http.Request) {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		fmt.Fprint(w, p.ip)
+	})
+	mux.HandleFunc("/nic/update", func(w http.ResponseWriter, r *http.Request) {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		p.updates++
+		if p.fail {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintf(w, "good %s", r.URL.Query().Get("myip"))
+	})
+	p.Server = httptest.NewServer(mux)
+	return p
+}
+
+// config returns a config updating a.example.com through the provider, with the given extra JSON fields.
+func (p *testProvider) config(t *testing.T, extra string) *Config {
+	t.Helper()
+	return testConfig(t, fmt.Sprintf(`{"hostname": "a.example.com", "provider": "dyndns2", "update_url": "%s/nic/update", "username": "u", "password": "p", "ip_check_url": "%s/ip", "update_freq_s": 60%s}`, p.URL, p.URL, extra))
+}
+
+func (p *testProvider) updateCount() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.updates
+}
+
+func (p *testProvider) setFail(fail bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.fail = fail
+}
+
+func TestRunOnceRecoversFromPanic(t *testing.T) {
+	p := newTestProvider("203.0.113.7")
+	defer p.Close()
+	d := NewDaemon(p.config(t, ""), testStore(t, ""))
+	ctx := context.Background()
+
+	// Make each cycle panic once its IP check is done. The failed cycles back off exponentially.
+	d.detectedAt = nil
+	for failures, wantWait := 1, 120*time.Second; failures <= 3; failures, wantWait = failures+1, 2*wantWait {
+		if err := d.RunOnce(ctx); err != ErrCheckFailed {
+			t.Fatalf("RunOnce of panicking cycle %d got error %v, want %v", failures, err, ErrCheckFailed)
+		}
+		if d.checkFailures != failures {
+			t.Errorf("After panicking cycle %d, got %d consecutive failures, want %d", failures, d.checkFailures, failures)
+		}
+		if wait := d.nextInterval(time.Now()); wait < wantWait || wait > wantWait+wantWait/10 {
+			t.Errorf("After panicking cycle %d, next cycle in %v, want %v (plus up to 10%% jitter)", failures, wait, wantWait)
+		}
+	}
+
+	// Once cycles stop panicking, the record is updated & the backoff is reset.
+	d.detectedAt = map[Family]time.Time{}
+	if err := d.RunOnce(ctx); err != nil {
+		t.Fatalf("RunOnce got unexpected error: %v", err)
+	}
+	if got, want := d.store.IP("a.example.com", IPv4), "203.0.113.7"; got != want {
+		t.Errorf("Published IP = %q, want %q", got, want)
+	}
+	if d.checkFailures != 0 {
+		t.Errorf("After successful cycle, got %d consecutive failures, want 0", d.checkFailures)
+	}
+	if got, want := d.nextInterval(time.Now()), 60*time.Second; got != want {
+		t.Errorf("After successful cycle, next cycle in %v, want %v", got, want)
+	}
+}
+
+func TestRunOnceSkipsUnchangedStateWrite(t *testing.T) {
+	p := newTestProvider("203.0.113.7")
+	defer p.Close()
+	d := NewDaemon(p.config(t, ""), testStore(t, ""))
+	ctx := context.Background()
+	if err := d.RunOnce(ctx); err != nil {
+		t.Fatalf("RunOnce got unexpected error: %v", err)
+	}
+	if _, err := os.Stat(d.store.filename); err != nil {
+		t.Fatalf("RunOnce did not write state after publishing new IP: %v", err)
+	}
+
+	// A cycle that finds the IP unchanged neither updates the record nor writes state.
+	if err := os.Remove(d.store.filename); err != nil {
+		t.Fatalf("Could not remove state file: %v", err)
+	}
+	d.detectedAt = map[Family]time.Time{} // don't reuse the IP just detected
+	if err := d.RunOnce(ctx); err != nil {
+		t.Fatalf("RunOnce got unexpected error: %v", err)
+	}
+	if got := p.updateCount(); got != 1 {
+		t.Errorf("Got %d updates, want 1", got)
+	}
+	if _, err := os.Stat(d.store.filename); !os.IsNotExist(err) {
+		t.Errorf("RunOnce with unchanged IP wrote state (stat error: %v)", err)
+	}
+}
+
+func TestFamilyPreference(t *testing.T) {
+	p := newTestProvider("203.0.113.7")
+	defer p.Close()
+	l, err := net.Listen("tcp6", "[::1]:0")
+	if err != nil {
+		t.Skipf("Could not listen on IPv6 loopback: %v", err)
+	}
+	var v6Up atomic.Value
+	v6Up.Store(true)
+	v6 := &httptest.Server{Listener: l, Config: &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !v6Up.Load().(bool) {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprint(w, "2001:db8::7")
+	})}}
+	v6.Start()
+	defer v6.Close()
+	d := NewDaemon(p.config(t, fmt.Sprintf(`, "protocol": "both", "family_preference": "ipv6-first", "ip_check_url_v6": "%s", "retry_policy": {"max_attempts": 1}`, v6.URL)), testStore(t, ""))
+	ctx := context.Background()
+
+	// While an IPv6 address is detected, only the AAAA record is updated.
+	if err := d.RunOnce(ctx); err != nil {
+		t.Fatalf("RunOnce got unexpected error: %v", err)
+	}
+	if got, want := d.store.IP("a.example.com", IPv6), "2001:db8::7"; got != want {
+		t.Errorf("Published IPv6 = %q, want %q", got, want)
+	}
+	if got := d.store.IP("a.example.com", IPv4); got != "" {
+		t.Errorf("Published IPv4 = %q, want none", got)
+	}
+
+	// Otherwise, only the A record is updated, & the cycle does not fail.
+	v6Up.Store(false)
+	d.detectedAt = map[Family]time.Time{}
+	if err := d.RunOnce(ctx); err != nil {
+		t.Fatalf("RunOnce without IPv6 got unexpected error: %v", err)
+	}
+	if got, want := d.store.IP("a.example.com", IPv4), "203.0.113.7"; got != want {
+		t.Errorf("Published IPv4 = %q, want %q", got, want)
+	}
+	if got := p.updateCount(); got != 2 {
+		t.Errorf("Got %d updates, want 2", got)
+	}
+}
+
+func TestRunWaitsForNotifications(t *testing.T) {
+	p := newTestProvider("203.0.113.7")
+	defer p.Close()
+	var once sync.Once
+	notified := make(chan struct{})
+	var delivered int32
+	wh := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		once.Do(func() { close(notified) })
+		time.Sleep(200 * time.Millisecond)
+		atomic.AddInt32(&delivered, 1)
+	}))
+	defer wh.Close()
+	d := NewDaemon(p.config(t, fmt.Sprintf(`, "notify_url": "%s", "notify_on": ["change"]`, wh.URL)), testStore(t, ""))
+
+	// Shut down while the first cycle's ip_changed notification is being sent.
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- d.Run(ctx, nil) }()
+	<-notified
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatalf("Run got unexpected error: %v", err)
+	}
+	if got := atomic.LoadInt32(&delivered); got != 1 {
+		t.Errorf("When Run returned, %d notifications were delivered, want 1", got)
+	}
+}
+
+func TestConsensus(t *testing.T) {
+	for _, test := range []struct {
+		desc      string
+		reported  []string // the IP reported by each IP check URL
+		consensus int
+		want      string // the IP published, or "" if the IP check fails
+	}{
+		{"quorum", []string{"203.0.113.7", "198.51.100.1", "203.0.113.7"}, 2, "203.0.113.7"},
+		{"quorum after failure", []string{"not an IP", "203.0.113.7", "203.0.113.7"}, 2, "203.0.113.7"},
+		{"tie", []string{"203.0.113.7", "198.51.100.1"}, 2, ""},
+		{"all disagree", []string{"203.0.113.7", "198.51.100.1", "192.0.2.1"}, 2, ""},
+		{"no consensus required", []string{"198.51.100.1", "203.0.113.7"}, 1, "198.51.100.1"},
+	} {
+		p := newTestProvider("")
+		var urls []string
+		for _, ip := range test.reported {
+			ip := ip
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { fmt.Fprint(w, ip) }))
+			defer srv.Close()
+			urls = append(urls, fmt.Sprintf("%q", srv.URL))
+		}
+		cfg := testConfig(t, fmt.Sprintf(`{"hostname": "a.example.com", "provider": "dyndns2", "update_url": "%s/nic/update", "username": "u", "password": "p", "ip_check_url": [%s], "consensus": %d, "retry_policy": {"max_attempts": 1}}`, p.URL, strings.Join(urls, ", "), test.consensus))
+		d := NewDaemon(cfg, testStore(t, ""))
+		err := d.RunOnce(context.Background())
+		switch {
+		case test.want == "" && err != ErrCheckFailed:
+			t.Errorf("%s: RunOnce got error %v, want %v", test.desc, err, ErrCheckFailed)
+		case test.want != "" && err != nil:
+			t.Errorf("%s: RunOnce got unexpected error: %v", test.desc, err)
+		}
+		if got := d.store.IP("a.example.com", IPv4); got != test.want {
+			t.Errorf("%s: published IP %q, want %q", test.desc, got, test.want)
+		}
+		p.Close()
+	}
+}
+
+func TestPublishOnce(t *testing.T) {
+	for _, test := range []struct {
+		desc        string
+		dnsIP       string // the IP the hostname resolves to
+		wantUpdates int
+	}{
+		{"live", "203.0.113.7", 0},
+		{"not live", "198.51.100.1", 1},
+	} {
+		p := newTestProvider("203.0.113.7")
+		doh := newFakeDoH(test.dnsIP)
+		cfg := p.config(t, fmt.Sprintf(`, "publish_once": true, "doh_url": "%s"`, doh.URL))
+		cfg.resolver = newDoHResolver(doh.URL, cfg.UserAgent, doh.Client())
+		d := NewDaemon(cfg, testStore(t, ""))
+		if err := d.RunOnce(context.Background()); err != nil {
+			t.Errorf("%s: RunOnce got unexpected error: %v", test.desc, err)
+		}
+		if got := p.updateCount(); got != test.wantUpdates {
+			t.Errorf("%s: got %d updates, want %d", test.desc, got, test.wantUpdates)
+		}
+		// Either way, the detected IP is taken to be published.
+		if got, want := d.store.IP("a.example.com", IPv4), "203.0.113.7"; got != want {
+			t.Errorf("%s: published IP %q, want %q", test.desc, got, want)
+		}
+		doh.Close()
+		p.Close()
+	}
+}
@@ -0,0 +1,291 @@
+package gdddc
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Detector detects the current IP address of each family, from the network interface, STUN servers, or IP check URLs
+// selected by a Config. It is not safe for concurrent use.
+type Detector struct {
+	cfg        *Config
+	httpClient *http.Client
+	// checkURLs holds the IP check URL of each family that last succeeded, which is tried first in the next check.
+	checkURLs map[Family]string
+	// sourceURLs holds the IP check URL that completed each family's last detection, or "" if another source did.
+	sourceURLs map[Family]string
+	// igd & natPMPGateway hold the router found by the last successful router check, by UPnP or NAT-PMP/PCP.
+	igd           igdService
+	natPMPGateway string
+}
+
+// NewDetector creates a Detector that makes IP checks with the given HTTP client. If httpClient is nil, a client
+// set up per the config is used; it connects over the family being checked, so that a dual-stack IP check service
+// reports the right address.
+func NewDetector(cfg *Config, httpClient *http.Client) *Detector {
+	return &Detector{cfg: cfg, httpClient: httpClient, checkURLs: map[Family]string{}, sourceURLs: map[Family]string{}}
+}
+
+// ipSource is a source from which an IP is detected: a network interface, STUN servers, the router, or (if none is
+// set) the IP check URLs.
+type ipSource struct {
+	name        string // as given in the config
+	iface       string
+	stunServers []string
+	router      bool
+}
+
+// Detect returns the current IP address of the given family, from the first of the config's IP sources that
+// succeeds.
+func (d *Detector) Detect(ctx context.Context, family Family) (string, error) {
+	d.sourceURLs[family] = ""
+	srcs := d.cfg.ipSources[family]
+	if len(srcs) == 1 {
+		return d.detectWith(ctx, family, srcs[0])
+	}
+	var errs []string
+	for i, src := range srcs {
+		ip, err := d.detectWith(ctx, family, src)
+		if err == nil {
+			return ip, nil
+		}
+		if i < len(srcs)-1 {
+			warnf("Could not detect %s IP with source %s, trying next source: %v", family, src.name, err)
+		}
+		errs = append(errs, fmt.Sprintf("%s: %v", src.name, err))
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return "", fmt.Errorf("all IP sources failed (%s)", strings.Join(errs, "; "))
+}
+
+// detectWith returns the current IP address of the given family from the given source.
+func (d *Detector) detectWith(ctx context.Context, family Family, src ipSource) (string, error) {
+	switch {
+	case src.iface != "":
+		return interfaceIP(src.iface, family)
+	case len(src.stunServers) > 0:
+		return stunIP(ctx, d.cfg, src.stunServers, family)
+	case src.router:
+		return d.routerIP(ctx)
+	}
+	ip, url, err := d.checkIP(ctx, family, d.checkURLs[family])
+	if err != nil {
+		return "", err
+	}
+	d.checkURLs[family], d.sourceURLs[family] = url, url
+	return ip, nil
+}
+
+// routerIP returns the router's external IPv4 address. The router is asked by UPnP or, failing that, NAT-PMP or PCP;
+// the router found is asked again in later checks, until it fails. An address that is not public (e.g. when the
+// router is itself behind carrier-grade NAT) is an error, so that another IP source may be used.
+func (d *Detector) routerIP(ctx context.Context) (string, error) {
+	ip, err := d.routerExternalIP(ctx)
+	if err != nil {
+		return "", err
+	}
+	switch parsed := net.ParseIP(ip); {
+	case cgnatNet.Contains(parsed):
+		warnIfCGNAT(ip)
+		return "", fmt.Errorf("router's external address %v is behind carrier-grade NAT", ip)
+	case !parsed.IsGlobalUnicast() || parsed.IsPrivate():
+		return "", fmt.Errorf("router's external address %v is not public; the router is itself behind NAT", ip)
+	}
+	return ip, nil
+}
+
+// routerExternalIP returns the external IPv4 address reported by the router, whether or not it is public.
+func (d *Detector) routerExternalIP(ctx context.Context) (string, error) {
+	if d.igd.controlURL != "" {
+		ip, err := d.igd.externalIP(ctx)
+		if err == nil {
+			return ip, nil
+		}
+		warnf("Could not get external IP from UPnP router at %s, searching again: %v", d.igd.controlURL, err)
+		d.igd = igdService{}
+	}
+	if d.natPMPGateway != "" {
+		ip, err := natPMPExternalIP(ctx, d.natPMPGateway)
+		if err == nil {
+			return ip, nil
+		}
+		warnf("Could not get external IP from NAT-PMP router at %s, searching again: %v", d.natPMPGateway, err)
+		d.natPMPGateway = ""
+	}
+
+	var errs []string
+	igd, err := discoverIGD(ctx)
+	if err == nil {
+		var ip string
+		if ip, err = igd.externalIP(ctx); err == nil {
+			debugf("Using UPnP router at %s", igd.controlURL)
+			d.igd = igd
+			return ip, nil
+		}
+	}
+	errs = append(errs, fmt.Sprintf("UPnP: %v", err))
+	gateway := d.cfg.RouterAddr
+	if gateway == "" {
+		if gateway, err = defaultGateway(); err != nil {
+			errs = append(errs, fmt.Sprintf("NAT-PMP & PCP: %v", err))
+			return "", fmt.Errorf("could not get external IP from router (%s)", strings.Join(errs, "; "))
+		}
+	}
+	ip, err := natPMPExternalIP(ctx, gateway)
+	if err == nil {
+		debugf("Using NAT-PMP router at %s", gateway)
+		d.natPMPGateway = gateway
+		return ip, nil
+	}
+	errs = append(errs, fmt.Sprintf("NAT-PMP: %v", err))
+	if ip, err = pcpExternalIP(ctx, gateway); err == nil {
+		return ip, nil
+	}
+	errs = append(errs, fmt.Sprintf("PCP: %v", err))
+	return "", fmt.Errorf("could not get external IP from router (%s)", strings.Join(errs, "; "))
+}
+
+// checkIP gets the IP address of the given family from the config-specified IP check URLs, trying each in turn
+// (starting with preferredURL, if it is one of them) until the config's consensus number of them agree on an IP.
+// It returns the IP & the URL that completed the consensus.
+func (d *Detector) checkIP(ctx context.Context, family Family, preferredURL string) (string, string, error) {
+	urls := d.cfg.IPCheckURL
+	if family == IPv6 {
+		urls = d.cfg.IPCheckURLv6
+	}
+	return d.checkIPFrom(ctx, family, urls, d.cfg.Consensus, preferredURL)
+}
+
+// checkIPExcluding gets the IP address of the given family like checkIP, but from the config-specified IP check
+// URLs other than the given one (requiring no more of them to agree than there are).
+func (d *Detector) checkIPExcluding(ctx context.Context, family Family, excludedURL string) (string, string, error) {
+	urls := d.cfg.IPCheckURL
+	if family == IPv6 {
+		urls = d.cfg.IPCheckURLv6
+	}
+	var others []string
+	for _, u := range urls {
+		if u != excludedURL {
+			others = append(others, u)
+		}
+	}
+	if len(others) == 0 {
+		return "", "", fmt.Errorf("no IP check URL other than %s is configured", excludedURL)
+	}
+	consensus := d.cfg.Consensus
+	if consensus > len(others) {
+		consensus = len(others)
+	}
+	return d.checkIPFrom(ctx, family, others, consensus, "")
+}
+
+// checkIPFrom gets the IP address of the given family from the given IP check URLs, trying each in turn (starting
+// with preferredURL, if it is one of them) until consensus of them agree on an IP.
+func (d *Detector) checkIPFrom(ctx context.Context, family Family, urls []string, consensus int, preferredURL string) (string, string, error) {
+	if len(urls) == 1 {
+		ip, err := d.checkIPWith(ctx, family, urls[0])
+		return ip, urls[0], err
+	}
+
+	// Try each URL in turn, starting from the preferred one (if any).
+	first := 0
+	for i, u := range urls {
+		if u == preferredURL {
+			first = i
+		}
+	}
+	var errs []string
+	votes := map[string]int{}
+	for i := range urls {
+		url := urls[(first+i)%len(urls)]
+		ip, err := d.checkIPWith(ctx, family, url)
+		if err == nil {
+			if votes[ip]++; votes[ip] >= consensus {
+				return ip, url, nil
+			}
+			continue
+		}
+		debugf("Could not check %s IP with %s: %v", family, url, err)
+		errs = append(errs, fmt.Sprintf("%s: %v", url, err))
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	if len(votes) > 0 {
+		// Some URLs succeeded, but too few of them agreed.
+		errs = append([]string{fmt.Sprintf("IPs reported: %v", votes)}, errs...)
+		return "", "", fmt.Errorf("no IP was reported by %d IP check URLs (%s)", consensus, strings.Join(errs, "; "))
+	}
+	return "", "", fmt.Errorf("all IP check URLs failed (%s)", strings.Join(errs, "; "))
+}
+
+// checkIPWith gets the current IP of the given family from the given IP check URL.
+func (d *Detector) checkIPWith(ctx context.Context, family Family, url string) (string, error) {
+	cfg := d.cfg
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return "", fmt.Errorf("could not create request: %v", err)
+	}
+	req.Header.Set("User-Agent", cfg.UserAgent)
+	client := d.httpClient
+	if client == nil {
+		client = cfg.checkClients[family]
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("could not make request: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 && resp.StatusCode < 400 {
+		return "", fmt.Errorf("redirected to %q, likely by a captive portal (%v)", resp.Header.Get("Location"), resp.Status)
+	}
+	if resp.StatusCode != 200 {
+		return "", fmt.Errorf("HTTP error: %v", resp.Status)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", fmt.Errorf("could not read IP: %v", err)
+	}
+	if cfg.IPCheckMatch == "extract" {
+		return extractIP(string(body), family)
+	}
+	ip, err := parseIP(strings.TrimSpace(string(body)), family)
+	if err != nil {
+		return "", fmt.Errorf("response not IP-shaped: %v", err)
+	}
+	return ip, nil
+}
+
+// ipIsLive reports whether the given hostname currently resolves to the given IP.
+func ipIsLive(ctx context.Context, cfg *Config, hostname, ip string) (bool, error) {
+	ip = canonicalIP(ip)
+	addrs, err := cfg.resolver.LookupHost(ctx, hostname)
+	if err != nil {
+		return false, fmt.Errorf("could not resolve %q: %v", hostname, err)
+	}
+	for _, addr := range addrs {
+		if canonicalIP(addr) == ip {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// checkHostnameExists returns an error if DNS reports that the given hostname does not exist.
+// Other lookup failures are not treated as errors, since they say nothing about the hostname.
+func checkHostnameExists(ctx context.Context, cfg *Config, hostname string) error {
+	_, err := cfg.resolver.LookupHost(ctx, hostname)
+	if dnsErr, ok := err.(*net.DNSError); ok && dnsErr.IsNotFound {
+		return fmt.Errorf("hostname %q does not exist in DNS", hostname)
+	}
+	if err != nil {
+		warnf("Could not verify that hostname %q exists, continuing: %v", hostname, err)
+	}
+	return nil
+}
@@ -0,0 +1,80 @@
+package gdddc
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// testConfig parses the given JSON config, failing the test if it is not valid.
+func testConfig(t *testing.T, config string) *Config {
+	t.Helper()
+	cfg, err := ParseConfig(strings.NewReader(config), "json")
+	if err != nil {
+		t.Fatalf("Could not parse config %s: %v", config, err)
+	}
+	return cfg
+}
+
+func TestCheckIP(t *testing.T) {
+	body := ""
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, body)
+	}))
+	defer srv.Close()
+
+	for _, test := range []struct {
+		match, body string
+		want        string // "" if an error is expected
+	}{
+		{"exact", "203.0.113.7", "203.0.113.7"},
+		{"exact", " 203.0.113.7\n", "203.0.113.7"},
+		{"exact", "::ffff:203.0.113.7", "203.0.113.7"},
+		{"exact", "Current IP Address: 203.0.113.7", ""},
+		{"exact", "2001:db8::1", ""},
+		{"extract", "Current IP Address: 203.0.113.7", "203.0.113.7"},
+		{"extract", "<html><body>203.0.113.7</body></html>", "203.0.113.7"},
+		{"extract", "<html><body>Please log in</body></html>", ""},
+	} {
+		cfg := testConfig(t, fmt.Sprintf(`{"hostname": "a.example.com", "username": "u", "password": "p", "ip_check_url": %q, "ip_check_match": %q}`, srv.URL, test.match))
+		body = test.body
+		got, err := NewDetector(cfg, nil).Detect(context.Background(), IPv4)
+		switch {
+		case test.want == "" && err == nil:
+			t.Errorf("[%s] Detect with body %q = %q, want error", test.match, test.body, got)
+		case test.want != "" && err != nil:
+			t.Errorf("[%s] Detect with body %q got unexpected error: %v", test.match, test.body, err)
+		case got != test.want:
+			t.Errorf("[%s] Detect with body %q = %q, want %q", test.match, test.body, got, test.want)
+		}
+	}
+}
+
+func TestCheckIPRedirect(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/ip", http.StatusFound)
+	})
+	mux.HandleFunc("/ip", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "203.0.113.7")
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	cfg := testConfig(t, fmt.Sprintf(`{"hostname": "a.example.com", "username": "u", "password": "p", "ip_check_url": %q}`, srv.URL))
+	if ip, err := NewDetector(cfg, nil).Detect(context.Background(), IPv4); err == nil || !strings.Contains(err.Error(), "captive portal") {
+		t.Errorf("Detect with redirect got (%q, %v), want captive portal error", ip, err)
+	}
+
+	cfg = testConfig(t, fmt.Sprintf(`{"hostname": "a.example.com", "username": "u", "password": "p", "ip_check_url": %q, "follow_redirects": true}`, srv.URL))
+	ip, err := NewDetector(cfg, nil).Detect(context.Background(), IPv4)
+	if err != nil {
+		t.Fatalf("Detect with redirect & follow_redirects got unexpected error: %v", err)
+	}
+	if want := "203.0.113.7"; ip != want {
+		t.Errorf("Detect with redirect & follow_redirects = %q, want %q", ip, want)
+	}
+}
@@ -0,0 +1,112 @@
+package gdddc
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"time"
+)
+
+// newDoHResolver returns a resolver that sends all of its queries to the given DNS-over-HTTPS (RFC 8484) URL, using
+// the given HTTP client. The client must not itself use the returned resolver.
+func newDoHResolver(url, userAgent string, client *http.Client) *net.Resolver {
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return &dohConn{ctx: ctx, url: url, userAgent: userAgent, client: client}, nil
+		},
+	}
+}
+
+// dohConn is a net.Conn that carries DNS messages to a DNS-over-HTTPS server.
+// Since it is not a net.PacketConn, the Go resolver speaks DNS-over-TCP framing (a two-byte length prefix
+// before each message) over it; each query written is POSTed to the server and the answer is made available to read.
+type dohConn struct {
+	ctx       context.Context
+	url       string
+	userAgent string
+	client    *http.Client
+
+	deadline time.Time
+	wbuf     bytes.Buffer // length-prefixed queries not yet sent
+	rbuf     bytes.Buffer // length-prefixed answers not yet read
+}
+
+func (c *dohConn) Write(b []byte) (int, error) {
+	return c.wbuf.Write(b)
+}
+
+func (c *dohConn) Read(b []byte) (int, error) {
+	if c.rbuf.Len() == 0 {
+		if err := c.roundTrip(); err != nil {
+			return 0, err
+		}
+	}
+	return c.rbuf.Read(b)
+}
+
+// roundTrip sends the next pending query to the DoH server, buffering the answer to be read.
+func (c *dohConn) roundTrip() error {
+	if c.wbuf.Len() < 2 {
+		return io.EOF
+	}
+	n := int(binary.BigEndian.Uint16(c.wbuf.Bytes()[:2]))
+	if c.wbuf.Len() < 2+n {
+		return io.ErrUnexpectedEOF
+	}
+	c.wbuf.Next(2)
+	query := c.wbuf.Next(n)
+
+	ctx := c.ctx
+	if !c.deadline.IsZero() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, c.deadline)
+		defer cancel()
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", c.url, bytes.NewReader(query))
+	if err != nil {
+		return fmt.Errorf("could not create DoH request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+	req.Header.Set("User-Agent", c.userAgent)
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("could not make DoH request: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("DoH HTTP error: %v", resp.Status)
+	}
+	answer, err := ioutil.ReadAll(io.LimitReader(resp.Body, 65535+1))
+	if err != nil {
+		return fmt.Errorf("could not read DoH response: %v", err)
+	}
+	if len(answer) > 65535 {
+		return fmt.Errorf("DoH response too large")
+	}
+
+	var l [2]byte
+	binary.BigEndian.PutUint16(l[:], uint16(len(answer)))
+	c.rbuf.Write(l[:])
+	c.rbuf.Write(answer)
+	return nil
+}
+
+func (c *dohConn) Close() error                       { return nil }
+func (c *dohConn) LocalAddr() net.Addr                { return dohAddr(c.url) }
+func (c *dohConn) RemoteAddr() net.Addr               { return dohAddr(c.url) }
+func (c *dohConn) SetDeadline(t time.Time) error      { c.deadline = t; return nil }
+func (c *dohConn) SetReadDeadline(t time.Time) error  { c.deadline = t; return nil }
+func (c *dohConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// dohAddr is the net.Addr of a DoH server, identified by its URL.
+type dohAddr string
+
+func (a dohAddr) Network() string { return "doh" }
+func (a dohAddr) String() string  { return string(a) }
@@ -0,0 +1,108 @@
+//go:build !windows
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+)
+
+// serviceName labels the launchd job installed by -install_service.
+const serviceName = "com.github.BranLwyd.gdddcd"
+
+// launchdPlist returns the path of the launchd plist installed by -install_service: a daemon if run as root,
+// otherwise an agent of the current user.
+func launchdPlist() (string, error) {
+	if os.Geteuid() == 0 {
+		return filepath.Join("/Library/LaunchDaemons", serviceName+".plist"), nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", fmt.Errorf("could not find home directory: %v", err)
+	}
+	return filepath.Join(home, "Library", "LaunchAgents", serviceName+".plist"), nil
+}
+
+// installService installs & starts a launchd job running the command given by serviceCommand, logging to
+// serviceLogFile.
+func installService() error {
+	if runtime.GOOS != "darwin" {
+		return fmt.Errorf("service installation is not supported on %s", runtime.GOOS)
+	}
+	exe, args, err := serviceCommand()
+	if err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString(`<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
+<plist version="1.0">
+<dict>
+	<key>Label</key>
+	<string>` + serviceName + `</string>
+	<key>ProgramArguments</key>
+	<array>
+`)
+	for _, arg := range append([]string{exe}, args...) {
+		buf.WriteString("\t\t<string>")
+		xml.EscapeText(&buf, []byte(arg))
+		buf.WriteString("</string>\n")
+	}
+	buf.WriteString("\t</array>\n\t<key>StandardErrorPath</key>\n\t<string>")
+	stFile, _ := filepath.Abs(*stateFile)
+	xml.EscapeText(&buf, []byte(serviceLogFile(stFile)))
+	buf.WriteString(`</string>
+	<key>RunAtLoad</key>
+	<true/>
+	<key>KeepAlive</key>
+	<true/>
+</dict>
+</plist>
+`)
+
+	plist, err := launchdPlist()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(plist), 0755); err != nil {
+		return fmt.Errorf("could not create %s: %v", filepath.Dir(plist), err)
+	}
+	if err := ioutil.WriteFile(plist, buf.Bytes(), 0644); err != nil {
+		return fmt.Errorf("could not write plist: %v", err)
+	}
+	if out, err := exec.Command("launchctl", "load", "-w", plist).CombinedOutput(); err != nil {
+		return fmt.Errorf("could not load %s: %v (%s)", plist, err, bytes.TrimSpace(out))
+	}
+	return nil
+}
+
+// uninstallService stops & removes the launchd job installed by installService.
+func uninstallService() error {
+	if runtime.GOOS != "darwin" {
+		return fmt.Errorf("service installation is not supported on %s", runtime.GOOS)
+	}
+	plist, err := launchdPlist()
+	if err != nil {
+		return err
+	}
+	if out, err := exec.Command("launchctl", "unload", "-w", plist).CombinedOutput(); err != nil {
+		return fmt.Errorf("could not unload %s: %v (%s)", plist, err, bytes.TrimSpace(out))
+	}
+	if err := os.Remove(plist); err != nil {
+		return fmt.Errorf("could not remove plist: %v", err)
+	}
+	return nil
+}
+
+// serviceContext returns ctx unchanged: launchd stops the daemon with SIGTERM, which is already handled.
+func serviceContext(ctx context.Context) (context.Context, func(), error) {
+	return ctx, func() {}, nil
+}
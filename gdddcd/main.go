@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/BranLwyd/gdddc"
+)
+
+var (
+	configFile = flag.String("config_file", filepath.Join(defaultDir(), "gdddcd.config"),
+		"File used to track configuration.")
+	configFormat = flag.String("config_format", "",
+		"Format of the config file: json, yaml, or toml. By default, implied by its extension (.yaml or .yml, .toml, or otherwise JSON).")
+	validateConfig = flag.Bool("validate_config", false,
+		"Read & check the config, print it with defaults filled in (and credentials redacted), then exit.")
+	checkProviders = flag.Bool("check_providers", false,
+		"With -validate_config, also check that each hostname's provider can be reached (and, where possible, accepts its credentials).")
+	watchConfig = flag.Bool("watch_config", false,
+		"Reload the config (as on SIGHUP) whenever the config file changes. If given, overrides the config's watch_config.")
+	stateFile = flag.String("state_file", filepath.Join(defaultDir(), "gdddcd.state"),
+		"File used to track state.")
+	readRetries = flag.Int("read_retries", 3,
+		"Number of times to re-read a config or state file that is not valid JSON, in case it is being replaced.")
+	readRetryDelay = flag.Duration("read_retry_delay", 200*time.Millisecond,
+		"Delay between re-reads of a config or state file that is not valid JSON.")
+	once = flag.Bool("once", false,
+		"Run a single check & update cycle (waiting for its notifications & propagation checks), then exit with status 0 on success, 2 if an IP check failed, 3 if an update failed, or 4 if the cycle was skipped for lack of a default route.")
+	dryRun = flag.Bool("dry_run", false,
+		"Check the IP & log the updates that would be sent, without sending them or writing state.")
+	logLevel = flag.String("log_level", "info",
+		"Minimum level of logged messages: debug, info, warn, or error.")
+	logFormat = flag.String("log_format", "text",
+		"Format of logged messages: text, or json for one JSON object per line.")
+	install = flag.Bool("install_service", false,
+		"Install & start a service (a launchd job on macOS, or a Windows service) running gdddcd with the other given flags, then exit.")
+	uninstall = flag.Bool("uninstall_service", false,
+		"Stop & remove the service installed by -install_service (macOS & Windows only), then exit.")
+)
+
+func main() {
+	// Read flags, config, & state.
+	flag.Parse()
+	if err := gdddc.ConfigureLogging(*logLevel, *logFormat); err != nil {
+		log.Fatalf("Could not configure logging: %v", err)
+	}
+	svcCtx, svcStopped, err := serviceContext(context.Background())
+	if err != nil {
+		log.Fatalf("ERROR: Could not start service: %v", err)
+	}
+	defer svcStopped()
+	opts := gdddc.ReadOptions{ConfigFormat: *configFormat, Retries: *readRetries, RetryDelay: *readRetryDelay}
+	if *uninstall {
+		if err := uninstallService(); err != nil {
+			log.Fatalf("ERROR: Could not uninstall service: %v", err)
+		}
+		return
+	}
+	cfg, err := gdddc.ReadConfig(*configFile, opts)
+	if err != nil {
+		log.Fatalf("ERROR: Could not read config: %v", err)
+	}
+	if *validateConfig {
+		validate(cfg)
+		return
+	}
+	if *install {
+		if err := installService(); err != nil {
+			log.Fatalf("ERROR: Could not install service: %v", err)
+		}
+		log.Printf("Installed & started service %s", serviceName)
+		return
+	}
+	if flag.Arg(0) == "history" {
+		printHistory(cfg)
+		return
+	}
+	store, err := gdddc.OpenStore(*stateFile, opts)
+	if err != nil {
+		log.Fatalf("ERROR: Could not read state: %v", err)
+	}
+	d := gdddc.NewDaemon(cfg, store)
+	d.DryRun = *dryRun
+
+	// Check immediately on startup, then periodically, until asked to shut down.
+	ctx, stop := signal.NotifyContext(svcCtx, syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	if *once {
+		err := d.RunOnce(ctx)
+		if err := d.Flush(); err != nil {
+			log.Fatalf("ERROR: Could not update on-disk state: %v", err)
+		}
+		d.Wait()
+		switch err {
+		case gdddc.ErrCheckFailed:
+			os.Exit(2)
+		case gdddc.ErrUpdateFailed:
+			os.Exit(3)
+		case gdddc.ErrCycleSkipped:
+			os.Exit(4)
+		case nil:
+		default:
+			log.Fatalf("ERROR: Could not run cycle: %v", err)
+		}
+		return
+	}
+
+	// Re-read the config on SIGHUP. If the new config is not valid, the current config is kept.
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	watch := cfg.WatchConfig
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "watch_config" {
+			watch = *watchConfig
+		}
+	})
+	if watch {
+		go watchConfigFile(ctx, *configFile, hup)
+	}
+	reload := make(chan *gdddc.Config)
+	go func() {
+		for range hup {
+			log.Printf("Reloading config")
+			cfg, err := gdddc.ReadConfig(*configFile, opts)
+			if err != nil {
+				log.Printf("WARNING: Could not reload config, continuing with current config: %v", err)
+				continue
+			}
+			select {
+			case reload <- cfg:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	if err := d.Run(ctx, reload); err != nil {
+		log.Fatalf("ERROR: Could not update on-disk state: %v", err)
+	}
+}
+
+// validate prints the given (already checked) config and, if requested, checks each hostname's provider. It exits
+// with status 1 if any check fails.
+func validate(cfg *gdddc.Config) {
+	b, err := cfg.Normalized()
+	if err != nil {
+		log.Fatalf("ERROR: Could not print config: %v", err)
+	}
+	fmt.Printf("%s\n", b)
+	if !*checkProviders {
+		return
+	}
+	c, ok := gdddc.NewClient(cfg, nil), true
+	for _, h := range cfg.Hostnames {
+		if err := c.Check(context.Background(), h); err != nil {
+			log.Printf("ERROR: Provider of %s failed check: %v", h, err)
+			ok = false
+			continue
+		}
+		log.Printf("Provider of %s is reachable", h)
+	}
+	if !ok {
+		os.Exit(1)
+	}
+}
+
+// printHistory prints the most recent entries of the history log (20, or as many as the argument after "history"
+// asks) as JSON lines.
+func printHistory(cfg *gdddc.Config) {
+	n := 20
+	if flag.NArg() > 1 {
+		var err error
+		if n, err = strconv.Atoi(flag.Arg(1)); err != nil || n <= 0 {
+			log.Fatalf("ERROR: Number of history entries must be a positive integer")
+		}
+	}
+	entries, err := gdddc.ReadHistory(cfg, n)
+	if err != nil {
+		log.Fatalf("ERROR: Could not read history: %v", err)
+	}
+	enc := json.NewEncoder(os.Stdout)
+	for _, e := range entries {
+		enc.Encode(e)
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+)
+
+// defaultDir returns the platform's directory for the default config & state files: %ProgramData%\gdddcd on
+// Windows, Application Support on macOS (/Library for root, otherwise ~/Library), & the working directory elsewhere.
+func defaultDir() string {
+	switch runtime.GOOS {
+	case "windows":
+		if dir := os.Getenv("ProgramData"); dir != "" {
+			return filepath.Join(dir, "gdddcd")
+		}
+		return `C:\ProgramData\gdddcd`
+	case "darwin":
+		if os.Geteuid() == 0 {
+			return "/Library/Application Support/gdddcd"
+		}
+		if home, err := os.UserHomeDir(); err == nil {
+			return filepath.Join(home, "Library", "Application Support", "gdddcd")
+		}
+	}
+	return ""
+}
+
+// serviceCommand returns the executable & arguments of the service installed by -install_service: gdddcd with the
+// same flags (other than the service flags), with the config & state files made absolute. It creates the state
+// file's directory, where the service also writes its log.
+func serviceCommand() (string, []string, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return "", nil, fmt.Errorf("could not find executable: %v", err)
+	}
+	cfgFile, err := filepath.Abs(*configFile)
+	if err != nil {
+		return "", nil, fmt.Errorf("could not find config file: %v", err)
+	}
+	stFile, err := filepath.Abs(*stateFile)
+	if err != nil {
+		return "", nil, fmt.Errorf("could not find state file: %v", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(stFile), 0700); err != nil {
+		return "", nil, fmt.Errorf("could not create state directory: %v", err)
+	}
+	args := []string{"-config_file=" + cfgFile, "-state_file=" + stFile}
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "install_service", "uninstall_service", "config_file", "state_file":
+		default:
+			args = append(args, fmt.Sprintf("-%s=%s", f.Name, f.Value))
+		}
+	})
+	return exe, args, nil
+}
+
+// serviceLogFile returns the file to which the service installed by -install_service writes its log.
+func serviceLogFile(stateFile string) string {
+	return filepath.Join(filepath.Dir(stateFile), "gdddcd.log")
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/mgr"
+)
+
+// serviceName names the Windows service installed by -install_service.
+const serviceName = "gdddcd"
+
+// installService installs & starts a Windows service, started automatically at boot, running the command given by
+// serviceCommand.
+func installService() error {
+	exe, args, err := serviceCommand()
+	if err != nil {
+		return err
+	}
+	m, err := mgr.Connect()
+	if err != nil {
+		return fmt.Errorf("could not connect to service manager: %v", err)
+	}
+	defer m.Disconnect()
+	s, err := m.CreateService(serviceName, exe, mgr.Config{
+		DisplayName: "Google Domains Dynamic DNS Client",
+		Description: "Keeps dynamic DNS records up to date with this machine's IP addresses.",
+		StartType:   mgr.StartAutomatic,
+	}, args...)
+	if err != nil {
+		return fmt.Errorf("could not create service: %v", err)
+	}
+	defer s.Close()
+	if err := s.Start(); err != nil {
+		return fmt.Errorf("could not start service: %v", err)
+	}
+	return nil
+}
+
+// uninstallService stops & removes the Windows service installed by installService.
+func uninstallService() error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return fmt.Errorf("could not connect to service manager: %v", err)
+	}
+	defer m.Disconnect()
+	s, err := m.OpenService(serviceName)
+	if err != nil {
+		return fmt.Errorf("could not open service: %v", err)
+	}
+	defer s.Close()
+	if st, err := s.Query(); err == nil && st.State != svc.Stopped {
+		if _, err := s.Control(svc.Stop); err != nil {
+			return fmt.Errorf("could not stop service: %v", err)
+		}
+		for deadline := time.Now().Add(30 * time.Second); st.State != svc.Stopped && time.Now().Before(deadline); {
+			time.Sleep(250 * time.Millisecond)
+			if st, err = s.Query(); err != nil {
+				return fmt.Errorf("could not query service: %v", err)
+			}
+		}
+	}
+	if err := s.Delete(); err != nil {
+		return fmt.Errorf("could not delete service: %v", err)
+	}
+	return nil
+}
+
+// serviceContext returns ctx unchanged unless gdddcd is running as a Windows service. If it is, serviceContext
+// redirects logging to serviceLogFile (a service has no console) & reports to the service manager, returning a
+// context that is canceled once the service is asked to stop; the returned func reports that the service has
+// stopped. It must be called before anything is logged.
+func serviceContext(ctx context.Context) (context.Context, func(), error) {
+	isService, err := svc.IsWindowsService()
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not determine if running as a service: %v", err)
+	}
+	if !isService {
+		return ctx, func() {}, nil
+	}
+
+	stFile, err := filepath.Abs(*stateFile)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not find state file: %v", err)
+	}
+	f, err := os.OpenFile(serviceLogFile(stFile), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not open log file: %v", err)
+	}
+	// gdddc's log writer writes to whatever os.Stderr is at the time, keeping -log_format & redaction.
+	os.Stderr = f
+
+	ctx, cancel := context.WithCancel(ctx)
+	h := &serviceHandler{cancel: cancel, stopped: make(chan struct{})}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if err := svc.Run(serviceName, h); err != nil {
+			log.Printf("ERROR: Could not run service: %v", err)
+		}
+		cancel()
+	}()
+	return ctx, func() {
+		close(h.stopped)
+		<-done
+	}, nil
+}
+
+// serviceHandler reports gdddcd's status to the Windows service manager, canceling the daemon's context when the
+// service is asked to stop.
+type serviceHandler struct {
+	cancel  func()
+	stopped chan struct{} // closed once the daemon has shut down
+}
+
+func (h *serviceHandler) Execute(args []string, reqs <-chan svc.ChangeRequest, status chan<- svc.Status) (bool, uint32) {
+	status <- svc.Status{State: svc.Running, Accepts: svc.AcceptStop | svc.AcceptShutdown}
+	for {
+		select {
+		case req := <-reqs:
+			switch req.Cmd {
+			case svc.Interrogate:
+				status <- req.CurrentStatus
+			case svc.Stop, svc.Shutdown:
+				status <- svc.Status{State: svc.StopPending}
+				h.cancel()
+			}
+		case <-h.stopped:
+			return false, 0
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"syscall"
+	"time"
+)
+
+// configPollInterval is how often -watch_config checks the config file for changes.
+const configPollInterval = time.Second
+
+// fileStamp identifies a version of a file by its modification time & size.
+type fileStamp struct {
+	modTime time.Time
+	size    int64
+}
+
+// statFile returns the stamp of the given file, or the zero stamp if it cannot be read (e.g. while it is replaced).
+func statFile(filename string) fileStamp {
+	fi, err := os.Stat(filename)
+	if err != nil {
+		return fileStamp{}
+	}
+	return fileStamp{fi.ModTime(), fi.Size()}
+}
+
+// watchConfigFile polls the given config file until ctx is done, sending SIGHUP on hup (as if the daemon had been
+// signalled) once the file has changed. The reload waits until the file has been unchanged for a poll interval,
+// so that a partially-written file is not read.
+func watchConfigFile(ctx context.Context, filename string, hup chan<- os.Signal) {
+	last, pending := statFile(filename), false
+	t := time.NewTicker(configPollInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			return
+		}
+		if cur := statFile(filename); cur != last {
+			last, pending = cur, true
+			continue
+		}
+		if !pending || last == (fileStamp{}) {
+			continue
+		}
+		pending = false
+		log.Printf("Config file %s changed", filename)
+		select {
+		case hup <- syscall.SIGHUP:
+		default: // a reload is already pending
+		}
+	}
+}
@@ -0,0 +1,359 @@
+package gdddc
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// historyConfig configures the history log, an append-only file (of JSON lines) recording each update attempt.
+type historyConfig struct {
+	File string `json:"file"`
+	// Rotate is how the file is rotated: "size" or "daily".
+	Rotate string `json:"rotate"`
+	// For "size" rotation, MaxSize & MaxAge bound the current file: once it reaches MaxSize bytes, or its first entry
+	// is MaxAge old, it is rotated (to File.1, File.1 to File.2, and so on). MaxFiles is how many rotated files are kept.
+	MaxSize  int64   `json:"max_size_bytes"`
+	MaxAge   float64 `json:"max_age_s"`
+	MaxFiles int     `json:"max_files"`
+	// For "daily" rotation, the file is rotated once an entry is written on a later (local) day than its first, by
+	// compressing it to File.YYYY-MM-DD.gz (the date of its entries). Rotated files more than RetentionDays old are
+	// deleted.
+	RetentionDays int `json:"retention_days"`
+}
+
+// fillDefaults fills in default values for unspecified fields.
+func (h *historyConfig) fillDefaults() error {
+	if h.File == "" {
+		return fmt.Errorf("history.file is a required field")
+	}
+	if h.Rotate == "" {
+		debugf("history.rotate unspecified in config, using default of size")
+		h.Rotate = "size"
+	}
+	switch h.Rotate {
+	case "size":
+	case "daily":
+		if h.RetentionDays <= 0 {
+			debugf("history.retention_days unspecified (or negative) in config, using default of 30")
+			h.RetentionDays = 30
+		}
+		return nil
+	default:
+		return fmt.Errorf("history.rotate must be one of size or daily")
+	}
+	if h.MaxSize <= 0 {
+		debugf("history.max_size_bytes unspecified (or negative) in config, using default of 1048576")
+		h.MaxSize = 1 << 20
+	}
+	if h.MaxAge <= 0 {
+		debugf("history.max_age_s unspecified (or negative) in config, using default of 2592000 (30 days)")
+		h.MaxAge = 30 * 24 * 60 * 60
+	}
+	if h.MaxFiles <= 0 {
+		debugf("history.max_files unspecified (or negative) in config, using default of 3")
+		h.MaxFiles = 3
+	}
+	return nil
+}
+
+// HistoryEntry records an update attempt in the history log.
+type HistoryEntry struct {
+	Time     time.Time `json:"time"`
+	Hostname string    `json:"hostname"`
+	Family   Family    `json:"family"`
+	Provider string    `json:"provider"`
+	OldIP    string    `json:"old_ip,omitempty"` // last published
+	NewIP    string    `json:"new_ip"`
+	Forced   bool      `json:"forced,omitempty"` // re-sent unchanged, e.g. by a scheduled update
+	Outcome  string    `json:"outcome"`          // "success" or "failure"
+	Response string    `json:"response,omitempty"`
+	Error    string    `json:"error,omitempty"`
+}
+
+// historyLog writes & reads the configured history log. It is safe for concurrent use.
+type historyLog struct {
+	mu      sync.Mutex
+	cfg     *historyConfig // nil if no history is kept
+	firstAt time.Time      // time of the current file's first entry, if known
+}
+
+// setConfig switches the log to the given config (nil to keep no history).
+func (l *historyLog) setConfig(cfg *historyConfig) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if cfg == nil || l.cfg == nil || cfg.File != l.cfg.File {
+		l.firstAt = time.Time{}
+	}
+	l.cfg = cfg
+}
+
+// append adds the given entry to the log, rotating the log first if needed. Failures are logged, since the history
+// is not essential to updating records.
+func (l *historyLog) append(e HistoryEntry) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.cfg == nil {
+		return
+	}
+	e.Response, e.Error = redact(e.Response), redact(e.Error)
+	line, err := json.Marshal(e)
+	if err != nil {
+		errorf("Could not marshal history entry: %v", err)
+		return
+	}
+	if err := l.rotateIfNeeded(e.Time); err != nil {
+		warnf("Could not rotate history file %s: %v", l.cfg.File, err)
+	}
+	f, err := os.OpenFile(l.cfg.File, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		errorf("Could not open history file: %v", err)
+		return
+	}
+	defer f.Close()
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		errorf("Could not write history file: %v", err)
+		return
+	}
+	if l.firstAt.IsZero() {
+		l.firstAt = e.Time
+	}
+}
+
+// rotateIfNeeded rotates the log if the current file is too large or too old, deleting the oldest rotated file.
+func (l *historyLog) rotateIfNeeded(now time.Time) error {
+	fi, err := os.Stat(l.cfg.File)
+	if os.IsNotExist(err) {
+		l.firstAt = time.Time{}
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if l.firstAt.IsZero() {
+		if entries, err := readHistoryFile(l.cfg.File); err == nil && len(entries) > 0 {
+			l.firstAt = entries[0].Time
+		}
+	}
+	if l.cfg.Rotate == "daily" {
+		return l.rotateDaily(now)
+	}
+	maxAge := time.Duration(l.cfg.MaxAge * float64(time.Second))
+	if fi.Size() < l.cfg.MaxSize && (l.firstAt.IsZero() || now.Sub(l.firstAt) < maxAge) {
+		return nil
+	}
+	os.Remove(rotatedHistoryFile(l.cfg.File, l.cfg.MaxFiles))
+	for i := l.cfg.MaxFiles - 1; i >= 1; i-- {
+		if err := os.Rename(rotatedHistoryFile(l.cfg.File, i), rotatedHistoryFile(l.cfg.File, i+1)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	l.firstAt = time.Time{}
+	return os.Rename(l.cfg.File, rotatedHistoryFile(l.cfg.File, 1))
+}
+
+// rotateDaily compresses the current file to the rotated file of its entries' date if they were written before the
+// given time's date, then deletes rotated files older than the retention.
+func (l *historyLog) rotateDaily(now time.Time) error {
+	if l.firstAt.IsZero() || historyDate(l.firstAt) == historyDate(now) {
+		return nil
+	}
+	if err := compressHistoryFile(l.cfg.File, datedHistoryFile(l.cfg.File, historyDate(l.firstAt))); err != nil {
+		return err
+	}
+	l.firstAt = time.Time{}
+
+	archives, err := historyArchives(l.cfg.File)
+	if err != nil {
+		return err
+	}
+	oldest := historyDate(now.AddDate(0, 0, -l.cfg.RetentionDays))
+	for _, a := range archives {
+		if a.date < oldest {
+			if err := os.Remove(a.name); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// compressHistoryFile moves the history file to the given gzip file. If the gzip file already exists (e.g. if the
+// clock was set back), the history file is appended to it as another gzip member.
+func compressHistoryFile(file, gzFile string) (retErr error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(gzFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := f.Close(); err != nil && retErr == nil {
+			retErr = err
+		}
+	}()
+	w := gzip.NewWriter(f)
+	if _, err := w.Write(b); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	return os.Remove(file)
+}
+
+// historyDate returns the (local) date of the given time, as used in daily rotated file names.
+func historyDate(t time.Time) string {
+	return t.Local().Format("2006-01-02")
+}
+
+func datedHistoryFile(file, date string) string {
+	return fmt.Sprintf("%s.%s.gz", file, date)
+}
+
+// historyArchive is a file rotated by daily rotation.
+type historyArchive struct {
+	name, date string
+}
+
+// historyArchives returns the files rotated from the given history file by daily rotation, oldest first.
+func historyArchives(file string) ([]historyArchive, error) {
+	fis, err := ioutil.ReadDir(filepath.Dir(file))
+	if err != nil {
+		return nil, err
+	}
+	prefix := filepath.Base(file) + "."
+	var archives []historyArchive
+	for _, fi := range fis {
+		if !strings.HasPrefix(fi.Name(), prefix) || !strings.HasSuffix(fi.Name(), ".gz") {
+			continue
+		}
+		date := strings.TrimSuffix(strings.TrimPrefix(fi.Name(), prefix), ".gz")
+		if _, err := time.Parse("2006-01-02", date); err == nil {
+			archives = append(archives, historyArchive{filepath.Join(filepath.Dir(file), fi.Name()), date})
+		}
+	}
+	sort.Slice(archives, func(i, j int) bool { return archives[i].date < archives[j].date })
+	return archives, nil
+}
+
+// recent returns the last n entries of the log (including rotated files), oldest first.
+func (l *historyLog) recent(n int) ([]HistoryEntry, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.cfg == nil {
+		return nil, fmt.Errorf("no history is kept (history is not configured)")
+	}
+	files := []string{l.cfg.File}
+	if l.cfg.Rotate == "daily" {
+		archives, err := historyArchives(l.cfg.File)
+		if err != nil {
+			return nil, fmt.Errorf("could not list rotated history files: %v", err)
+		}
+		for i := len(archives) - 1; i >= 0; i-- {
+			files = append(files, archives[i].name)
+		}
+	} else {
+		for i := 1; i <= l.cfg.MaxFiles; i++ {
+			files = append(files, rotatedHistoryFile(l.cfg.File, i))
+		}
+	}
+	var entries []HistoryEntry
+	for i, file := range files {
+		if len(entries) >= n {
+			break
+		}
+		fileEntries, err := readHistoryFile(file)
+		if os.IsNotExist(err) && i == 0 {
+			continue // e.g. just rotated
+		} else if os.IsNotExist(err) {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		entries = append(fileEntries, entries...)
+	}
+	if len(entries) > n {
+		entries = entries[len(entries)-n:]
+	}
+	return entries, nil
+}
+
+// serveHistory serves the most recent entries of the log (100, or as many as the n parameter asks) as JSON lines.
+func (l *historyLog) serveHistory(w http.ResponseWriter, r *http.Request) {
+	n := 100
+	if s := r.FormValue("n"); s != "" {
+		var err error
+		if n, err = strconv.Atoi(s); err != nil || n <= 0 {
+			http.Error(w, "n must be a positive integer", http.StatusBadRequest)
+			return
+		}
+	}
+	entries, err := l.recent(n)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	enc := json.NewEncoder(w)
+	for _, e := range entries {
+		enc.Encode(e)
+	}
+}
+
+// ReadHistory returns the last n entries of the config's history log, oldest first.
+func ReadHistory(cfg *Config, n int) ([]HistoryEntry, error) {
+	l := &historyLog{cfg: cfg.History}
+	return l.recent(n)
+}
+
+func rotatedHistoryFile(file string, i int) string {
+	return fmt.Sprintf("%s.%d", file, i)
+}
+
+// readHistoryFile reads the entries of a history file, which is decompressed if it is a .gz file. A line that cannot
+// be parsed (e.g. one cut short by a crash) is skipped.
+func readHistoryFile(file string) ([]HistoryEntry, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var r io.Reader = f
+	if strings.HasSuffix(file, ".gz") {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return nil, fmt.Errorf("could not read history file %s: %v", file, err)
+		}
+		defer gz.Close()
+		r = gz
+	}
+	var entries []HistoryEntry
+	s := bufio.NewScanner(r)
+	s.Buffer(nil, 1<<20)
+	for s.Scan() {
+		var e HistoryEntry
+		if err := json.Unmarshal(s.Bytes(), &e); err == nil {
+			entries = append(entries, e)
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, fmt.Errorf("could not read history file %s: %v", file, err)
+	}
+	return entries, nil
+}
@@ -0,0 +1,56 @@
+package gdddc
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestHistoryDailyRotation(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "history.jsonl")
+	cfg := &historyConfig{File: file, Rotate: "daily", RetentionDays: 2}
+	if err := cfg.fillDefaults(); err != nil {
+		t.Fatalf("fillDefaults got unexpected error: %v", err)
+	}
+	var l historyLog
+	l.setConfig(cfg)
+
+	// Write two entries a day for four days. Each day's entries are rotated once the next day's are written.
+	day := time.Date(2021, 6, 1, 0, 0, 0, 0, time.Local)
+	for d := 0; d < 4; d++ {
+		for _, h := range []int{9, 21} {
+			l.append(HistoryEntry{Time: day.AddDate(0, 0, d).Add(time.Duration(h) * time.Hour), Hostname: "a.example.com", NewIP: "203.0.113.7", Outcome: "success"})
+		}
+	}
+	for _, date := range []string{"2021-06-02", "2021-06-03"} {
+		if _, err := os.Stat(datedHistoryFile(file, date)); err != nil {
+			t.Errorf("Rotated file of %s is missing: %v", date, err)
+		}
+	}
+	// 2021-06-01 is more than two days before the last rotation, on 2021-06-04.
+	if _, err := os.Stat(datedHistoryFile(file, "2021-06-01")); !os.IsNotExist(err) {
+		t.Errorf("Rotated file of 2021-06-01 was not deleted (stat error: %v)", err)
+	}
+	if entries, err := readHistoryFile(file); err != nil || len(entries) != 2 {
+		t.Errorf("Current file has %d entries (error: %v), want 2", len(entries), err)
+	}
+
+	// Recent entries are read from the rotated files too, oldest first.
+	entries, err := l.recent(5)
+	if err != nil {
+		t.Fatalf("recent got unexpected error: %v", err)
+	}
+	if len(entries) != 5 {
+		t.Fatalf("recent(5) got %d entries, want 5", len(entries))
+	}
+	if got, want := entries[0].Time, day.AddDate(0, 0, 1).Add(21*time.Hour); !got.Equal(want) {
+		t.Errorf("recent(5) first entry at %v, want %v", got, want)
+	}
+	if got, want := entries[4].Time, day.AddDate(0, 0, 3).Add(21*time.Hour); !got.Equal(want) {
+		t.Errorf("recent(5) last entry at %v, want %v", got, want)
+	}
+	if entries, err := l.recent(100); err != nil || len(entries) != 6 {
+		t.Errorf("recent(100) got %d entries (error: %v), want 6", len(entries), err)
+	}
+}
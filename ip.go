@@ -0,0 +1,191 @@
+package gdddc
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Family is an IP address family, which determines the type of DNS record (A or AAAA) that is updated.
+type Family string
+
+const (
+	IPv4 Family = "ipv4"
+	IPv6 Family = "ipv6"
+)
+
+// network returns the network name used to dial TCP connections over the family.
+func (f Family) network() string {
+	if f == IPv6 {
+		return "tcp6"
+	}
+	return "tcp4"
+}
+
+// parseProtocol parses a protocol config value ("ipv4", "ipv6", or "both") into the IP families it selects.
+func parseProtocol(p string) ([]Family, error) {
+	switch p {
+	case "ipv4":
+		return []Family{IPv4}, nil
+	case "ipv6":
+		return []Family{IPv6}, nil
+	case "both":
+		return []Family{IPv4, IPv6}, nil
+	}
+	return nil, fmt.Errorf("%q is not one of ipv4, ipv6, or both", p)
+}
+
+// hasFamily reports whether the given families include family.
+func hasFamily(families []Family, family Family) bool {
+	for _, f := range families {
+		if f == family {
+			return true
+		}
+	}
+	return false
+}
+
+var (
+	// cgnatNet is the shared address space used by carrier-grade NAT (RFC 6598).
+	_, cgnatNet, _ = net.ParseCIDR("100.64.0.0/10")
+
+	// ipv4TokenRe matches an IPv4 address anywhere in a string, accepting only octet values 0-255. The address may be
+	// followed by a period that is not followed by a digit, as at the end of a sentence.
+	ipv4TokenRe = regexp.MustCompile(`(?:^|[^\d.])((?:(?:25[0-5]|2[0-4]\d|1\d\d|[1-9]?\d)\.){3}(?:25[0-5]|2[0-4]\d|1\d\d|[1-9]?\d))(?:$|[^\d.]|\.(?:$|\D))`)
+	// ipv6TokenRe matches tokens that may hold IPv6 addresses anywhere in a string, bounded by characters that
+	// cannot be part of one; see ipv6Candidate.
+	ipv6TokenRe = regexp.MustCompile(`(?:^|[^0-9A-Fa-f:.])([0-9A-Fa-f]*:[0-9A-Fa-f:.]*)`)
+)
+
+// parseIP parses an IP address of the given family, returning it in canonical form. IPv4-mapped IPv6 addresses
+// (e.g. "::ffff:203.0.113.7"), returned by some dual-stack services, are treated as IPv4 addresses.
+func parseIP(s string, family Family) (string, error) {
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return "", fmt.Errorf("%q is not an IP address", s)
+	}
+	if (ip.To4() != nil) != (family == IPv4) {
+		return "", fmt.Errorf("%q is not an %s address", s, family)
+	}
+	return ip.String(), nil
+}
+
+// extractIP returns the first IP address of the given family found in the given response body.
+func extractIP(body string, family Family) (string, error) {
+	if family == IPv4 {
+		if m := ipv4TokenRe.FindStringSubmatch(body); m != nil {
+			return parseIP(m[1], family)
+		}
+	} else {
+		for _, m := range ipv6TokenRe.FindAllStringSubmatch(body, -1) {
+			if ip := ipv6Candidate(m[1]); ip != "" {
+				return ip, nil
+			}
+		}
+	}
+	return "", fmt.Errorf("response contains no %s address: %q", family, body)
+}
+
+// ipv6Candidate returns the IPv6 address (in canonical form) held by the given token, or "" if there is none. The
+// token may end with a sentence's period, & may start with a label that looks like part of an address (e.g. "abc:" or
+// "addr:"), so the parts of the token after each of its colons are candidates too: the first that is a global unicast
+// address (2000::/3, as public addresses are) is preferred, or else the first that is an IPv6 address.
+func ipv6Candidate(token string) string {
+	token = strings.TrimRight(token, ".")
+	var first string
+	for c := token; ; {
+		if ip, err := parseIP(c, IPv6); err == nil {
+			if net.ParseIP(ip)[0]&0xe0 == 0x20 {
+				return ip
+			}
+			if first == "" {
+				first = ip
+			}
+		}
+		i := strings.Index(c, ":")
+		if i < 0 {
+			return first
+		}
+		c = c[i+1:]
+	}
+}
+
+// interfaceIP returns the first global address of the given family assigned to the named network interface.
+// Private (RFC 1918 or ULA), link-local, and loopback addresses are skipped, since they are not reachable from
+// the internet.
+func interfaceIP(name string, family Family) (string, error) {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return "", fmt.Errorf("could not find interface: %v", err)
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return "", fmt.Errorf("could not get addresses of interface %s: %v", name, err)
+	}
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		ip := ipNet.IP
+		if (ip.To4() != nil) != (family == IPv4) || !ip.IsGlobalUnicast() || ip.IsPrivate() {
+			continue
+		}
+		return ip.String(), nil
+	}
+	return "", fmt.Errorf("interface %s has no global %s address", name, family)
+}
+
+// canonicalIP returns the canonical form of the given IP address (per net.IP.String), so that differing
+// representations of one address (IPv6 case or zero compression, IPv4-mapped IPv6) compare equal.
+// Strings that are not IP addresses are returned unchanged.
+func canonicalIP(s string) string {
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return s
+	}
+	return ip.String()
+}
+
+// warnIfCGNAT logs a warning if the given IP is in the carrier-grade NAT range, since DNS pointing at such an
+// address will not make this host reachable from the internet.
+func warnIfCGNAT(ip string) {
+	if parsed := net.ParseIP(ip); parsed != nil && cgnatNet.Contains(parsed) {
+		warnf("detected IP %v is in the carrier-grade NAT range %v; this host is likely behind CGNAT, "+
+			"so inbound connections (e.g. forwarded ports) to it probably will not work", ip, cgnatNet)
+	}
+}
+
+// udpRoundTrip sends req on the given connected UDP socket & returns the first datagram received for which match
+// returns true. The request is retransmitted after each of the given timeouts.
+func udpRoundTrip(ctx context.Context, conn net.Conn, req []byte, timeouts []time.Duration, match func([]byte) bool) ([]byte, error) {
+	buf := make([]byte, 1500)
+	for _, timeout := range timeouts {
+		deadline := time.Now().Add(timeout)
+		if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+			deadline = d
+		}
+		conn.SetDeadline(deadline)
+		if _, err := conn.Write(req); err != nil {
+			return nil, fmt.Errorf("could not send request: %v", err)
+		}
+		var err error
+		for {
+			var n int
+			if n, err = conn.Read(buf); err != nil {
+				break
+			}
+			// Ignore stray datagrams, e.g. responses to an earlier transmission of a request that timed out.
+			if match(buf[:n]) {
+				return buf[:n], nil
+			}
+		}
+		if ne, ok := err.(net.Error); !ok || !ne.Timeout() || ctx.Err() != nil {
+			return nil, fmt.Errorf("could not read response: %v", err)
+		}
+	}
+	return nil, fmt.Errorf("no response after %d attempts", len(timeouts))
+}
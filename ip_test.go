@@ -0,0 +1,83 @@
+package gdddc
+
+import "testing"
+
+func TestParseIP(t *testing.T) {
+	for _, test := range []struct {
+		s      string
+		family Family
+		want   string // "" if an error is expected
+	}{
+		{"203.0.113.7", IPv4, "203.0.113.7"},
+		{"::ffff:203.0.113.7", IPv4, "203.0.113.7"},
+		{"::FFFF:cb00:7107", IPv4, "203.0.113.7"},
+		{"2001:DB8:0:0::1", IPv6, "2001:db8::1"},
+		{"203.0.113.7", IPv6, ""},
+		{"::ffff:203.0.113.7", IPv6, ""},
+		{"2001:db8::1", IPv4, ""},
+		{"203.0.113.256", IPv4, ""},
+		{"", IPv4, ""},
+	} {
+		got, err := parseIP(test.s, test.family)
+		switch {
+		case test.want == "" && err == nil:
+			t.Errorf("parseIP(%q, %s) = %q, want error", test.s, test.family, got)
+		case test.want != "" && err != nil:
+			t.Errorf("parseIP(%q, %s) got unexpected error: %v", test.s, test.family, err)
+		case got != test.want:
+			t.Errorf("parseIP(%q, %s) = %q, want %q", test.s, test.family, got, test.want)
+		}
+	}
+}
+
+func TestExtractIP(t *testing.T) {
+	for _, test := range []struct {
+		body   string
+		family Family
+		want   string // "" if an error is expected
+	}{
+		{"203.0.113.7", IPv4, "203.0.113.7"},
+		{"Current IP Address: 203.0.113.7", IPv4, "203.0.113.7"},
+		{`{"ip": "203.0.113.7"}`, IPv4, "203.0.113.7"},
+		{"<body>203.0.113.7</body>", IPv4, "203.0.113.7"},
+		{"version 1.2.3.4.5, IP 203.0.113.7", IPv4, "203.0.113.7"},
+		{"Your IP is 203.0.113.7.", IPv4, "203.0.113.7"},
+		{"Your IP is 203.0.113.7. Have a nice day.", IPv4, "203.0.113.7"},
+		{"203.0.113.7.1", IPv4, ""},
+		{"203.0.113.256 or 198.51.100.1", IPv4, "198.51.100.1"},
+		{"1203.0.113.7", IPv4, ""},
+		{"no address here", IPv4, ""},
+		{`{"ip": "2001:DB8::1"}`, IPv6, "2001:db8::1"},
+		{"time 12:30, IP 2001:db8::1", IPv6, "2001:db8::1"},
+		{"ip 2001:db8::1.", IPv6, "2001:db8::1"},
+		{"addr=abc:2001:db8::1", IPv6, "2001:db8::1"},
+		{"addr:2001:db8::1", IPv6, "2001:db8::1"},
+		{"fe80::1", IPv6, "fe80::1"},
+		{"203.0.113.7", IPv6, ""},
+	} {
+		got, err := extractIP(test.body, test.family)
+		switch {
+		case test.want == "" && err == nil:
+			t.Errorf("extractIP(%q, %s) = %q, want error", test.body, test.family, got)
+		case test.want != "" && err != nil:
+			t.Errorf("extractIP(%q, %s) got unexpected error: %v", test.body, test.family, err)
+		case got != test.want:
+			t.Errorf("extractIP(%q, %s) = %q, want %q", test.body, test.family, got, test.want)
+		}
+	}
+}
+
+func TestCanonicalIP(t *testing.T) {
+	for _, test := range []struct{ s, want string }{
+		{"203.0.113.7", "203.0.113.7"},
+		{"::ffff:203.0.113.7", "203.0.113.7"},
+		{"2001:DB8:0:0:0:0:0:1", "2001:db8::1"},
+		{"2001:db8::1", "2001:db8::1"},
+		{"", ""},
+		{"not an IP", "not an IP"},
+	} {
+		if got := canonicalIP(test.s); got != test.want {
+			t.Errorf("canonicalIP(%q) = %q, want %q", test.s, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,164 @@
+package gdddc
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// logLevel is the severity of a log message.
+type logLevel int
+
+const (
+	levelDebug logLevel = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+// logLevels maps each log level's name to the level, & logTags each level to the tag beginning its messages.
+var (
+	logLevels = map[string]logLevel{"debug": levelDebug, "info": levelInfo, "warn": levelWarn, "error": levelError}
+	logTags   = map[logLevel]string{levelDebug: "DEBUG: ", levelInfo: "", levelWarn: "WARNING: ", levelError: "ERROR: "}
+)
+
+// Logging settings, set by ConfigureLogging & setLogPrefix.
+var (
+	minLogLevel   = levelInfo
+	jsonLogs      bool
+	logInstance   string     // instance label, if any
+	jsonLogOutput sync.Mutex // serializes JSON log lines
+)
+
+// ConfigureLogging sets the minimum level of logged messages ("debug", "info", "warn", or "error") and their format
+// ("text", or "json" for one JSON object per line). It also routes the standard logger through the same formatting &
+// redaction of credentials.
+func ConfigureLogging(level, format string) error {
+	l, ok := logLevels[level]
+	if !ok {
+		return fmt.Errorf("log level must be one of debug, info, warn, or error")
+	}
+	switch format {
+	case "text":
+	case "json":
+		jsonLogs = true
+		log.SetFlags(0)
+		log.SetPrefix("")
+	default:
+		return fmt.Errorf("log format must be one of text or json")
+	}
+	minLogLevel = l
+	log.SetOutput(logWriter{})
+	return nil
+}
+
+func debugf(format string, args ...interface{}) { logf(levelDebug, format, args...) }
+func infof(format string, args ...interface{})  { logf(levelInfo, format, args...) }
+func warnf(format string, args ...interface{})  { logf(levelWarn, format, args...) }
+func errorf(format string, args ...interface{}) { logf(levelError, format, args...) }
+
+// logf logs a message of the given level, if it is at least the minimum level.
+func logf(level logLevel, format string, args ...interface{}) {
+	if level < minLogLevel {
+		return
+	}
+	log.Print(logTags[level] + redact(fmt.Sprintf(format, args...)))
+}
+
+// setLogPrefix tags every subsequent log line with the given instance label, if any.
+func setLogPrefix(label string) {
+	logInstance = label
+	if label == "" || jsonLogs {
+		log.SetPrefix("")
+		return
+	}
+	log.SetFlags(log.Flags() | log.Lmsgprefix)
+	log.SetPrefix(fmt.Sprintf("[%s] ", label))
+}
+
+// logWriter is the output of the standard logger once logging is configured. It redacts credentials & writes each
+// line to stderr, as a JSON object if configured.
+type logWriter struct{}
+
+func (logWriter) Write(b []byte) (int, error) {
+	line := redact(string(b))
+	if !jsonLogs {
+		return os.Stderr.Write([]byte(line))
+	}
+	msg, level := strings.TrimSuffix(line, "\n"), levelInfo
+	for l, tag := range logTags {
+		if tag != "" && strings.HasPrefix(msg, tag) {
+			msg, level = strings.TrimPrefix(msg, tag), l
+		}
+	}
+	var name string
+	for n, l := range logLevels {
+		if l == level {
+			name = n
+		}
+	}
+	out, err := json.Marshal(struct {
+		Time     string `json:"time"`
+		Level    string `json:"level"`
+		Instance string `json:"instance,omitempty"`
+		Msg      string `json:"msg"`
+	}{time.Now().Format(time.RFC3339Nano), name, logInstance, msg})
+	if err != nil {
+		return 0, err
+	}
+	jsonLogOutput.Lock()
+	defer jsonLogOutput.Unlock()
+	if _, err := os.Stderr.Write(append(out, '\n')); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// minSecretLen is the length below which credentials are not redacted from logs, since redacting such short strings
+// would mangle unrelated text.
+const minSecretLen = 4
+
+// secrets holds the credentials redacted from logs, longest first.
+var secrets struct {
+	sync.Mutex
+	values []string
+}
+
+// urlUserinfo matches the userinfo (e.g. "user:password@") of URLs.
+var urlUserinfo = regexp.MustCompile(`([a-zA-Z][a-zA-Z0-9+.-]*://)[^/?#\s@]+@`)
+
+// addSecrets registers credentials (e.g. passwords & API tokens) to be redacted from logs.
+func addSecrets(values ...string) {
+	secrets.Lock()
+	defer secrets.Unlock()
+	for _, v := range values {
+		if len(v) < minSecretLen {
+			continue
+		}
+		dup := false
+		for _, s := range secrets.values {
+			dup = dup || s == v
+		}
+		if !dup {
+			secrets.values = append(secrets.values, v)
+		}
+	}
+	sort.Slice(secrets.values, func(i, j int) bool { return len(secrets.values[i]) > len(secrets.values[j]) })
+}
+
+// redact removes registered credentials & URL userinfo from the given log message.
+func redact(msg string) string {
+	msg = urlUserinfo.ReplaceAllString(msg, "${1}REDACTED@")
+	secrets.Lock()
+	defer secrets.Unlock()
+	for _, s := range secrets.values {
+		msg = strings.Replace(msg, s, "REDACTED", -1)
+	}
+	return msg
+}
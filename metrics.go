@@ -0,0 +1,403 @@
+package gdddc
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// healthyCycleMultiple is how many update intervals may pass without a successful cycle before /healthz fails,
+// by default.
+const healthyCycleMultiple = 3
+
+// counters holds totals of the daemon's activity: IP checks, update attempts, & failures of either (or of a cycle,
+// by panicking).
+type counters struct {
+	Checks   int64 `json:"checks"`
+	Updates  int64 `json:"updates"`
+	Failures int64 `json:"failures"`
+}
+
+// add returns the sum of the counters.
+func (c counters) add(o counters) counters {
+	return counters{c.Checks + o.Checks, c.Updates + o.Updates, c.Failures + o.Failures}
+}
+
+// metrics tracks the daemon's status & activity for the metrics, health, & status endpoints (which are served from
+// other goroutines) & for statsd. A nil *metrics discards all updates.
+type metrics struct {
+	mu                sync.Mutex
+	maxAge            time.Duration // longest time without a successful cycle that is healthy
+	maxUpdateFailures int           // number of consecutive failed updates that is unhealthy, or 0 for no limit
+	start             time.Time
+	lastCheck         time.Time // last successful IP check
+	lastUpdate        time.Time // last successful IP update
+	lastCycle         time.Time // last cycle without failed checks or updates
+	checks            int64
+	checkFailures     int64
+	updates           int64 // successful updates
+	updateFailures    int64
+	// consecutiveUpdateFailures counts the failed updates since the last successful one.
+	consecutiveUpdateFailures int
+	propagations              int64 // propagation checks completed, successfully or not
+	propagationFailures       int64
+	panics                    int64             // cycles that panicked
+	failureStreak             int               // consecutive failed checks, updates, & cycles
+	lifetimeBase              counters          // lifetime totals before startup, if persisted
+	providerErrors            map[string]int64  // failed updates, by provider
+	ips                       map[Family]string // most recently detected IP of each family
+	published                 map[record]string // IP published to each record
+	results                   map[record]result // outcome of the last update of each record
+	state                     []byte            // JSON snapshot of the state, served at /state if enabled
+}
+
+// result is the outcome of an update.
+type result struct {
+	time time.Time
+	err  error
+}
+
+// newMetrics creates a new metrics, treating the daemon as healthy while a successful cycle has happened within
+// maxAge, and fewer than maxUpdateFailures consecutive updates have failed (if set). Lifetime totals continue from
+// the given ones.
+func newMetrics(maxAge time.Duration, maxUpdateFailures int, lifetime counters) *metrics {
+	return &metrics{
+		maxAge:            maxAge,
+		maxUpdateFailures: maxUpdateFailures,
+		start:             time.Now(),
+		lifetimeBase:      lifetime,
+		providerErrors:    map[string]int64{},
+		ips:               map[Family]string{},
+		published:         map[record]string{},
+		results:           map[record]result{},
+	}
+}
+
+// setHealthLimits changes the limits used to determine health (see newMetrics), e.g. after a config reload.
+func (m *metrics) setHealthLimits(maxAge time.Duration, maxUpdateFailures int) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.maxAge, m.maxUpdateFailures = maxAge, maxUpdateFailures
+}
+
+// recordCheck records the outcome of an IP check of the given family, which detected ip if successful.
+func (m *metrics) recordCheck(family Family, ip string, err error) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.checks++
+	if err != nil {
+		m.checkFailures++
+		m.failureStreak++
+		return
+	}
+	m.failureStreak = 0
+	m.lastCheck = time.Now()
+	m.ips[family] = ip
+}
+
+// recordUpdate records the outcome of an IP update of the given record using the named provider.
+func (m *metrics) recordUpdate(r record, provider string, err error) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.results[r] = result{time.Now(), err}
+	if err != nil {
+		m.updateFailures++
+		m.consecutiveUpdateFailures++
+		m.failureStreak++
+		m.providerErrors[provider]++
+		return
+	}
+	m.updates++
+	m.consecutiveUpdateFailures = 0
+	m.failureStreak = 0
+	m.lastUpdate = time.Now()
+}
+
+// recordPropagation records the outcome of checking that an updated record resolves to its new IP.
+func (m *metrics) recordPropagation(err error) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.propagations++
+	if err != nil {
+		m.propagationFailures++
+	}
+}
+
+// recordPublished records the IP published to the given record.
+func (m *metrics) recordPublished(r record, ip string) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.published[r] = ip
+}
+
+// recordCycle records the end of a cycle, which was successful if no IP check or update failed & it did not panic.
+func (m *metrics) recordCycle(success, panicked bool) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if panicked {
+		m.panics++
+		m.failureStreak++
+		return
+	}
+	if success {
+		m.lastCycle = time.Now()
+	}
+}
+
+// sinceStart returns the activity totals since startup; m.mu must be held.
+func (m *metrics) sinceStart() counters {
+	return counters{
+		Checks:   m.checks,
+		Updates:  m.updates + m.updateFailures,
+		Failures: m.checkFailures + m.updateFailures + m.panics,
+	}
+}
+
+// lifetime returns the activity totals over the daemon's lifetime (since startup, if they are not persisted).
+func (m *metrics) lifetime() counters {
+	if m == nil {
+		return counters{}
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.lifetimeBase.add(m.sinceStart())
+}
+
+// emit sends the daemon's uptime & activity totals to statsd as gauges.
+func (m *metrics) emit(sd *statsdClient) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	uptime, streak, sinceStart := time.Since(m.start), m.failureStreak, m.sinceStart()
+	lifetime := m.lifetimeBase.add(sinceStart)
+	m.mu.Unlock()
+	sd.gauge("uptime_s", uptime.Seconds())
+	sd.gauge("failure_streak", float64(streak))
+	for prefix, c := range map[string]counters{"since_start": sinceStart, "lifetime": lifetime} {
+		sd.gauge(prefix+".checks", float64(c.Checks))
+		sd.gauge(prefix+".updates", float64(c.Updates))
+		sd.gauge(prefix+".failures", float64(c.Failures))
+	}
+}
+
+// serve serves the metrics (at /metrics, in Prometheus text format), health (at /healthz), &, if serveState is set,
+// state (at /state) endpoints on the given address, in the background.
+func (m *metrics) serve(addr string, serveState bool) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", m.serveMetrics)
+	mux.HandleFunc("/healthz", m.serveHealth)
+	if serveState {
+		mux.HandleFunc("/state", m.serveState)
+	}
+	go func() {
+		infof("Serving metrics on %s", addr)
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			errorf("Could not serve metrics: %v", err)
+		}
+	}()
+}
+
+// setState sets the state snapshot served at /state.
+func (m *metrics) setState(state []byte) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.state = state
+}
+
+// serveState serves the latest state snapshot, as JSON.
+func (m *metrics) serveState(w http.ResponseWriter, r *http.Request) {
+	m.mu.Lock()
+	state := m.state
+	m.mu.Unlock()
+	if state == nil {
+		http.Error(w, "no state yet", http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(state)
+}
+
+func (m *metrics) serveMetrics(w http.ResponseWriter, r *http.Request) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	writeMetric(w, "gdddcd_last_successful_check_timestamp_seconds", "gauge", "Time of the last successful IP check.", timestamp(m.lastCheck))
+	writeMetric(w, "gdddcd_last_successful_update_timestamp_seconds", "gauge", "Time of the last successful IP update.", timestamp(m.lastUpdate))
+	writeMetric(w, "gdddcd_last_successful_cycle_timestamp_seconds", "gauge", "Time of the last cycle without failures.", timestamp(m.lastCycle))
+	var sinceUpdate float64
+	if !m.lastUpdate.IsZero() {
+		sinceUpdate = time.Since(m.lastUpdate).Seconds()
+	}
+	writeMetric(w, "gdddcd_seconds_since_last_successful_update", "gauge", "Time since the last successful IP update, or 0 if there has been none.", sinceUpdate)
+	writeMetric(w, "gdddcd_checks_total", "counter", "Number of IP checks.", float64(m.checks))
+	writeMetric(w, "gdddcd_check_failures_total", "counter", "Number of failed IP checks.", float64(m.checkFailures))
+	writeMetric(w, "gdddcd_updates_total", "counter", "Number of successful IP updates.", float64(m.updates))
+	writeMetric(w, "gdddcd_update_failures_total", "counter", "Number of failed IP updates.", float64(m.updateFailures))
+	writeMetric(w, "gdddcd_propagation_checks_total", "counter", "Number of updates checked for propagation to DNS.", float64(m.propagations))
+	writeMetric(w, "gdddcd_propagation_failures_total", "counter", "Number of updates not found to propagate to DNS in time.", float64(m.propagationFailures))
+	writeMetric(w, "gdddcd_cycle_panics_total", "counter", "Number of cycles that panicked.", float64(m.panics))
+	writeMetric(w, "gdddcd_uptime_seconds", "gauge", "Time since the daemon started.", time.Since(m.start).Seconds())
+	writeMetric(w, "gdddcd_failure_streak", "gauge", "Number of consecutive failed IP checks, updates, & cycles.", float64(m.failureStreak))
+	lifetime := m.lifetimeBase.add(m.sinceStart())
+	writeMetric(w, "gdddcd_lifetime_checks_total", "counter", "Number of IP checks over the daemon's lifetime (if persisted).", float64(lifetime.Checks))
+	writeMetric(w, "gdddcd_lifetime_updates_total", "counter", "Number of IP update attempts over the daemon's lifetime (if persisted).", float64(lifetime.Updates))
+	writeMetric(w, "gdddcd_lifetime_failures_total", "counter", "Number of failed IP checks, updates, & cycles over the daemon's lifetime (if persisted).", float64(lifetime.Failures))
+
+	fmt.Fprintf(w, "# HELP gdddcd_provider_errors_total Number of failed IP updates, by provider.\n# TYPE gdddcd_provider_errors_total counter\n")
+	var providers []string
+	for p := range m.providerErrors {
+		providers = append(providers, p)
+	}
+	sort.Strings(providers)
+	for _, p := range providers {
+		fmt.Fprintf(w, "gdddcd_provider_errors_total{provider=%q} %d\n", p, m.providerErrors[p])
+	}
+
+	fmt.Fprintf(w, "# HELP gdddcd_published_ip_info IP published to each record.\n# TYPE gdddcd_published_ip_info gauge\n")
+	for _, r := range sortedRecords(m.published, nil) {
+		fmt.Fprintf(w, "gdddcd_published_ip_info{hostname=%q,family=%q,ip=%q} 1\n", r.hostname, r.family, m.published[r])
+	}
+
+	fmt.Fprintf(w, "# HELP gdddcd_current_ip Most recently detected IP of each family.\n# TYPE gdddcd_current_ip gauge\n")
+	var families []string
+	for f := range m.ips {
+		families = append(families, string(f))
+	}
+	sort.Strings(families)
+	for _, f := range families {
+		fmt.Fprintf(w, "gdddcd_current_ip{family=%q,ip=%q} 1\n", f, m.ips[Family(f)])
+	}
+}
+
+func (m *metrics) serveHealth(w http.ResponseWriter, r *http.Request) {
+	m.mu.Lock()
+	last := m.lastCycle
+	if last.IsZero() {
+		last = m.start
+	}
+	maxAge, failures, maxFailures := m.maxAge, m.consecutiveUpdateFailures, m.maxUpdateFailures
+	uptime, streak := time.Since(m.start), m.failureStreak
+	m.mu.Unlock()
+
+	if age := time.Since(last); age > maxAge {
+		http.Error(w, fmt.Sprintf("no successful cycle in %v", age.Round(time.Second)), http.StatusServiceUnavailable)
+		return
+	}
+	if maxFailures > 0 && failures >= maxFailures {
+		http.Error(w, fmt.Sprintf("last %d updates failed", failures), http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintf(w, "ok (up %v, %d consecutive failures)\n", uptime.Round(time.Second), streak)
+}
+
+// serveStatus serves a JSON description of the detected IPs & of each record.
+func (m *metrics) serveStatus(w http.ResponseWriter, r *http.Request) {
+	type recordStatus struct {
+		Hostname    string `json:"hostname"`
+		Family      Family `json:"family"`
+		IP          string `json:"ip,omitempty"` // last published
+		LastAttempt string `json:"last_attempt,omitempty"`
+		Error       string `json:"error,omitempty"` // of the last attempt, if it failed
+	}
+	var status struct {
+		IPs        map[Family]string `json:"ips"` // most recently detected
+		LastCheck  string            `json:"last_check,omitempty"`
+		LastUpdate string            `json:"last_update,omitempty"`
+		LastCycle  string            `json:"last_cycle,omitempty"`
+		Uptime     float64           `json:"uptime_s"`
+		// FailureStreak counts the consecutive failed IP checks, updates, & cycles.
+		FailureStreak int            `json:"failure_streak"`
+		SinceStart    counters       `json:"since_start"`
+		Lifetime      counters       `json:"lifetime"`
+		Records       []recordStatus `json:"records"`
+	}
+	m.mu.Lock()
+	status.IPs = map[Family]string{}
+	for f, ip := range m.ips {
+		status.IPs[f] = ip
+	}
+	status.LastCheck, status.LastUpdate, status.LastCycle = formatTime(m.lastCheck), formatTime(m.lastUpdate), formatTime(m.lastCycle)
+	status.Uptime, status.FailureStreak = time.Since(m.start).Seconds(), m.failureStreak
+	status.SinceStart = m.sinceStart()
+	status.Lifetime = m.lifetimeBase.add(status.SinceStart)
+	status.Records = []recordStatus{}
+	for _, rec := range sortedRecords(m.published, m.results) {
+		rs := recordStatus{Hostname: rec.hostname, Family: rec.family, IP: m.published[rec]}
+		if res, ok := m.results[rec]; ok {
+			rs.LastAttempt = formatTime(res.time)
+			if res.err != nil {
+				rs.Error = redact(res.err.Error())
+			}
+		}
+		status.Records = append(status.Records, rs)
+	}
+	m.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(status); err != nil {
+		warnf("Could not write status: %v", err)
+	}
+}
+
+// sortedRecords returns the records that are keys of either map, sorted by hostname then family.
+func sortedRecords(published map[record]string, results map[record]result) []record {
+	var records []record
+	for r := range published {
+		records = append(records, r)
+	}
+	for r := range results {
+		if _, ok := published[r]; !ok {
+			records = append(records, r)
+		}
+	}
+	sort.Slice(records, func(i, j int) bool {
+		if records[i].hostname != records[j].hostname {
+			return records[i].hostname < records[j].hostname
+		}
+		return records[i].family < records[j].family
+	})
+	return records
+}
+
+// formatTime formats the given time in RFC 3339 format, or as "" if it is the zero time.
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.Format(time.RFC3339)
+}
+
+// writeMetric writes a single unlabelled metric in Prometheus text format.
+func writeMetric(w http.ResponseWriter, name, typ, help string, v float64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %g\n", name, help, name, typ, name, v)
+}
+
+// timestamp returns the given time as Unix seconds, or 0 if it is the zero time.
+func timestamp(t time.Time) float64 {
+	if t.IsZero() {
+		return 0
+	}
+	return float64(t.UnixNano()) / 1e9
+}
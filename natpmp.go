@@ -0,0 +1,114 @@
+package gdddc
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// natPMPPort is the router port to which NAT-PMP (RFC 6886) & PCP (RFC 6887) requests are sent.
+const natPMPPort = 5351
+
+// natPMPRetransmits are the timeouts of each attempt of a NAT-PMP or PCP request, per RFC 6886.
+var natPMPRetransmits = []time.Duration{250 * time.Millisecond, 500 * time.Millisecond, time.Second, 2 * time.Second}
+
+// natPMPExternalIP asks the given router for its external IPv4 address with a NAT-PMP external address request.
+func natPMPExternalIP(ctx context.Context, gateway string) (string, error) {
+	conn, err := net.Dial("udp4", net.JoinHostPort(gateway, strconv.Itoa(natPMPPort)))
+	if err != nil {
+		return "", fmt.Errorf("could not connect: %v", err)
+	}
+	defer conn.Close()
+	resp, err := udpRoundTrip(ctx, conn, []byte{0, 0}, natPMPRetransmits, func(resp []byte) bool {
+		return len(resp) >= 4 && resp[1] == 128
+	})
+	if err != nil {
+		return "", err
+	}
+	if code := binary.BigEndian.Uint16(resp[2:]); code != 0 {
+		return "", fmt.Errorf("router returned result code %d", code)
+	}
+	if len(resp) < 12 {
+		return "", fmt.Errorf("truncated response")
+	}
+	return net.IP(resp[8:12]).String(), nil
+}
+
+// pcpExternalIP asks the given router for its external IPv4 address with PCP. PCP has no request for just the
+// address, so a short-lived UDP mapping of an unused port is requested & then deleted; its response includes the
+// external address.
+func pcpExternalIP(ctx context.Context, gateway string) (string, error) {
+	conn, err := net.Dial("udp4", net.JoinHostPort(gateway, strconv.Itoa(natPMPPort)))
+	if err != nil {
+		return "", fmt.Errorf("could not connect: %v", err)
+	}
+	defer conn.Close()
+	local := conn.LocalAddr().(*net.UDPAddr)
+	nonce := make([]byte, 12)
+	if _, err := rand.Read(nonce); err != nil {
+		return "", fmt.Errorf("could not generate nonce: %v", err)
+	}
+	mapRequest := func(lifetime uint32) []byte {
+		req := make([]byte, 60)
+		req[0], req[1] = 2, 1 // version 2, MAP
+		binary.BigEndian.PutUint32(req[4:], lifetime)
+		copy(req[8:24], local.IP.To16())
+		copy(req[24:36], nonce)
+		req[36] = 17 // UDP
+		binary.BigEndian.PutUint16(req[40:], uint16(local.Port))
+		copy(req[44:60], net.IPv4zero.To16())
+		return req
+	}
+	resp, err := udpRoundTrip(ctx, conn, mapRequest(60), natPMPRetransmits, func(resp []byte) bool {
+		return len(resp) >= 4 && resp[1] == 0x81 && (resp[3] != 0 || len(resp) >= 60 && bytes.Equal(resp[24:36], nonce))
+	})
+	if err != nil {
+		return "", err
+	}
+	if resp[0] != 2 {
+		return "", fmt.Errorf("router does not support PCP (version %d response)", resp[0])
+	}
+	if resp[3] != 0 {
+		return "", fmt.Errorf("router returned result code %d", resp[3])
+	}
+	ip := net.IP(resp[44:60])
+	// Delete the mapping, best effort: it expires shortly anyway.
+	conn.Write(mapRequest(0))
+	if ip.To4() == nil {
+		return "", fmt.Errorf("router reported non-IPv4 external address %v", ip)
+	}
+	return ip.String(), nil
+}
+
+// defaultGateway returns the address of the default IPv4 gateway, as listed in /proc/net/route (so only on Linux).
+func defaultGateway() (string, error) {
+	routes, err := ioutil.ReadFile("/proc/net/route")
+	if err != nil {
+		return "", fmt.Errorf("could not read routes (set router_addr): %v", err)
+	}
+	for _, line := range strings.Split(string(routes), "\n")[1:] {
+		fields := strings.Fields(line)
+		if len(fields) < 4 || fields[1] != "00000000" {
+			continue
+		}
+		flags, err := strconv.ParseUint(fields[3], 16, 16)
+		if err != nil || flags&0x2 == 0 { // RTF_GATEWAY
+			continue
+		}
+		gw, err := strconv.ParseUint(fields[2], 16, 32)
+		if err != nil {
+			continue
+		}
+		ip := make(net.IP, 4)
+		binary.LittleEndian.PutUint32(ip, uint32(gw))
+		return ip.String(), nil
+	}
+	return "", fmt.Errorf("no default gateway found (set router_addr)")
+}
@@ -0,0 +1,331 @@
+package gdddc
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/smtp"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Notification events.
+const (
+	eventIPChanged    = "ip_changed"    // records were updated to a new IP
+	eventUpdateFailed = "update_failed" // an update failed, other than by an authentication failure
+	eventAuthFailed   = "auth_failed"   // an update was rejected because its credentials are not valid
+	eventCheckFailed  = "check_failed"  // an IP check failed
+
+	eventPropagationFailed = "propagation_failed" // an updated record did not come to resolve to its new IP
+
+	eventStarted   = "started"   // the daemon started
+	eventRecovered = "recovered" // a cycle succeeded after one or more failed cycles
+)
+
+// events lists every notification event.
+var events = []string{eventIPChanged, eventUpdateFailed, eventAuthFailed, eventCheckFailed, eventPropagationFailed, eventStarted, eventRecovered}
+
+// notifyClasses lists the classes of events that may be given in notify_on.
+var notifyClasses = []string{"change", "error", "permanent_error", "stale_dns", "recovery", "startup"}
+
+// inClass reports whether the event belongs to the given class of events: change (ip_changed), error (any failed
+// check or update), permanent_error (a failed update that is not retried until restart), stale_dns
+// (propagation_failed), recovery (recovered), or startup (started).
+func (ev event) inClass(class string) bool {
+	switch class {
+	case "change":
+		return ev.Event == eventIPChanged
+	case "error":
+		return ev.Event == eventUpdateFailed || ev.Event == eventAuthFailed || ev.Event == eventCheckFailed
+	case "permanent_error":
+		return ev.Permanent
+	case "stale_dns":
+		return ev.Event == eventPropagationFailed
+	case "recovery":
+		return ev.Event == eventRecovered
+	case "startup":
+		return ev.Event == eventStarted
+	}
+	return false
+}
+
+// notification configures where events are notified. Any combination of webhook, command, & email may be used.
+type notification struct {
+	// Events, if set, lists the events notified; by default, those in the config's notify_on classes are.
+	Events []string `json:"events"`
+
+	// WebhookURL, if set, is POSTed a JSON description of each event.
+	WebhookURL string `json:"webhook_url"`
+	// Command, if set, is a command (& arguments) run for each event, which is described by GDDDCD_* environment
+	// variables.
+	Command []string `json:"command"`
+	// Email, if set, sends mail describing each event.
+	Email *emailConfig `json:"email"`
+}
+
+// emailConfig configures the sending of notification email over SMTP.
+type emailConfig struct {
+	SMTPAddr string   `json:"smtp_addr"` // host:port
+	Username string   `json:"username"`  // if set, authenticates with PLAIN auth
+	Password string   `json:"password"`
+	From     string   `json:"from"`
+	To       []string `json:"to"`
+}
+
+// validate checks that the notification is fully configured.
+func (n notification) validate() error {
+	for _, e := range n.Events {
+		if !contains(events, e) {
+			return fmt.Errorf("events must contain only %s", strings.Join(events, ", "))
+		}
+	}
+	if n.WebhookURL == "" && len(n.Command) == 0 && n.Email == nil {
+		return fmt.Errorf("at least one of webhook_url, command, or email is required")
+	}
+	if e := n.Email; e != nil && (e.SMTPAddr == "" || e.From == "" || len(e.To) == 0) {
+		return fmt.Errorf("email requires smtp_addr, from, and to")
+	}
+	return nil
+}
+
+// wants reports whether the notification is sent for the given event, given the config's notify_on classes.
+func (n notification) wants(ev event, notifyOn []string) bool {
+	if len(n.Events) > 0 {
+		return contains(n.Events, ev.Event)
+	}
+	return ev.notifiable(notifyOn)
+}
+
+// notifiable reports whether the event belongs to any of the given classes.
+func (ev event) notifiable(classes []string) bool {
+	for _, c := range classes {
+		if ev.inClass(c) {
+			return true
+		}
+	}
+	return false
+}
+
+// contains reports whether ss contains s.
+func contains(ss []string, s string) bool {
+	for _, e := range ss {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
+
+// event describes something that happened to one or more records, as sent to notifications.
+type event struct {
+	Event     string    `json:"event"`
+	OldIP     string    `json:"old_ip"` // empty if no IP was previously published (or, in a digest, if they differed)
+	NewIP     string    `json:"new_ip"`
+	Family    Family    `json:"family"`
+	Hostnames []string  `json:"hostnames"`
+	Error     string    `json:"error,omitempty"`
+	Permanent bool      `json:"permanent,omitempty"` // set for failed updates that are not retried until restart
+	Timestamp time.Time `json:"timestamp"`
+}
+
+func (ev event) String() string {
+	s := fmt.Sprintf("%s for %s", ev.Event, strings.Join(ev.Hostnames, ", "))
+	if ev.Family != "" {
+		s += fmt.Sprintf(" (%s %v -> %v)", ev.Family, ev.OldIP, ev.NewIP)
+	}
+	if ev.Error != "" {
+		s += ": " + ev.Error
+	}
+	return s
+}
+
+// notify sends the given event to each of the config's notifications that wants it, & counts it in statsd if it is
+// in the config's notify_on classes. Notification is best-effort: it runs in the background (retrying per the
+// config's retry policy), tracked by wg, and failures are only logged.
+func notify(cfg *Config, wg *sync.WaitGroup, ev event) {
+	if ev.notifiable(cfg.NotifyOn) {
+		cfg.statsd.count("event."+ev.Event, 1)
+	}
+	for _, n := range cfg.notifications {
+		if !n.wants(ev, cfg.NotifyOn) {
+			continue
+		}
+		n := n
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+			defer cancel()
+			if n.WebhookURL != "" {
+				if err := cfg.RetryPolicy.retry(ctx, "send webhook notification", func() error { return sendWebhook(ctx, cfg, n.WebhookURL, ev) }); err != nil {
+					warnf("Could not send webhook notification of %s: %v", ev.Event, err)
+				}
+			}
+			if len(n.Command) > 0 {
+				if err := cfg.RetryPolicy.retry(ctx, "run notification command", func() error { return runCommand(ctx, cfg, n.Command, ev) }); err != nil {
+					warnf("Could not run notification command for %s: %v", ev.Event, err)
+				}
+			}
+			if n.Email != nil {
+				if err := cfg.RetryPolicy.retry(ctx, "send notification email", func() error { return sendEmail(n.Email, ev) }); err != nil {
+					warnf("Could not send notification email of %s: %v", ev.Event, err)
+				}
+			}
+		}()
+	}
+}
+
+// notifyBatcher coalesces the ip_changed events notified within the config's notify_batch_window_s of the first into
+// digests, each notifying the change of every listed hostname's record of a family to the same IP. It is safe for
+// concurrent use.
+type notifyBatcher struct {
+	mu      sync.Mutex
+	cfg     *Config
+	wg      *sync.WaitGroup
+	pending map[batchKey]*event
+	timer   *time.Timer // set while events are pending
+}
+
+// batchKey identifies the events merged into a digest.
+type batchKey struct {
+	family Family
+	newIP  string
+}
+
+// add notifies the given ip_changed event once the batch window has passed, merged with any others of the same
+// family & new IP. The batch is tracked by wg until it is sent.
+func (b *notifyBatcher) add(cfg *Config, wg *sync.WaitGroup, ev event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.timer == nil {
+		b.cfg, b.wg, b.pending = cfg, wg, map[batchKey]*event{}
+		wg.Add(1)
+		b.timer = time.AfterFunc(time.Duration(cfg.NotifyBatchWindow*float64(time.Second)), b.flush)
+	}
+	k := batchKey{ev.Family, ev.NewIP}
+	digest, ok := b.pending[k]
+	if !ok {
+		ev.Hostnames = append([]string(nil), ev.Hostnames...)
+		b.pending[k] = &ev
+		return
+	}
+	if digest.OldIP != ev.OldIP {
+		digest.OldIP = "" // the records were changed from different IPs
+	}
+	for _, h := range ev.Hostnames {
+		if !contains(digest.Hostnames, h) {
+			digest.Hostnames = append(digest.Hostnames, h)
+		}
+	}
+	sort.Strings(digest.Hostnames)
+	digest.Timestamp = ev.Timestamp
+}
+
+// flush notifies the pending digests now, if any.
+func (b *notifyBatcher) flush() {
+	b.mu.Lock()
+	if b.timer == nil {
+		b.mu.Unlock()
+		return
+	}
+	b.timer.Stop()
+	cfg, wg, pending := b.cfg, b.wg, b.pending
+	b.timer, b.pending = nil, nil
+	b.mu.Unlock()
+
+	var digests []*event
+	for _, ev := range pending {
+		digests = append(digests, ev)
+	}
+	sort.Slice(digests, func(i, j int) bool {
+		if digests[i].Family != digests[j].Family {
+			return digests[i].Family < digests[j].Family
+		}
+		return digests[i].NewIP < digests[j].NewIP
+	})
+	for _, ev := range digests {
+		notify(cfg, wg, *ev)
+	}
+	wg.Done()
+}
+
+// sendWebhook posts the given event to the given webhook URL as JSON.
+func sendWebhook(ctx context.Context, cfg *Config, url string, ev event) error {
+	body, err := json.Marshal(ev)
+	if err != nil {
+		return fmt.Errorf("could not marshal notification: %v", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("could not create request: %v", err)
+	}
+	req.Header.Set("User-Agent", cfg.UserAgent)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := cfg.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("could not make request: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("HTTP error: %v", resp.Status)
+	}
+	return nil
+}
+
+// runCommand runs the given command, describing the given event in its environment.
+func runCommand(ctx context.Context, cfg *Config, command []string, ev event) error {
+	cmd := exec.CommandContext(ctx, command[0], command[1:]...)
+	// Credentials given by environment variables are not passed on.
+env:
+	for _, kv := range os.Environ() {
+		for _, e := range cfg.secretEnvs {
+			if strings.HasPrefix(kv, e+"=") {
+				continue env
+			}
+		}
+		cmd.Env = append(cmd.Env, kv)
+	}
+	cmd.Env = append(cmd.Env,
+		"GDDDCD_EVENT="+ev.Event,
+		"GDDDCD_OLD_IP="+ev.OldIP,
+		"GDDDCD_NEW_IP="+ev.NewIP,
+		"GDDDCD_FAMILY="+string(ev.Family),
+		"GDDDCD_HOSTNAMES="+strings.Join(ev.Hostnames, " "),
+		"GDDDCD_ERROR="+ev.Error,
+		"GDDDCD_PERMANENT="+strconv.FormatBool(ev.Permanent),
+		"GDDDCD_TIMESTAMP="+ev.Timestamp.Format(time.RFC3339))
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%v (output: %q)", err, out)
+	}
+	return nil
+}
+
+// sendEmail sends mail describing the given event.
+func sendEmail(cfg *emailConfig, ev event) error {
+	host, _, err := net.SplitHostPort(cfg.SMTPAddr)
+	if err != nil {
+		return fmt.Errorf("could not parse smtp_addr: %v", err)
+	}
+	var auth smtp.Auth
+	if cfg.Username != "" {
+		auth = smtp.PlainAuth("", cfg.Username, cfg.Password, host)
+	}
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", cfg.From)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(cfg.To, ", "))
+	fmt.Fprintf(&msg, "Subject: gdddcd: %s for %s\r\n", ev.Event, strings.Join(ev.Hostnames, ", "))
+	fmt.Fprintf(&msg, "Date: %s\r\n", ev.Timestamp.Format(time.RFC1123Z))
+	fmt.Fprintf(&msg, "Content-Type: text/plain; charset=utf-8\r\n\r\n%s at %s\r\n", ev, ev.Timestamp.Format(time.RFC3339))
+	if err := smtp.SendMail(cfg.SMTPAddr, auth, cfg.From, cfg.To, msg.Bytes()); err != nil {
+		return fmt.Errorf("could not send mail: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,192 @@
+package gdddc
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+)
+
+// testWebhook is a webhook that records the events POSTed to it.
+type testWebhook struct {
+	*httptest.Server
+	mu     sync.Mutex
+	events []event
+}
+
+func newTestWebhook() *testWebhook {
+	wh := &testWebhook{}
+	wh.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var ev event
+		if err := json.NewDecoder(r.Body).Decode(&ev); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		wh.mu.Lock()
+		defer wh.mu.Unlock()
+		wh.events = append(wh.events, ev)
+	}))
+	return wh
+}
+
+// received returns the names of the events received so far, sorted.
+func (wh *testWebhook) received() []string {
+	wh.mu.Lock()
+	defer wh.mu.Unlock()
+	var names []string
+	for _, ev := range wh.events {
+		names = append(names, ev.Event)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestNotifyOn(t *testing.T) {
+	for _, test := range []struct {
+		notifyOn string // JSON, or "" for the default
+		want     []string
+	}{
+		{"", []string{eventIPChanged, eventRecovered}},
+		{`["change", "error", "recovery", "startup"]`, []string{eventIPChanged, eventRecovered, eventStarted, eventUpdateFailed}},
+		{`["startup"]`, []string{eventStarted}},
+		{`[]`, nil},
+	} {
+		p := newTestProvider("203.0.113.7")
+		wh := newTestWebhook()
+		extra := fmt.Sprintf(`, "notify_url": "%s", "retry_policy": {"max_attempts": 1}`, wh.URL)
+		if test.notifyOn != "" {
+			extra += `, "notify_on": ` + test.notifyOn
+		}
+		d := NewDaemon(p.config(t, extra), testStore(t, ""))
+		ctx := context.Background()
+
+		// A failed cycle, then one that succeeds.
+		p.setFail(true)
+		if err := d.RunOnce(ctx); err != ErrUpdateFailed {
+			t.Errorf("RunOnce with failing provider got error %v, want %v", err, ErrUpdateFailed)
+		}
+		p.setFail(false)
+		if err := d.RunOnce(ctx); err != nil {
+			t.Errorf("RunOnce got unexpected error: %v", err)
+		}
+		d.Wait()
+		if got := wh.received(); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("With notify_on %s, got events %q, want %q", test.notifyOn, got, test.want)
+		}
+		wh.Close()
+		p.Close()
+	}
+}
+
+func TestNotificationWants(t *testing.T) {
+	notifyOn := []string{"change", "permanent_error"}
+	for _, test := range []struct {
+		n    notification
+		ev   event
+		want bool
+	}{
+		{notification{}, event{Event: eventIPChanged}, true},
+		{notification{}, event{Event: eventUpdateFailed}, false},
+		{notification{}, event{Event: eventAuthFailed, Permanent: true}, true},
+		{notification{Events: []string{eventUpdateFailed}}, event{Event: eventUpdateFailed}, true},
+		{notification{Events: []string{eventUpdateFailed}}, event{Event: eventIPChanged}, false},
+	} {
+		if got := test.n.wants(test.ev, notifyOn); got != test.want {
+			t.Errorf("Notification with events %q wants %s (permanent: %v) = %v, want %v", test.n.Events, test.ev.Event, test.ev.Permanent, got, test.want)
+		}
+	}
+}
+
+func TestNotifyBatching(t *testing.T) {
+	wh := newTestWebhook()
+	defer wh.Close()
+	cfg := testConfig(t, fmt.Sprintf(`{"hostname": ["a.example.com", "b.example.com", "c.example.com"], "username": "u", "password": "p", "notify_url": "%s", "notify_batch_window_s": 60}`, wh.URL))
+	var b notifyBatcher
+	var wg sync.WaitGroup
+	for _, ev := range []event{
+		{Event: eventIPChanged, OldIP: "198.51.100.1", NewIP: "203.0.113.7", Family: IPv4, Hostnames: []string{"b.example.com"}},
+		{Event: eventIPChanged, OldIP: "198.51.100.2", NewIP: "203.0.113.8", Family: IPv4, Hostnames: []string{"c.example.com"}},
+		{Event: eventIPChanged, OldIP: "198.51.100.1", NewIP: "203.0.113.7", Family: IPv4, Hostnames: []string{"a.example.com"}},
+	} {
+		b.add(cfg, &wg, ev)
+	}
+	if got := wh.received(); len(got) != 0 {
+		t.Errorf("Within batch window, got events %q, want none", got)
+	}
+
+	// Flushing sends one digest per new IP, without waiting for the window.
+	b.flush()
+	wg.Wait()
+	wh.mu.Lock()
+	defer wh.mu.Unlock()
+	var got []string
+	for _, ev := range wh.events {
+		got = append(got, ev.String())
+	}
+	sort.Strings(got)
+	want := []string{
+		"ip_changed for a.example.com, b.example.com (ipv4 198.51.100.1 -> 203.0.113.7)",
+		"ip_changed for c.example.com (ipv4 198.51.100.2 -> 203.0.113.8)",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("After flush, got events %q, want %q", got, want)
+	}
+}
+
+func TestReloadGraceCycles(t *testing.T) {
+	p := newTestProvider("203.0.113.7")
+	defer p.Close()
+	wh := newTestWebhook()
+	defer wh.Close()
+	extra := fmt.Sprintf(`, "notify_url": "%s", "notify_batch_window_s": 60, "ip_cache_s": 0.001, "reload_grace_cycles": 1`, wh.URL)
+	d := NewDaemon(p.config(t, extra), testStore(t, ""))
+	ctx := context.Background()
+	setIP := func(ip string) {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		p.ip = ip
+	}
+
+	// Before the reload, ip_changed events are batched. (A pending batch is tracked by d.background, so it is only
+	// waited for once nothing is batched.)
+	if err := d.RunOnce(ctx); err != nil {
+		t.Fatalf("RunOnce got unexpected error: %v", err)
+	}
+	if got := wh.received(); len(got) != 0 {
+		t.Errorf("Before reload, got events %q, want none", got)
+	}
+
+	// Reloading sends the batched events, & drops the mismatches found before the reload.
+	d.mismatches <- propagationMismatch{record{"a.example.com", IPv4}, "203.0.113.7", p.URL + "/ip", []string{"192.0.2.1"}}
+	d.setConfig(p.config(t, extra))
+	d.background.Wait()
+	if got, want := wh.received(), []string{eventIPChanged}; !reflect.DeepEqual(got, want) {
+		t.Errorf("After reload, got events %q, want %q", got, want)
+	}
+	if got := len(d.mismatches); got != 0 {
+		t.Errorf("After reload, %d mismatches are waiting to be cross-checked, want 0", got)
+	}
+
+	// The change detected by the grace cycle is notified at once; later ones are batched again.
+	setIP("203.0.113.8")
+	if err := d.RunOnce(ctx); err != nil {
+		t.Fatalf("RunOnce got unexpected error: %v", err)
+	}
+	d.background.Wait()
+	if got, want := wh.received(), []string{eventIPChanged, eventIPChanged}; !reflect.DeepEqual(got, want) {
+		t.Errorf("After grace cycle, got events %q, want %q", got, want)
+	}
+	setIP("203.0.113.9")
+	if err := d.RunOnce(ctx); err != nil {
+		t.Fatalf("RunOnce got unexpected error: %v", err)
+	}
+	if got, want := wh.received(), []string{eventIPChanged, eventIPChanged}; !reflect.DeepEqual(got, want) {
+		t.Errorf("After cycle following grace cycle, got events %q, want %q", got, want)
+	}
+	d.Wait()
+}
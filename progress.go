@@ -0,0 +1,111 @@
+package gdddc
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	maxProgressSubscribers = 8  // subscribers streamed to at once; more are refused
+	progressBuffer         = 64 // progress events buffered per subscriber; one further behind is dropped
+)
+
+// Kinds of progress event.
+const (
+	progressCheckStarted = "check_started" // an IP check started
+	progressCheckResult  = "check_result"  // an IP check finished, detecting IP or failing with Error
+	progressUpdateSent   = "update_sent"   // an update of a record to IP was sent
+	progressUpdateResult = "update_result" // an update finished, succeeding or failing with Error
+)
+
+// progress is a step of the daemon's activity, streamed to the subscribers of the admin endpoint's /events.
+type progress struct {
+	Event     string    `json:"event"`
+	Family    Family    `json:"family,omitempty"`
+	Hostname  string    `json:"hostname,omitempty"`
+	IP        string    `json:"ip,omitempty"`
+	Error     string    `json:"error,omitempty"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// progressStream sends progress events to its subscribers. It never blocks the daemon: a subscriber whose buffer is
+// full is dropped.
+type progressStream struct {
+	mu   sync.Mutex
+	subs map[chan progress]bool
+}
+
+// publish sends the given progress event to each subscriber, dropping those that have fallen behind.
+func (s *progressStream) publish(p progress) {
+	p.Timestamp = time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for ch := range s.subs {
+		select {
+		case ch <- p:
+		default:
+			warnf("Dropping /events subscriber, which has fallen %d events behind", progressBuffer)
+			delete(s.subs, ch)
+			close(ch)
+		}
+	}
+}
+
+// subscribe returns a channel receiving the progress events published from now on, which is closed if the
+// subscriber is dropped; it returns nil if there are already too many subscribers.
+func (s *progressStream) subscribe() chan progress {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.subs) >= maxProgressSubscribers {
+		return nil
+	}
+	if s.subs == nil {
+		s.subs = map[chan progress]bool{}
+	}
+	ch := make(chan progress, progressBuffer)
+	s.subs[ch] = true
+	return ch
+}
+
+// unsubscribe stops sending progress events to the given channel, unless it has already been dropped.
+func (s *progressStream) unsubscribe(ch chan progress) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.subs[ch] {
+		delete(s.subs, ch)
+		close(ch)
+	}
+}
+
+// serve streams progress events as newline-delimited JSON until the client disconnects or is dropped.
+func (s *progressStream) serve(w http.ResponseWriter, r *http.Request) {
+	ch := s.subscribe()
+	if ch == nil {
+		http.Error(w, "too many subscribers", http.StatusServiceUnavailable)
+		return
+	}
+	defer s.unsubscribe(ch)
+	rc := http.NewResponseController(w)
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	rc.Flush()
+	enc := json.NewEncoder(w)
+	for {
+		select {
+		case p, ok := <-ch:
+			if !ok {
+				return // dropped
+			}
+			// A client that stops reading is disconnected, rather than holding its connection open forever.
+			rc.SetWriteDeadline(time.Now().Add(10 * time.Second))
+			if err := enc.Encode(p); err != nil {
+				return
+			}
+			rc.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
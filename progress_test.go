@@ -0,0 +1,94 @@
+package gdddc
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestProgressStreamDropsSlowSubscribers(t *testing.T) {
+	var s progressStream
+	slow, fast := s.subscribe(), s.subscribe()
+	for i := 0; i < progressBuffer+1; i++ {
+		s.publish(progress{Event: progressCheckStarted, Family: IPv4})
+		<-fast
+	}
+	// The slow subscriber's buffer filled, so it was dropped: its channel is closed once drained.
+	for i := 0; i < progressBuffer; i++ {
+		<-slow
+	}
+	if _, ok := <-slow; ok {
+		t.Errorf("Slow subscriber got an event beyond its buffer, want channel closed")
+	}
+	s.publish(progress{Event: progressCheckStarted, Family: IPv4})
+	if _, ok := <-fast; !ok {
+		t.Errorf("Fast subscriber was dropped")
+	}
+	s.unsubscribe(fast)
+	s.unsubscribe(slow) // already dropped
+}
+
+func TestProgressStreamLimitsSubscribers(t *testing.T) {
+	var s progressStream
+	for i := 0; i < maxProgressSubscribers; i++ {
+		if s.subscribe() == nil {
+			t.Fatalf("Subscriber %d was refused, want at most %d accepted", i+1, maxProgressSubscribers)
+		}
+	}
+	srv := httptest.NewServer(http.HandlerFunc(s.serve))
+	defer srv.Close()
+	resp, err := http.Get(srv.URL)
+	if err != nil {
+		t.Fatalf("Could not get events: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("Subscribing beyond the limit got status %v, want %v", resp.Status, http.StatusServiceUnavailable)
+	}
+}
+
+func TestProgressEvents(t *testing.T) {
+	p := newTestProvider("203.0.113.7")
+	defer p.Close()
+	d := NewDaemon(p.config(t, ""), testStore(t, ""))
+	srv := httptest.NewServer(http.HandlerFunc(d.progress.serve))
+	defer srv.Close()
+	resp, err := http.Get(srv.URL)
+	if err != nil {
+		t.Fatalf("Could not get events: %v", err)
+	}
+	defer resp.Body.Close()
+	if got, want := resp.Header.Get("Content-Type"), "application/x-ndjson"; got != want {
+		t.Errorf("Events served with Content-Type %q, want %q", got, want)
+	}
+
+	if err := d.RunOnce(context.Background()); err != nil {
+		t.Fatalf("RunOnce got unexpected error: %v", err)
+	}
+	sc := bufio.NewScanner(resp.Body)
+	for _, want := range []progress{
+		{Event: progressCheckStarted, Family: IPv4},
+		{Event: progressCheckResult, Family: IPv4, IP: "203.0.113.7"},
+		{Event: progressUpdateSent, Family: IPv4, Hostname: "a.example.com", IP: "203.0.113.7"},
+		{Event: progressUpdateResult, Family: IPv4, Hostname: "a.example.com", IP: "203.0.113.7"},
+	} {
+		if !sc.Scan() {
+			t.Fatalf("Event stream ended before %s event: %v", want.Event, sc.Err())
+		}
+		var got progress
+		if err := json.Unmarshal(sc.Bytes(), &got); err != nil {
+			t.Fatalf("Could not parse event %q: %v", sc.Text(), err)
+		}
+		if got.Timestamp.IsZero() {
+			t.Errorf("Event %q has no timestamp", sc.Text())
+		}
+		got.Timestamp = want.Timestamp
+		if got != want {
+			t.Errorf("Got event %+v, want %+v", got, want)
+		}
+	}
+	d.Wait()
+}
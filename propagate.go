@@ -0,0 +1,192 @@
+package gdddc
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// propagationConfig configures checking that updated records come to resolve to their new IP.
+type propagationConfig struct {
+	// Resolver, if set, is the DNS server (host[:port]) queried. By default, the hostname's authoritative name
+	// servers are queried. Both are ignored if doh_url is set: records are then queried at the DoH server.
+	Resolver string `json:"resolver"`
+	// Delay is the time to wait after an update before querying, & between queries.
+	Delay float64 `json:"delay_s"`
+	// Window is how long after an update the record may take to resolve to the new IP before it is reported.
+	Window float64 `json:"window_s"`
+	// CrossCheck, if set, re-detects the IP with the other IP check URLs when a record does not come to resolve to
+	// its new IP. If they agree with the record, the IP check URL that detected the new IP is taken to be wrong: the
+	// state is corrected to the record's IP, & the agreeing URL is preferred by later checks.
+	CrossCheck bool `json:"cross_check"`
+}
+
+// fillDefaults fills in default values for unspecified fields.
+func (p *propagationConfig) fillDefaults() error {
+	if p.Resolver != "" {
+		if _, _, err := net.SplitHostPort(p.Resolver); err != nil {
+			p.Resolver = net.JoinHostPort(p.Resolver, "53")
+		}
+	}
+	if p.Delay <= 0 {
+		debugf("verify_propagation.delay_s unspecified (or negative) in config, using default of 10")
+		p.Delay = 10
+	}
+	if p.Window <= 0 {
+		debugf("verify_propagation.window_s unspecified (or negative) in config, using default of 300")
+		p.Window = 300
+	}
+	if p.Window < p.Delay {
+		return fmt.Errorf("verify_propagation.window_s must not be less than delay_s")
+	}
+	return nil
+}
+
+// verifyPropagation checks, in the background (tracked by wg), that the given record comes to resolve to the given IP
+// within the config's propagation window. If it does not, this is logged, counted, & notified as a
+// propagation_failed event, & mismatched (if non-nil) is called with the IPs it last resolved to, if any.
+func verifyPropagation(cfg *Config, m *metrics, wg *sync.WaitGroup, r record, ip string, mismatched func(dnsIPs []string)) {
+	p := cfg.VerifyPropagation
+	delay := time.Duration(p.Delay * float64(time.Second))
+	window := time.Duration(p.Window * float64(time.Second))
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ctx, cancel := context.WithTimeout(context.Background(), window)
+		defer cancel()
+		var dnsIPs []string
+		var err error
+		for {
+			select {
+			case <-time.After(delay):
+			case <-ctx.Done():
+				if err == nil {
+					err = ctx.Err()
+				}
+				errorf("%s record of %s did not resolve to %v within %v: %v", r.family, r.hostname, ip, window, err)
+				m.recordPropagation(err)
+				cfg.statsd.count("propagation.failure", 1)
+				notify(cfg, wg, event{Event: eventPropagationFailed, NewIP: ip, Family: r.family, Hostnames: []string{r.hostname}, Error: err.Error(), Timestamp: time.Now()})
+				if mismatched != nil && len(dnsIPs) > 0 {
+					mismatched(dnsIPs)
+				}
+				return
+			}
+			if dnsIPs, err = checkPropagation(ctx, cfg, r, ip); err == nil {
+				infof("Verified that %s record of %s resolves to %v", r.family, r.hostname, ip)
+				m.recordPropagation(nil)
+				return
+			}
+		}
+	}()
+}
+
+// checkPropagation returns an error unless the given record resolves to the given IP at the configured resolver,
+// along with the IPs it resolves to (if it could be resolved).
+func checkPropagation(ctx context.Context, cfg *Config, r record, ip string) ([]string, error) {
+	ips, err := resolveRecord(ctx, cfg, r)
+	if err != nil {
+		return nil, fmt.Errorf("could not resolve %q: %v", r.hostname, err)
+	}
+	for _, got := range ips {
+		if got == ip {
+			return ips, nil
+		}
+	}
+	return ips, fmt.Errorf("%q resolves to %v", r.hostname, ips)
+}
+
+// resolveRecord returns the IPs (in canonical form) of the given record at verify_propagation's resolver if one is
+// configured, or else at the hostname's authoritative name servers, so that cached answers are not returned. If
+// doh_url is set, the record is instead looked up at the DoH server, as plain DNS may be tampered with; its answers
+// may be cached, which propagation verification's retries allow for.
+func resolveRecord(ctx context.Context, cfg *Config, r record) ([]string, error) {
+	resolver := cfg.resolver
+	if cfg.DoHURL == "" {
+		var servers []string
+		if p := cfg.VerifyPropagation; p != nil && p.Resolver != "" {
+			servers = []string{p.Resolver}
+		} else {
+			var err error
+			if servers, err = authoritativeServers(ctx, cfg, r.hostname); err != nil {
+				return nil, err
+			}
+		}
+		resolver = serverResolver(cfg, servers)
+	}
+	network := "ip4"
+	if r.family == IPv6 {
+		network = "ip6"
+	}
+	addrs, err := resolver.LookupIP(ctx, network, r.hostname)
+	if err != nil {
+		return nil, err
+	}
+	var ips []string
+	for _, addr := range addrs {
+		ips = append(ips, canonicalIP(addr.String()))
+	}
+	return ips, nil
+}
+
+// updateVerifyDelays are the waits before each query verifying an update that got an empty response, per
+// empty_response_policy verify: the authoritative servers may not all serve the new record at once.
+var updateVerifyDelays = []time.Duration{time.Second, 2 * time.Second, 4 * time.Second}
+
+// resolvesTo reports whether the given record resolves to the given IP (see resolveRecord), querying after each of
+// the given delays until it does. An error is returned if the last query failed.
+func resolvesTo(ctx context.Context, cfg *Config, r record, ip string, delays []time.Duration) (bool, error) {
+	ip = canonicalIP(ip)
+	var err error
+	for _, delay := range delays {
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return false, ctx.Err()
+		}
+		var ips []string
+		if ips, err = resolveRecord(ctx, cfg, r); err == nil && contains(ips, ip) {
+			return true, nil
+		}
+	}
+	return false, err
+}
+
+// authoritativeServers returns the addresses (host:port) of the authoritative name servers of the zone containing
+// the given hostname, which is found by looking up NS records of the hostname & then each of its parent domains.
+func authoritativeServers(ctx context.Context, cfg *Config, hostname string) ([]string, error) {
+	labels := strings.Split(strings.TrimSuffix(hostname, "."), ".")
+	for i := 0; i < len(labels)-1; i++ {
+		nss, err := cfg.resolver.LookupNS(ctx, strings.Join(labels[i:], "."))
+		if err != nil || len(nss) == 0 {
+			continue
+		}
+		var servers []string
+		for _, ns := range nss {
+			servers = append(servers, net.JoinHostPort(strings.TrimSuffix(ns.Host, "."), "53"))
+		}
+		return servers, nil
+	}
+	return nil, fmt.Errorf("could not find authoritative name servers of %q", hostname)
+}
+
+// serverResolver returns a resolver that queries the given DNS servers (host:port), trying each in turn.
+func serverResolver(cfg *Config, servers []string) *net.Resolver {
+	dialer := &net.Dialer{Timeout: 10 * time.Second, Resolver: cfg.resolver}
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			var err error
+			for _, s := range servers {
+				var conn net.Conn
+				if conn, err = dialer.DialContext(ctx, network, s); err == nil {
+					return conn, nil
+				}
+			}
+			return nil, err
+		},
+	}
+}
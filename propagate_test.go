@@ -0,0 +1,198 @@
+package gdddc
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestCrossCheckMismatches(t *testing.T) {
+	for _, test := range []struct {
+		desc   string
+		dnsIPs []string
+		want   string // published IP after the cross-check
+		prefer bool   // whether the other URL is preferred after the cross-check
+	}{
+		{"DNS agrees with other URL", []string{"203.0.113.7"}, "203.0.113.7", true},
+		{"DNS disagrees with other URL", []string{"192.0.2.1"}, "198.51.100.66", false},
+	} {
+		p := newTestProvider("203.0.113.7")
+		bad := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, "198.51.100.66")
+		}))
+		cfg := testConfig(t, fmt.Sprintf(`{"hostname": "a.example.com", "provider": "dyndns2", "update_url": "%s/nic/update", "username": "u", "password": "p", "ip_check_url": ["%s", "%s/ip"]}`, p.URL, bad.URL, p.URL))
+		d := NewDaemon(cfg, testStore(t, ""))
+		ctx := context.Background()
+
+		// The first IP check URL reports a bad IP, which is published.
+		if err := d.RunOnce(ctx); err != nil {
+			t.Fatalf("%s: RunOnce got unexpected error: %v", test.desc, err)
+		}
+		if got, want := d.detector.sourceURLs[IPv4], bad.URL; got != want {
+			t.Errorf("%s: IP detected by %q, want %q", test.desc, got, want)
+		}
+
+		// Once propagation verification finds the record resolving to other IPs, the next cycle cross-checks the IP
+		// with the other URL.
+		r := record{"a.example.com", IPv4}
+		d.mismatches <- propagationMismatch{r, "198.51.100.66", bad.URL, test.dnsIPs}
+		if err := d.RunOnce(ctx); err != nil {
+			t.Fatalf("%s: RunOnce got unexpected error: %v", test.desc, err)
+		}
+		if got := d.store.IP(r.hostname, r.family); got != test.want {
+			t.Errorf("%s: after cross-check, published IP = %q, want %q", test.desc, got, test.want)
+		}
+		if got := d.detector.checkURLs[IPv4] == p.URL+"/ip"; got != test.prefer {
+			t.Errorf("%s: after cross-check, other URL preferred = %v, want %v", test.desc, got, test.prefer)
+		}
+		if got := p.updateCount(); got != 1 {
+			t.Errorf("%s: got %d updates, want 1", test.desc, got)
+		}
+		bad.Close()
+		p.Close()
+	}
+}
+
+// fakeDoH is a DNS-over-HTTPS server that answers A queries with a fixed IP, & other queries with no records.
+type fakeDoH struct {
+	*httptest.Server
+	ip net.IP
+
+	mu      sync.Mutex
+	queries []string // names of the A queries received
+}
+
+func newFakeDoH(ip string) *fakeDoH {
+	d := &fakeDoH{ip: net.ParseIP(ip)}
+	d.Server = httptest.NewTLSServer(http.HandlerFunc(d.serve))
+	return d
+}
+
+func (d *fakeDoH) serve(w http.ResponseWriter, r *http.Request) {
+	q, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "bad query", http.StatusBadRequest)
+		return
+	}
+	resp, name, isA := dnsAnswer(q, d.ip)
+	if resp == nil {
+		http.Error(w, "bad query", http.StatusBadRequest)
+		return
+	}
+	if isA {
+		d.mu.Lock()
+		d.queries = append(d.queries, name)
+		d.mu.Unlock()
+	}
+	w.Header().Set("Content-Type", "application/dns-message")
+	w.Write(resp)
+}
+
+// dnsAnswer returns the response to the given DNS query, answering an A query with the given IP, & others with no
+// records, along with the name queried & whether it is an A query. It returns a nil response if the query cannot be
+// parsed.
+func dnsAnswer(q []byte, ip net.IP) (resp []byte, name string, isA bool) {
+	if len(q) < 12 {
+		return nil, "", false
+	}
+	// Find the end of the (single) question: its name's labels, then its type & class.
+	i := 12
+	var labels []string
+	for i < len(q) && q[i] != 0 {
+		if i+1+int(q[i]) > len(q) {
+			return nil, "", false
+		}
+		labels = append(labels, string(q[i+1:i+1+int(q[i])]))
+		i += 1 + int(q[i])
+	}
+	i++
+	if i+4 > len(q) {
+		return nil, "", false
+	}
+	isA = binary.BigEndian.Uint16(q[i:]) == 1
+	i += 4
+
+	// Answer with the query's header (as a response) & question, then an A record if asked for one.
+	resp = append([]byte{}, q[:i]...)
+	binary.BigEndian.PutUint16(resp[2:], 0x8180)
+	binary.BigEndian.PutUint16(resp[6:], 0)
+	binary.BigEndian.PutUint16(resp[8:], 0)
+	binary.BigEndian.PutUint16(resp[10:], 0)
+	if isA {
+		binary.BigEndian.PutUint16(resp[6:], 1)
+		resp = append(resp, 0xc0, 12, 0, 1, 0, 1, 0, 0, 0, 60, 0, 4)
+		resp = append(resp, ip.To4()...)
+	}
+	return resp, strings.Join(labels, "."), isA
+}
+
+// fakeDNS is a DNS server (over UDP) answering A queries with the IPs in its answers, in turn; once they run out, it
+// keeps answering with the last.
+type fakeDNS struct {
+	conn    net.PacketConn
+	mu      sync.Mutex
+	answers []string
+}
+
+func newFakeDNS(t *testing.T, answers ...string) *fakeDNS {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Could not listen for DNS queries: %v", err)
+	}
+	d := &fakeDNS{conn: conn, answers: answers}
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			d.mu.Lock()
+			resp, _, isA := dnsAnswer(buf[:n], net.ParseIP(d.answers[0]))
+			if isA && len(d.answers) > 1 {
+				d.answers = d.answers[1:]
+			}
+			d.mu.Unlock()
+			if resp != nil {
+				conn.WriteTo(resp, addr)
+			}
+		}
+	}()
+	return d
+}
+
+func (d *fakeDNS) Addr() string { return d.conn.LocalAddr().String() }
+func (d *fakeDNS) Close()       { d.conn.Close() }
+
+func (d *fakeDoH) queried() []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([]string{}, d.queries...)
+}
+
+func TestPropagationUsesDoH(t *testing.T) {
+	doh := newFakeDoH("203.0.113.7")
+	defer doh.Close()
+	// verify_propagation's resolver is unreachable, so only the DoH server can answer.
+	cfg := testConfig(t, fmt.Sprintf(`{"hostname": "a.example.com", "username": "u", "password": "p", "doh_url": "%s", "verify_propagation": {"resolver": "192.0.2.1"}}`, doh.URL))
+	cfg.resolver = newDoHResolver(doh.URL, cfg.UserAgent, doh.Client())
+
+	ips, err := checkPropagation(context.Background(), cfg, record{"a.example.com", IPv4}, "203.0.113.7")
+	if err != nil {
+		t.Fatalf("checkPropagation got unexpected error: %v", err)
+	}
+	if want := []string{"203.0.113.7"}; fmt.Sprint(ips) != fmt.Sprint(want) {
+		t.Errorf("checkPropagation got IPs %v, want %v", ips, want)
+	}
+	if got := doh.queried(); len(got) == 0 || got[0] != "a.example.com" {
+		t.Errorf("DoH server got A queries for %q, want a.example.com", got)
+	}
+}
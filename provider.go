@@ -0,0 +1,413 @@
+package gdddc
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// provider updates DNS records at a DNS provider.
+type provider interface {
+	// update sets the record of the given family for hc's hostname to ip, returning the provider's response.
+	update(ctx context.Context, c *Client, hc hostConfig, family Family, ip string) (*Response, error)
+	// usesUsername reports whether the provider's credentials include a username, rather than just a password or token.
+	usesUsername() bool
+	// supportsFamily reports whether the provider can update records of the given family.
+	supportsFamily(family Family) bool
+	// supportsComments reports whether the provider can set a comment on records (a host's comment) by updates.
+	supportsComments() bool
+	// check returns an error unless the provider can be reached &, where this can be done without updating a record,
+	// hc's credentials are accepted.
+	check(ctx context.Context, c *Client, hc hostConfig) error
+}
+
+// txtProvider is implemented by providers that can also keep a TXT record (a host's txt_record) up to date.
+type txtProvider interface {
+	// updateTXT sets the content of hc's TXT record, creating the record if needed.
+	updateTXT(ctx context.Context, c *Client, hc hostConfig, content string) error
+}
+
+// newProvider creates the provider configured for the given host.
+func newProvider(hc hostConfig) (provider, error) {
+	switch hc.Provider {
+	case "google":
+		return dyndns2Provider{url: "https://domains.google.com/nic/update"}, nil
+	case "dyndns2":
+		if hc.UpdateURL == "" {
+			return nil, fmt.Errorf("update_url is required for the dyndns2 provider")
+		}
+		return dyndns2Provider{url: hc.UpdateURL}, nil
+	case "duckdns":
+		if !strings.HasSuffix(hc.Hostname, ".duckdns.org") {
+			return nil, fmt.Errorf("hostname %q is not a duckdns.org hostname", hc.Hostname)
+		}
+		return duckDNSProvider{}, nil
+	case "namecheap":
+		return namecheapProvider{zone: zoneOf(hc)}, nil
+	case "cloudflare":
+		return cloudflareProvider{zone: zoneOf(hc)}, nil
+	}
+	return nil, fmt.Errorf("provider must be one of google, dyndns2, duckdns, namecheap, or cloudflare")
+}
+
+// zoneOf returns the DNS zone (i.e. the registered domain) containing the given host's hostname.
+func zoneOf(hc hostConfig) string {
+	if hc.Zone != "" {
+		return hc.Zone
+	}
+	labels := strings.Split(hc.Hostname, ".")
+	if len(labels) > 2 {
+		labels = labels[len(labels)-2:]
+	}
+	zone := strings.Join(labels, ".")
+	debugf("zone unspecified for %s in config, using default of %s", hc.Hostname, zone)
+	return zone
+}
+
+// renderComment returns the comment to set on hc's record by an update to the given IP.
+func (hc hostConfig) renderComment(ip string) (string, error) {
+	var buf bytes.Buffer
+	data := struct{ Time, IP, Hostname string }{time.Now().UTC().Format(time.RFC3339), ip, hc.Hostname}
+	if err := hc.comment.Execute(&buf, data); err != nil {
+		return "", fmt.Errorf("could not render comment: %v", err)
+	}
+	return buf.String(), nil
+}
+
+// doUpdateRequest makes an IP update request, returning the response & its body. The given secret, which may be
+// a parameter of the request URL, is removed from any returned error.
+func doUpdateRequest(c *Client, req *http.Request, secret string) (*http.Response, []byte, error) {
+	req.Header.Set("User-Agent", c.cfg.UserAgent)
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not make request: %v", redactSecret(err, secret))
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not read response%s: %v", formatHeaders(captureHeaders(c.cfg, resp)), err)
+	}
+	return resp, body, nil
+}
+
+// checkReachable returns an error unless an HTTP request to the given URL gets a response (of any status).
+func checkReachable(ctx context.Context, c *Client, u string) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", u, nil)
+	if err != nil {
+		return fmt.Errorf("could not create request: %v", err)
+	}
+	_, _, err = doUpdateRequest(c, req, "")
+	return err
+}
+
+// redactSecret replaces any URL parameter with the given secret value in the URL of err, if it is a *url.Error.
+func redactSecret(err error, secret string) error {
+	e, ok := err.(*url.Error)
+	if !ok || secret == "" {
+		return err
+	}
+	u, perr := url.Parse(e.URL)
+	if perr != nil {
+		return errors.New("request failed (could not redact URL)")
+	}
+	q := u.Query()
+	for _, vs := range q {
+		for i, v := range vs {
+			if v == secret {
+				vs[i] = "REDACTED"
+			}
+		}
+	}
+	u.RawQuery = q.Encode()
+	return &url.Error{Op: e.Op, URL: u.String(), Err: e.Err}
+}
+
+// dyndns2Provider updates records using the dyndns2 protocol, as used by Google Domains & many others.
+type dyndns2Provider struct {
+	url string
+}
+
+func (p dyndns2Provider) usesUsername() bool                { return true }
+func (p dyndns2Provider) supportsFamily(family Family) bool { return true }
+func (p dyndns2Provider) supportsComments() bool            { return false }
+
+func (p dyndns2Provider) check(ctx context.Context, c *Client, hc hostConfig) error {
+	return checkReachable(ctx, c, p.url)
+}
+
+func (p dyndns2Provider) update(ctx context.Context, c *Client, hc hostConfig, family Family, newIP string) (*Response, error) {
+	// Credentials are sent in a header rather than the URL, so that they cannot appear in errors (which include the URL).
+	u := fmt.Sprintf("%s?hostname=%s&myip=%s", p.url, url.QueryEscape(hc.Hostname), url.QueryEscape(newIP))
+	req, err := http.NewRequestWithContext(ctx, "POST", u, nil)
+	if err != nil {
+		return nil, fmt.Errorf("could not create request: %v", err)
+	}
+	req.SetBasicAuth(hc.Username, hc.Password)
+	resp, bodyBytes, err := doUpdateRequest(c, req, "")
+	if err != nil {
+		return nil, err
+	}
+	hdrs := captureHeaders(c.cfg, resp)
+	body := string(bodyBytes)
+	ok, respErr := parseResponse(body, newIP)
+	if ok {
+		return newResponse(body, hdrs), nil
+	}
+	if respErr != nil {
+		respErr.hdrs = formatHeaders(hdrs)
+		return nil, respErr
+	}
+	if resp.StatusCode == 200 && strings.TrimSpace(body) == "" {
+		// Some proxies strip response bodies, so an empty body does not confirm the update.
+		if c.cfg.EmptyResponsePolicy == "verify" {
+			live, err := resolvesTo(ctx, c.cfg, record{hc.Hostname, family}, newIP, updateVerifyDelays)
+			if err != nil {
+				return nil, fmt.Errorf("IP update got empty response, and could not verify it%s: %v", formatHeaders(hdrs), err)
+			}
+			if !live {
+				return nil, fmt.Errorf("IP update got empty response, and %s does not resolve to %s%s", hc.Hostname, newIP, formatHeaders(hdrs))
+			}
+			infof("IP update got empty response, but %s resolves to %s; treating as successful", hc.Hostname, newIP)
+			return newResponse(body, hdrs), nil
+		}
+		warnf("IP update got empty response; assuming (unconfirmed) success%s", formatHeaders(hdrs))
+		return newResponse(body, hdrs), nil
+	}
+	if resp.StatusCode == 200 {
+		warnf("IP update got unexpected response body for successful update: %q%s", body, formatHeaders(hdrs))
+		return newResponse(body, hdrs), nil
+	}
+	return nil, fmt.Errorf("IP update got error: %q (%v)%s", body, resp.Status, formatHeaders(hdrs))
+}
+
+// duckDNSProvider updates records of duckdns.org subdomains. The password is the account's token.
+type duckDNSProvider struct{}
+
+func (p duckDNSProvider) usesUsername() bool                { return false }
+func (p duckDNSProvider) supportsFamily(family Family) bool { return true }
+func (p duckDNSProvider) supportsComments() bool            { return false }
+
+func (p duckDNSProvider) check(ctx context.Context, c *Client, hc hostConfig) error {
+	return checkReachable(ctx, c, "https://www.duckdns.org/")
+}
+
+func (p duckDNSProvider) update(ctx context.Context, c *Client, hc hostConfig, family Family, newIP string) (*Response, error) {
+	ipParam := "ip"
+	if family == IPv6 {
+		ipParam = "ipv6"
+	}
+	q := url.Values{}
+	q.Set("domains", strings.TrimSuffix(hc.Hostname, ".duckdns.org"))
+	q.Set("token", hc.Password)
+	q.Set(ipParam, newIP)
+	req, err := http.NewRequestWithContext(ctx, "GET", "https://www.duckdns.org/update?"+q.Encode(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("could not create request: %v", err)
+	}
+	resp, body, err := doUpdateRequest(c, req, hc.Password)
+	if err != nil {
+		return nil, err
+	}
+	hdrs := captureHeaders(c.cfg, resp)
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("IP update got error: %q (%v)%s", body, resp.Status, formatHeaders(hdrs))
+	}
+	if strings.TrimSpace(string(body)) != "OK" {
+		// DuckDNS reports any failure (e.g. a bad token or unknown domain) as just "KO".
+		return nil, fmt.Errorf("IP update got error response %q (token or domain not valid)%s", body, formatHeaders(hdrs))
+	}
+	return newResponse(string(body), hdrs), nil
+}
+
+// namecheapProvider updates records hosted by Namecheap. The password is the domain's dynamic DNS password.
+type namecheapProvider struct {
+	zone string
+}
+
+func (p namecheapProvider) usesUsername() bool                { return false }
+func (p namecheapProvider) supportsFamily(family Family) bool { return family == IPv4 }
+func (p namecheapProvider) supportsComments() bool            { return false }
+
+func (p namecheapProvider) check(ctx context.Context, c *Client, hc hostConfig) error {
+	return checkReachable(ctx, c, "https://dynamicdns.park-your-domain.com/")
+}
+
+func (p namecheapProvider) update(ctx context.Context, c *Client, hc hostConfig, family Family, newIP string) (*Response, error) {
+	host := strings.TrimSuffix(hc.Hostname, "."+p.zone)
+	if hc.Hostname == p.zone {
+		host = "@"
+	}
+	q := url.Values{}
+	q.Set("host", host)
+	q.Set("domain", p.zone)
+	q.Set("password", hc.Password)
+	q.Set("ip", newIP)
+	req, err := http.NewRequestWithContext(ctx, "GET", "https://dynamicdns.park-your-domain.com/update?"+q.Encode(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("could not create request: %v", err)
+	}
+	resp, body, err := doUpdateRequest(c, req, hc.Password)
+	if err != nil {
+		return nil, err
+	}
+	hdrs := captureHeaders(c.cfg, resp)
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("IP update got error: %q (%v)%s", body, resp.Status, formatHeaders(hdrs))
+	}
+	var result struct {
+		ErrCount int      `xml:"ErrCount"`
+		Errors   []string `xml:"errors>Err1"`
+	}
+	if err := xml.Unmarshal(body, &result); err != nil {
+		return nil, fmt.Errorf("could not parse response%s: %v", formatHeaders(hdrs), err)
+	}
+	if result.ErrCount > 0 {
+		return nil, fmt.Errorf("IP update got errors %q%s", result.Errors, formatHeaders(hdrs))
+	}
+	return newResponse(string(body), hdrs), nil
+}
+
+// cloudflareProvider updates records hosted by Cloudflare, using its API. The password is an API token with
+// permission to edit the zone's DNS records. The A & AAAA records must already exist.
+type cloudflareProvider struct {
+	zone string
+}
+
+func (p cloudflareProvider) usesUsername() bool                { return false }
+func (p cloudflareProvider) supportsFamily(family Family) bool { return true }
+func (p cloudflareProvider) supportsComments() bool            { return true }
+
+// check looks up the zone, which checks the API token too.
+func (p cloudflareProvider) check(ctx context.Context, c *Client, hc hostConfig) error {
+	_, err := p.zoneID(ctx, c, hc)
+	return err
+}
+
+func (p cloudflareProvider) update(ctx context.Context, c *Client, hc hostConfig, family Family, newIP string) (*Response, error) {
+	zoneID, err := p.zoneID(ctx, c, hc)
+	if err != nil {
+		return nil, err
+	}
+	typ := "A"
+	if family == IPv6 {
+		typ = "AAAA"
+	}
+	recordsPath := fmt.Sprintf("/zones/%s/dns_records", zoneID)
+	id, err := p.recordID(ctx, c, hc, recordsPath, typ, hc.Hostname)
+	if err != nil {
+		return nil, err
+	}
+	if id == "" {
+		return nil, fmt.Errorf("%s has no %s record", hc.Hostname, typ)
+	}
+	body := map[string]string{"content": newIP}
+	if hc.comment != nil {
+		if body["comment"], err = hc.renderComment(newIP); err != nil {
+			return nil, err
+		}
+	}
+	return p.call(ctx, c, hc, "PATCH", recordsPath+"/"+id, body, nil)
+}
+
+// updateTXT sets the content of hc's TXT record, which is created if it does not exist yet (unlike A & AAAA records,
+// gdddcd is its only writer).
+func (p cloudflareProvider) updateTXT(ctx context.Context, c *Client, hc hostConfig, content string) error {
+	zoneID, err := p.zoneID(ctx, c, hc)
+	if err != nil {
+		return err
+	}
+	recordsPath := fmt.Sprintf("/zones/%s/dns_records", zoneID)
+	id, err := p.recordID(ctx, c, hc, recordsPath, "TXT", hc.TXTRecord)
+	if err != nil {
+		return err
+	}
+	if id == "" {
+		_, err = p.call(ctx, c, hc, "POST", recordsPath, map[string]interface{}{"type": "TXT", "name": hc.TXTRecord, "content": content, "ttl": 1}, nil)
+	} else {
+		_, err = p.call(ctx, c, hc, "PATCH", recordsPath+"/"+id, map[string]string{"content": content}, nil)
+	}
+	return err
+}
+
+// zoneID returns the Cloudflare ID of the provider's zone.
+func (p cloudflareProvider) zoneID(ctx context.Context, c *Client, hc hostConfig) (string, error) {
+	var zones []struct {
+		ID string `json:"id"`
+	}
+	if _, err := p.call(ctx, c, hc, "GET", "/zones?name="+url.QueryEscape(p.zone), nil, &zones); err != nil {
+		return "", fmt.Errorf("could not look up zone %s: %v", p.zone, err)
+	}
+	if len(zones) == 0 {
+		return "", fmt.Errorf("zone %s not found", p.zone)
+	}
+	return zones[0].ID, nil
+}
+
+// recordID returns the ID of the zone's record of the given type & name, or "" if there is none.
+func (p cloudflareProvider) recordID(ctx context.Context, c *Client, hc hostConfig, recordsPath, typ, name string) (string, error) {
+	var records []struct {
+		ID string `json:"id"`
+	}
+	if _, err := p.call(ctx, c, hc, "GET", fmt.Sprintf("%s?type=%s&name=%s", recordsPath, typ, url.QueryEscape(name)), nil, &records); err != nil {
+		return "", fmt.Errorf("could not look up %s record: %v", typ, err)
+	}
+	if len(records) == 0 {
+		return "", nil
+	}
+	return records[0].ID, nil
+}
+
+// call makes a Cloudflare API request with the given JSON body (if non-nil), unmarshalling the response's result
+// into result (if non-nil).
+func (p cloudflareProvider) call(ctx context.Context, c *Client, hc hostConfig, method, path string, body, result interface{}) (*Response, error) {
+	var reqBody []byte
+	if body != nil {
+		var err error
+		if reqBody, err = json.Marshal(body); err != nil {
+			return nil, fmt.Errorf("could not marshal request: %v", err)
+		}
+	}
+	req, err := http.NewRequestWithContext(ctx, method, "https://api.cloudflare.com/client/v4"+path, bytes.NewReader(reqBody))
+	if err != nil {
+		return nil, fmt.Errorf("could not create request: %v", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+hc.Password)
+	req.Header.Set("Content-Type", "application/json")
+	resp, respBody, err := doUpdateRequest(c, req, hc.Password)
+	if err != nil {
+		return nil, err
+	}
+	hdrs := captureHeaders(c.cfg, resp)
+	var r struct {
+		Success bool `json:"success"`
+		Errors  []struct {
+			Code    int    `json:"code"`
+			Message string `json:"message"`
+		} `json:"errors"`
+		Result json.RawMessage `json:"result"`
+	}
+	if err := json.Unmarshal(respBody, &r); err != nil {
+		return nil, fmt.Errorf("could not parse response (%v)%s: %v", resp.Status, formatHeaders(hdrs), err)
+	}
+	if !r.Success {
+		var msgs []string
+		for _, e := range r.Errors {
+			msgs = append(msgs, fmt.Sprintf("%d: %s", e.Code, e.Message))
+		}
+		return nil, fmt.Errorf("API error (%v): %s%s", resp.Status, strings.Join(msgs, "; "), formatHeaders(hdrs))
+	}
+	if result != nil {
+		if err := json.Unmarshal(r.Result, result); err != nil {
+			return nil, fmt.Errorf("could not parse result%s: %v", formatHeaders(hdrs), err)
+		}
+	}
+	return newResponse(string(respBody), hdrs), nil
+}
@@ -0,0 +1,261 @@
+package gdddc
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeCloudflare serves the parts of the Cloudflare API used by the cloudflare provider, for the zone example.com
+// with a single A record for a.example.com. TXT record writes fail while failTXT is set.
+type fakeCloudflare struct {
+	*httptest.Server
+	mu      sync.Mutex
+	records map[string]map[string]string // by ID: the record's type, name, & content
+	writes  []map[string]interface{}     // bodies of POST & PATCH requests, in order
+	failTXT bool
+}
+
+func newFakeCloudflare() *fakeCloudflare {
+	cf := &fakeCloudflare{records: map[string]map[string]string{
+		"r1": {"type": "A", "name": "a.example.com", "content": "198.51.100.1"},
+	}}
+	cf.Server = httptest.NewServer(http.HandlerFunc(cf.serve))
+	return cf
+}
+
+func (cf *fakeCloudflare) serve(w http.ResponseWriter, r *http.Request) {
+	cf.mu.Lock()
+	defer cf.mu.Unlock()
+	reply := func(result interface{}) {
+		json.NewEncoder(w).Encode(map[string]interface{}{"success": true, "result": result})
+	}
+	if r.Header.Get("Authorization") != "Bearer token" {
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprint(w, `{"success": false, "errors": [{"code": 9109, "message": "Invalid access token"}]}`)
+		return
+	}
+	var body map[string]interface{}
+	if r.Method == "POST" || r.Method == "PATCH" {
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		cf.writes = append(cf.writes, body)
+	}
+	fail := func() {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(w, `{"success": false, "errors": [{"code": 10000, "message": "Internal error"}]}`)
+	}
+	switch path := strings.TrimPrefix(r.URL.Path, "/client/v4"); {
+	case path == "/zones" && r.URL.Query().Get("name") == "example.com":
+		reply([]map[string]string{{"id": "z1"}})
+	case path == "/zones":
+		reply([]map[string]string{})
+	case path == "/zones/z1/dns_records" && r.Method == "GET":
+		matches := []map[string]string{}
+		for id, rec := range cf.records {
+			if rec["type"] == r.URL.Query().Get("type") && rec["name"] == r.URL.Query().Get("name") {
+				matches = append(matches, map[string]string{"id": id})
+			}
+		}
+		reply(matches)
+	case path == "/zones/z1/dns_records" && r.Method == "POST":
+		if cf.failTXT && body["type"] == "TXT" {
+			fail()
+			return
+		}
+		id := fmt.Sprintf("r%d", len(cf.records)+1)
+		cf.records[id] = map[string]string{"type": body["type"].(string), "name": body["name"].(string), "content": body["content"].(string)}
+		reply(map[string]string{"id": id})
+	case strings.HasPrefix(path, "/zones/z1/dns_records/") && r.Method == "PATCH":
+		rec, ok := cf.records[strings.TrimPrefix(path, "/zones/z1/dns_records/")]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"success": false, "errors": [{"code": 81044, "message": "Record does not exist"}]}`)
+			return
+		}
+		if cf.failTXT && rec["type"] == "TXT" {
+			fail()
+			return
+		}
+		rec["content"] = body["content"].(string)
+		reply(map[string]string{})
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// record returns the content of the record of the given type & name, or "" if there is none.
+func (cf *fakeCloudflare) record(typ, name string) string {
+	cf.mu.Lock()
+	defer cf.mu.Unlock()
+	for _, rec := range cf.records {
+		if rec["type"] == typ && rec["name"] == name {
+			return rec["content"]
+		}
+	}
+	return ""
+}
+
+// writeCount returns the number of POST & PATCH requests received.
+func (cf *fakeCloudflare) writeCount() int {
+	cf.mu.Lock()
+	defer cf.mu.Unlock()
+	return len(cf.writes)
+}
+
+func (cf *fakeCloudflare) setFailTXT(fail bool) {
+	cf.mu.Lock()
+	defer cf.mu.Unlock()
+	cf.failTXT = fail
+}
+
+// client returns an HTTP client that sends requests for the Cloudflare API to the fake.
+func (cf *fakeCloudflare) client() *http.Client {
+	u, _ := url.Parse(cf.URL)
+	return &http.Client{Transport: redirectTransport{u.Host}}
+}
+
+// redirectTransport sends every request over plain HTTP to the given host instead.
+type redirectTransport struct {
+	host string
+}
+
+func (t redirectTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.URL.Scheme, req.URL.Host = "http", t.host
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func TestCloudflareUpdate(t *testing.T) {
+	cf := newFakeCloudflare()
+	defer cf.Close()
+	cfg := testConfig(t, `{"hosts": [{"hostname": "a.example.com", "provider": "cloudflare", "password": "token", "txt_record": "_ip.a.example.com"}]}`)
+	c := NewClient(cfg, cf.client())
+	ctx := context.Background()
+
+	if _, err := c.Update(ctx, "a.example.com", IPv4, "203.0.113.7"); err != nil {
+		t.Fatalf("Update got unexpected error: %v", err)
+	}
+	if got, want := cf.record("A", "a.example.com"), "203.0.113.7"; got != want {
+		t.Errorf("After Update, A record = %q, want %q", got, want)
+	}
+	if _, err := c.Update(ctx, "a.example.com", IPv6, "2001:db8::1"); err == nil || !strings.Contains(err.Error(), "has no AAAA record") {
+		t.Errorf("Update of missing AAAA record got error %v, want error containing %q", err, "has no AAAA record")
+	}
+
+	// The TXT record is created by its first update, & modified by later ones.
+	for _, content := range []string{"ip=203.0.113.7;updated=2021-06-01T12:00:00Z", "ip=203.0.113.8;updated=2021-06-02T12:00:00Z"} {
+		if err := c.UpdateTXT(ctx, "a.example.com", content); err != nil {
+			t.Fatalf("UpdateTXT(%q) got unexpected error: %v", content, err)
+		}
+		if got := cf.record("TXT", "_ip.a.example.com"); got != content {
+			t.Errorf("After UpdateTXT(%q), TXT record = %q", content, got)
+		}
+	}
+	if got, want := cf.writeCount(), 3; got != want {
+		t.Errorf("Got %d writes, want %d (the A record, then creating & modifying the TXT record)", got, want)
+	}
+}
+
+func TestCloudflareComment(t *testing.T) {
+	cf := newFakeCloudflare()
+	defer cf.Close()
+	cfg := testConfig(t, `{"hosts": [{"hostname": "a.example.com", "provider": "cloudflare", "password": "token"}], "comment": "set to {{.IP}} for {{.Hostname}}"}`)
+	if _, err := NewClient(cfg, cf.client()).Update(context.Background(), "a.example.com", IPv4, "203.0.113.7"); err != nil {
+		t.Fatalf("Update got unexpected error: %v", err)
+	}
+	if got, want := cf.writes[0]["comment"], "set to 203.0.113.7 for a.example.com"; got != want {
+		t.Errorf("Update set comment %q, want %q", got, want)
+	}
+}
+
+func TestCloudflareBadToken(t *testing.T) {
+	cf := newFakeCloudflare()
+	defer cf.Close()
+	cfg := testConfig(t, `{"hosts": [{"hostname": "a.example.com", "provider": "cloudflare", "password": "wrong"}]}`)
+	err := NewClient(cfg, cf.client()).Check(context.Background(), "a.example.com")
+	if err == nil || !strings.Contains(err.Error(), "Invalid access token") {
+		t.Errorf("Check with bad token got error %v, want error containing %q", err, "Invalid access token")
+	}
+}
+
+func TestTXTRecordRetried(t *testing.T) {
+	cf := newFakeCloudflare()
+	defer cf.Close()
+	p := newTestProvider("203.0.113.7")
+	defer p.Close()
+	cfg := testConfig(t, fmt.Sprintf(`{"hosts": [{"hostname": "a.example.com", "provider": "cloudflare", "password": "token", "txt_record": "_ip.a.example.com"}], "ip_check_url": "%s/ip", "retry_policy": {"max_attempts": 1}}`, p.URL))
+	d := NewDaemon(cfg, testStore(t, ""))
+	d.client = NewClient(cfg, cf.client())
+	ctx := context.Background()
+
+	// A failed TXT write fails the cycle, though the A record is updated.
+	cf.setFailTXT(true)
+	if err := d.RunOnce(ctx); err != ErrUpdateFailed {
+		t.Fatalf("RunOnce with failing TXT write got error %v, want %v", err, ErrUpdateFailed)
+	}
+	if got, want := cf.record("A", "a.example.com"), "203.0.113.7"; got != want {
+		t.Errorf("A record = %q, want %q", got, want)
+	}
+
+	// The next cycle writes the TXT record, though the A record is unchanged.
+	cf.setFailTXT(false)
+	writes := cf.writeCount()
+	if err := d.RunOnce(ctx); err != nil {
+		t.Fatalf("RunOnce got unexpected error: %v", err)
+	}
+	if got := cf.writeCount() - writes; got != 1 {
+		t.Errorf("Second cycle made %d writes, want 1 (the TXT record)", got)
+	}
+	want := "ip=203.0.113.7;updated=" + d.store.lastUpdate("a.example.com").UTC().Format(time.RFC3339)
+	if got := cf.record("TXT", "_ip.a.example.com"); got != want {
+		t.Errorf("TXT record = %q, want %q", got, want)
+	}
+
+	// Once written, the TXT record is left alone until the A record changes.
+	writes = cf.writeCount()
+	if err := d.RunOnce(ctx); err != nil {
+		t.Fatalf("RunOnce got unexpected error: %v", err)
+	}
+	if got := cf.writeCount() - writes; got != 0 {
+		t.Errorf("Third cycle made %d writes, want 0", got)
+	}
+}
+
+func TestEmptyResponseVerified(t *testing.T) {
+	delays := updateVerifyDelays
+	defer func() { updateVerifyDelays = delays }()
+	updateVerifyDelays = []time.Duration{0, time.Millisecond, time.Millisecond}
+	srv := httptest.NewServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {})) // 200, empty body
+	defer srv.Close()
+
+	for _, test := range []struct {
+		desc    string
+		answers []string // the record's IPs at its servers, in turn
+		wantErr string   // or "" if the update succeeds
+	}{
+		{"record updated at once", []string{"203.0.113.7"}, ""},
+		{"record updated after a query", []string{"198.51.100.1", "203.0.113.7"}, ""},
+		{"record not updated", []string{"198.51.100.1"}, "does not resolve to 203.0.113.7"},
+	} {
+		dns := newFakeDNS(t, test.answers...)
+		cfg := testConfig(t, fmt.Sprintf(`{"hostname": "a.example.com", "provider": "dyndns2", "update_url": "%s", "username": "u", "password": "p", "empty_response_policy": "verify", "verify_propagation": {"resolver": "%s"}}`, srv.URL, dns.Addr()))
+		_, err := NewClient(cfg, nil).Update(context.Background(), "a.example.com", IPv4, "203.0.113.7")
+		switch {
+		case test.wantErr == "" && err != nil:
+			t.Errorf("%s: Update got unexpected error: %v", test.desc, err)
+		case test.wantErr != "" && (err == nil || !strings.Contains(err.Error(), test.wantErr)):
+			t.Errorf("%s: Update got error %v, want error containing %q", test.desc, err, test.wantErr)
+		}
+		dns.Close()
+	}
+}
@@ -0,0 +1,52 @@
+package gdddc
+
+import (
+	"fmt"
+	"strings"
+)
+
+// responseError is an error reported by Google Domains via one of the documented dyndns response codes.
+type responseError struct {
+	code string // e.g. "badauth"
+	body string
+	hdrs string // formatted captured headers, if any
+}
+
+func (e *responseError) Error() string {
+	return fmt.Sprintf("IP update got error response %q (%s)%s", e.body, responseCodeDescs[e.code], e.hdrs)
+}
+
+// permanent reports whether the error will recur for every request for the hostname, so retrying is pointless.
+func (e *responseError) permanent() bool {
+	return e.code != "911"
+}
+
+// responseCodeDescs describes each documented error response code.
+var responseCodeDescs = map[string]string{
+	"nohost":   "hostname does not exist, or does not have dynamic DNS enabled",
+	"badauth":  "username/password combination is not valid for the hostname",
+	"notfqdn":  "hostname is not a fully-qualified domain name",
+	"badagent": "user agent was rejected",
+	"abuse":    "dynamic DNS access for the hostname has been blocked due to failure to interpret previous responses",
+	"911":      "server-side error",
+	"conflict": "custom A/AAAA records conflict with the update",
+}
+
+// parseResponse parses a dyndns response body. It reports whether the body is a success response ("good" or "nochg")
+// for the given IP, or returns a *responseError if the body holds a documented error code. Other bodies are
+// reported as neither.
+func parseResponse(body, ip string) (bool, *responseError) {
+	f := strings.Fields(body)
+	if len(f) == 0 {
+		return false, nil
+	}
+	switch code := f[0]; {
+	case (code == "good" || code == "nochg") && len(f) == 2:
+		return canonicalIP(f[1]) == ip, nil
+	case code == "conflict" && len(f) >= 2:
+		return false, &responseError{code: code, body: strings.TrimSpace(body)}
+	case len(f) == 1 && responseCodeDescs[code] != "" && code != "conflict":
+		return false, &responseError{code: code, body: code}
+	}
+	return false, nil
+}
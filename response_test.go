@@ -0,0 +1,45 @@
+package gdddc
+
+import "testing"
+
+func TestParseResponse(t *testing.T) {
+	for _, test := range []struct {
+		body, ip string
+		want     bool
+		wantCode string // "" if no error is expected
+	}{
+		{"good 203.0.113.7", "203.0.113.7", true, ""},
+		{"nochg 203.0.113.7\n", "203.0.113.7", true, ""},
+		{"good 198.51.100.1", "203.0.113.7", false, ""},
+		{"good 2001:DB8:0::1", "2001:db8::1", true, ""},
+		{"good ::ffff:203.0.113.7", "203.0.113.7", true, ""},
+		{"good", "203.0.113.7", false, ""},
+		{"badauth", "203.0.113.7", false, "badauth"},
+		{"911\n", "203.0.113.7", false, "911"},
+		{"conflict A", "203.0.113.7", false, "conflict"},
+		{"conflict", "203.0.113.7", false, ""},
+		{"badauth extra", "203.0.113.7", false, ""},
+		{"", "203.0.113.7", false, ""},
+		{"<html>Service Unavailable</html>", "203.0.113.7", false, ""},
+	} {
+		got, err := parseResponse(test.body, test.ip)
+		if got != test.want {
+			t.Errorf("parseResponse(%q, %q) reported success %v, want %v", test.body, test.ip, got, test.want)
+		}
+		gotCode := ""
+		if err != nil {
+			gotCode = err.code
+		}
+		if gotCode != test.wantCode {
+			t.Errorf("parseResponse(%q, %q) got error code %q, want %q", test.body, test.ip, gotCode, test.wantCode)
+		}
+	}
+}
+
+func TestResponseErrorPermanent(t *testing.T) {
+	for code := range responseCodeDescs {
+		if got, want := (&responseError{code: code}).permanent(), code != "911"; got != want {
+			t.Errorf("responseError with code %q permanent() = %v, want %v", code, got, want)
+		}
+	}
+}
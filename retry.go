@@ -0,0 +1,102 @@
+package gdddc
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"math/rand"
+	"time"
+)
+
+// retryPolicy describes how a failed operation is retried within a single update cycle.
+type retryPolicy struct {
+	MaxAttempts int     `json:"max_attempts"`
+	Base        float64 `json:"base_s"`
+	Max         float64 `json:"max_s"`
+	Multiplier  float64 `json:"multiplier"`
+	Jitter      float64 `json:"jitter"`
+}
+
+// fillDefaults fills in default values for unspecified fields of the retry policy, and validates the result.
+func (p *retryPolicy) fillDefaults() error {
+	if p.MaxAttempts <= 0 {
+		debugf("retry_policy.max_attempts unspecified (or negative) in config, using default of 3")
+		p.MaxAttempts = 3
+	}
+	if p.Base <= 0 {
+		debugf("retry_policy.base_s unspecified (or negative) in config, using default of 1")
+		p.Base = 1
+	}
+	if p.Max <= 0 {
+		debugf("retry_policy.max_s unspecified (or negative) in config, using default of 10")
+		p.Max = 10
+	}
+	if p.Multiplier == 0 {
+		debugf("retry_policy.multiplier unspecified in config, using default of 2")
+		p.Multiplier = 2
+	}
+	return p.validate()
+}
+
+// inherit fills in unspecified (zero) fields of the retry policy from the given one, and validates the result.
+func (p *retryPolicy) inherit(from retryPolicy) error {
+	if p.MaxAttempts <= 0 {
+		p.MaxAttempts = from.MaxAttempts
+	}
+	if p.Base <= 0 {
+		p.Base = from.Base
+	}
+	if p.Max <= 0 {
+		p.Max = from.Max
+	}
+	if p.Multiplier == 0 {
+		p.Multiplier = from.Multiplier
+	}
+	if p.Jitter == 0 {
+		p.Jitter = from.Jitter
+	}
+	return p.validate()
+}
+
+// validate returns an error if the retry policy is not valid.
+func (p *retryPolicy) validate() error {
+	if p.Max < p.Base {
+		return fmt.Errorf("retry_policy.max_s (%v) must be at least retry_policy.base_s (%v)", p.Max, p.Base)
+	}
+	if p.Multiplier < 1 {
+		return fmt.Errorf("retry_policy.multiplier (%v) must be at least 1", p.Multiplier)
+	}
+	if p.Jitter < 0 || p.Jitter > 1 {
+		return fmt.Errorf("retry_policy.jitter (%v) must be between 0 and 1", p.Jitter)
+	}
+	return nil
+}
+
+// delay returns how long to wait after the given (1-based) failed attempt, including jitter.
+func (p retryPolicy) delay(attempt int) time.Duration {
+	d := math.Min(p.Base*math.Pow(p.Multiplier, float64(attempt-1)), p.Max)
+	d *= 1 + p.Jitter*(2*rand.Float64()-1)
+	return time.Duration(d * float64(time.Second))
+}
+
+// retry calls f until it succeeds, the policy's attempts are exhausted, or ctx is done, returning the last error.
+// Errors reported by Google Domains' response codes are not retried, since an immediate retry will not help.
+// desc describes the operation for logging, e.g. "check IP".
+func (p retryPolicy) retry(ctx context.Context, desc string, f func() error) error {
+	for attempt := 1; ; attempt++ {
+		err := f()
+		if _, ok := err.(*responseError); ok {
+			return err
+		}
+		if err == nil || attempt >= p.MaxAttempts || ctx.Err() != nil {
+			return err
+		}
+		d := p.delay(attempt)
+		warnf("Could not %s (attempt %d of %d), retrying in %v: %v", desc, attempt, p.MaxAttempts, d, err)
+		select {
+		case <-time.After(d):
+		case <-ctx.Done():
+			return err
+		}
+	}
+}
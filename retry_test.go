@@ -0,0 +1,71 @@
+package gdddc
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRetryPolicyDelay(t *testing.T) {
+	p := retryPolicy{MaxAttempts: 6, Base: 1, Max: 10, Multiplier: 3}
+	for attempt, want := range []time.Duration{1 * time.Second, 3 * time.Second, 9 * time.Second, 10 * time.Second, 10 * time.Second} {
+		if got := p.delay(attempt + 1); got != want {
+			t.Errorf("delay(%d) = %v, want %v", attempt+1, got, want)
+		}
+	}
+
+	p.Jitter = 0.5
+	for i := 0; i < 100; i++ {
+		if got := p.delay(2); got < 1500*time.Millisecond || got > 4500*time.Millisecond {
+			t.Fatalf("delay(2) with jitter 0.5 = %v, want within 50%% of 3s", got)
+		}
+	}
+}
+
+func TestRetryPolicyRetry(t *testing.T) {
+	p := retryPolicy{MaxAttempts: 3, Base: 0.001, Max: 0.001, Multiplier: 1}
+	errTransient, errBadAuth := errors.New("transient"), &responseError{code: "badauth"}
+	for _, test := range []struct {
+		desc         string
+		errs         []error // returned by successive attempts; nil once exhausted
+		wantAttempts int
+		wantErr      error
+	}{
+		{"success", nil, 1, nil},
+		{"success after failures", []error{errTransient, errTransient}, 3, nil},
+		{"failures", []error{errTransient, errTransient, errTransient, errTransient}, 3, errTransient},
+		{"response error", []error{errBadAuth}, 1, errBadAuth},
+	} {
+		attempts := 0
+		err := p.retry(context.Background(), test.desc, func() error {
+			attempts++
+			if attempts <= len(test.errs) {
+				return test.errs[attempts-1]
+			}
+			return nil
+		})
+		if attempts != test.wantAttempts {
+			t.Errorf("[%s] retry made %d attempts, want %d", test.desc, attempts, test.wantAttempts)
+		}
+		if err != test.wantErr {
+			t.Errorf("[%s] retry got error %v, want %v", test.desc, err, test.wantErr)
+		}
+	}
+}
+
+func TestHostRetryPolicy(t *testing.T) {
+	cfg := testConfig(t, `{"hosts": [{"hostname": "a.example.com"}, {"hostname": "b.example.com", "retry_policy": {"max_attempts": 5, "max_s": 30}}], "username": "u", "password": "p", "retry_policy": {"base_s": 2}}`)
+	if got, want := cfg.retryPolicy("a.example.com"), (retryPolicy{MaxAttempts: 3, Base: 2, Max: 10, Multiplier: 2}); got != want {
+		t.Errorf("Retry policy of a.example.com = %+v, want %+v", got, want)
+	}
+	if got, want := cfg.retryPolicy("b.example.com"), (retryPolicy{MaxAttempts: 5, Base: 2, Max: 30, Multiplier: 2}); got != want {
+		t.Errorf("Retry policy of b.example.com = %+v, want %+v", got, want)
+	}
+
+	_, err := ParseConfig(strings.NewReader(`{"hosts": [{"hostname": "a.example.com", "retry_policy": {"max_s": 1}}], "username": "u", "password": "p", "retry_policy": {"base_s": 2}}`), "json")
+	if want := "invalid retry_policy of a.example.com"; err == nil || !strings.Contains(err.Error(), want) {
+		t.Errorf("ParseConfig with max_s below inherited base_s got error %v, want error containing %q", err, want)
+	}
+}
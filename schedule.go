@@ -0,0 +1,119 @@
+package gdddc
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"time"
+)
+
+// changeWindow describes a daily window, in local time, during which the IP is expected to change (e.g. because
+// the ISP forces a reconnect); the IP is checked at a different frequency during the window.
+type changeWindow struct {
+	Start           string  `json:"start"` // HH:MM
+	End             string  `json:"end"`   // HH:MM; may be before Start, for windows spanning midnight
+	UpdateFrequency float64 `json:"update_freq_s"`
+
+	start, end time.Duration // offsets of Start & End from midnight, filled in by parse
+}
+
+// parse validates the change window and fills in its derived fields.
+func (w *changeWindow) parse() error {
+	var err error
+	if w.start, err = parseTimeOfDay(w.Start); err != nil {
+		return fmt.Errorf("could not parse change_window.start: %v", err)
+	}
+	if w.end, err = parseTimeOfDay(w.End); err != nil {
+		return fmt.Errorf("could not parse change_window.end: %v", err)
+	}
+	if w.start == w.end {
+		return fmt.Errorf("change_window.start and change_window.end must differ")
+	}
+	if w.UpdateFrequency <= 0 {
+		return fmt.Errorf("change_window.update_freq_s must be positive")
+	}
+	return nil
+}
+
+// contains reports whether the given time falls within the window.
+func (w *changeWindow) contains(t time.Time) bool {
+	tod := timeOfDay(t)
+	if w.start < w.end {
+		return w.start <= tod && tod < w.end
+	}
+	return tod >= w.start || tod < w.end
+}
+
+// untilStart returns the duration from the given time until the window next starts.
+func (w *changeWindow) untilStart(t time.Time) time.Duration {
+	return nextTimeOfDay(t, w.start).Sub(t)
+}
+
+// parseTimeOfDay parses an HH:MM time of day into an offset from midnight.
+func parseTimeOfDay(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// timeOfDay returns the offset of the given time from its (local) midnight, as shown on the clock.
+func timeOfDay(t time.Time) time.Duration {
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute + time.Duration(t.Second())*time.Second
+}
+
+// nextTimeOfDay returns the first time strictly after t at which the clock reads the given time of day.
+// Using time.Date keeps this correct across DST transitions; a time of day skipped by a transition is
+// normalized by time.Date to a time an hour away from it.
+func nextTimeOfDay(t time.Time, tod time.Duration) time.Time {
+	h, m := int(tod/time.Hour), int(tod%time.Hour/time.Minute)
+	next := time.Date(t.Year(), t.Month(), t.Day(), h, m, 0, 0, t.Location())
+	for !next.After(t) {
+		next = time.Date(next.Year(), next.Month(), next.Day()+1, h, m, 0, 0, t.Location())
+	}
+	return next
+}
+
+// checkInterval returns how long to wait after the given time before the next check.
+func (c *Config) checkInterval(t time.Time) time.Duration {
+	freq := time.Duration(c.UpdateFrequency * float64(time.Second))
+	if w := c.ChangeWindow; w != nil {
+		if w.contains(t) {
+			return time.Duration(w.UpdateFrequency * float64(time.Second))
+		}
+		// Make sure not to sleep past the start of the window.
+		if d := w.untilStart(t); d < freq {
+			return d
+		}
+	}
+	return freq
+}
+
+// hostCheckInterval returns how long to wait after the given time before the next check of the given hostname: as
+// checkInterval, but using the hostname's own update frequency (if any) outside the change window.
+func (c *Config) hostCheckInterval(hostname string, t time.Time) time.Duration {
+	f := c.hosts[hostname].UpdateFrequency
+	if f <= 0 || c.ChangeWindow != nil && c.ChangeWindow.contains(t) {
+		return c.checkInterval(t)
+	}
+	freq := time.Duration(f * float64(time.Second))
+	if w := c.ChangeWindow; w != nil {
+		if d := w.untilStart(t); d < freq {
+			return d
+		}
+	}
+	return freq
+}
+
+// backoffInterval returns how long to wait before the next cycle after the given number of consecutive failed
+// cycles: the update frequency, doubled for each failure, capped at the max backoff, plus up to 10% jitter so that
+// many instances failing together do not stay synchronized.
+func (c *Config) backoffInterval(failures int) time.Duration {
+	return jittered(math.Min(c.UpdateFrequency*math.Pow(2, float64(failures)), c.MaxBackoff))
+}
+
+// jittered returns the given number of seconds as a duration, plus up to 10% jitter.
+func jittered(s float64) time.Duration {
+	return time.Duration(s * (1 + 0.1*rand.Float64()) * float64(time.Second))
+}
@@ -0,0 +1,103 @@
+package gdddc
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestNextTimeOfDay(t *testing.T) {
+	loc, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skipf("Could not load time zone: %v", err)
+	}
+	for _, test := range []struct {
+		t    time.Time
+		tod  string
+		want time.Time
+	}{
+		{time.Date(2026, 6, 1, 1, 0, 0, 0, loc), "03:30", time.Date(2026, 6, 1, 3, 30, 0, 0, loc)},
+		{time.Date(2026, 6, 1, 4, 0, 0, 0, loc), "03:30", time.Date(2026, 6, 2, 3, 30, 0, 0, loc)},
+		{time.Date(2026, 6, 1, 3, 30, 0, 0, loc), "03:30", time.Date(2026, 6, 2, 3, 30, 0, 0, loc)},
+		{time.Date(2026, 12, 31, 23, 0, 0, 0, loc), "00:15", time.Date(2027, 1, 1, 0, 15, 0, 0, loc)},
+		// Across the start & end of DST, the next day's time of day is 23 & 25 hours away.
+		{time.Date(2026, 3, 7, 4, 0, 0, 0, loc), "04:00", time.Date(2026, 3, 8, 4, 0, 0, 0, loc)},
+		{time.Date(2026, 10, 31, 4, 0, 0, 0, loc), "04:00", time.Date(2026, 11, 1, 4, 0, 0, 0, loc)},
+	} {
+		tod, err := parseTimeOfDay(test.tod)
+		if err != nil {
+			t.Fatalf("parseTimeOfDay(%q) got unexpected error: %v", test.tod, err)
+		}
+		if got := nextTimeOfDay(test.t, tod); !got.Equal(test.want) {
+			t.Errorf("nextTimeOfDay(%v, %s) = %v, want %v", test.t, test.tod, got, test.want)
+		}
+	}
+}
+
+func TestChangeWindowContains(t *testing.T) {
+	for _, test := range []struct {
+		start, end string
+		at         []string // times of day within the window
+		notAt      []string // times of day outside it
+	}{
+		{"02:00", "04:00", []string{"02:00", "03:59"}, []string{"01:59", "04:00", "12:00"}},
+		{"23:00", "01:00", []string{"23:00", "00:00", "00:59"}, []string{"01:00", "12:00", "22:59"}},
+	} {
+		w := &changeWindow{Start: test.start, End: test.end, UpdateFrequency: 10}
+		if err := w.parse(); err != nil {
+			t.Fatalf("Could not parse change window %s-%s: %v", test.start, test.end, err)
+		}
+		for _, s := range append(append([]string{}, test.at...), test.notAt...) {
+			tod, _ := parseTimeOfDay(s)
+			at := time.Date(2026, 6, 1, 0, 0, 0, 0, time.Local).Add(tod)
+			if got, want := w.contains(at), contains(test.at, s); got != want {
+				t.Errorf("Change window %s-%s contains %s = %v, want %v", test.start, test.end, s, got, want)
+			}
+		}
+	}
+}
+
+func TestScheduledUpdateRetriedOnSchedule(t *testing.T) {
+	p := newTestProvider("203.0.113.7")
+	defer p.Close()
+	store := testStore(t, `{"hosts": {"a.example.com": {"ip": "203.0.113.7"}}}`)
+	d := NewDaemon(p.config(t, `, "scheduled_update_at": "03:00", "retry_policy": {"max_attempts": 1}`), store)
+	ctx := context.Background()
+	if err := d.start(ctx); err != nil {
+		t.Fatalf("start got unexpected error: %v", err)
+	}
+
+	// A failed scheduled update is still due once the scheduled time has passed, but the next scheduled update
+	// moves on to the next day rather than firing again at once.
+	p.setFail(true)
+	d.nextScheduled = time.Now().Add(-time.Minute)
+	d.runOnce(ctx)
+	if got := p.updateCount(); got != 1 {
+		t.Fatalf("Got %d updates for scheduled update, want 1", got)
+	}
+	if !d.updateFailed {
+		t.Fatalf("Scheduled update to failing provider did not fail")
+	}
+	if !d.nextScheduled.After(time.Now()) {
+		t.Errorf("After failed scheduled update, next scheduled update at %v, want in the future", d.nextScheduled)
+	}
+	if r := (record{"a.example.com", IPv4}); !d.scheduledPending[r] {
+		t.Errorf("After failed scheduled update, record is not pending")
+	}
+
+	// The next cycle re-sends the IP, though it has not changed.
+	p.setFail(false)
+	d.runOnce(ctx)
+	if got := p.updateCount(); got != 2 {
+		t.Errorf("Got %d updates after retry of scheduled update, want 2", got)
+	}
+	if d.scheduledPending != nil {
+		t.Errorf("After successful retry, scheduled update is still pending: %v", d.scheduledPending)
+	}
+
+	// Later cycles do not re-send the IP.
+	d.runOnce(ctx)
+	if got := p.updateCount(); got != 2 {
+		t.Errorf("Got %d updates after scheduled update completed, want 2", got)
+	}
+}
@@ -0,0 +1,224 @@
+package gdddc
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// state stores read-write information.
+type state struct {
+	// Hosts holds per-hostname state, keyed by hostname.
+	Hosts map[string]*hostState `json:"hosts,omitempty"`
+
+	// Lifetime holds activity totals across restarts; only maintained if the config's persist_counters is set.
+	Lifetime counters `json:"lifetime,omitempty"`
+
+	// IP is the IP of the single hostname supported by older versions, which did not write Hosts.
+	// It is only read, to migrate such state.
+	IP string `json:"ip,omitempty"`
+}
+
+// hostState stores read-write information about a single hostname.
+type hostState struct {
+	// IP & IPv6 are the last IPv4 & IPv6 addresses successfully published for the hostname.
+	IP   string `json:"ip"`
+	IPv6 string `json:"ipv6,omitempty"`
+
+	// LastUpdate is the time of the last successful IP update, LastResponse the provider's response to it, &
+	// LastResponseHeaders its captured headers.
+	LastUpdate          *time.Time        `json:"last_update,omitempty"`
+	LastResponse        string            `json:"last_response,omitempty"`
+	LastResponseHeaders map[string]string `json:"last_response_headers,omitempty"`
+	// LastForcedUpdate is the time of the last successful update forced by force_update_interval_s.
+	LastForcedUpdate *time.Time `json:"last_forced_update,omitempty"`
+}
+
+// Store holds the state, such as the IPs last published to each record. It is kept in memory & written to a file
+// by Flush. It is not safe for concurrent use.
+type Store struct {
+	filename string
+	state    *state
+	// dirty is set if the state has changed since it was last written; ipDirty if a published IP has changed.
+	dirty, ipDirty bool
+	// lastWrite is the time at which the state was last written.
+	lastWrite time.Time
+}
+
+// OpenStore reads the state from the given file (re-reading it per opts, if it cannot be parsed), and returns a Store
+// that writes it back to the same file. If the file does not exist or cannot be parsed, the Store starts with empty
+// state, so every record is re-sent.
+func OpenStore(filename string, opts ReadOptions) (*Store, error) {
+	s := &state{}
+	stateBytes, err := readJSONFile(filename, opts)
+	switch {
+	case os.IsNotExist(err):
+		infof("State file %s does not exist, starting with empty state", filename)
+	case err != nil:
+		return nil, fmt.Errorf("could not read state: %v", err)
+	default:
+		if err := json.Unmarshal(stateBytes, s); err != nil {
+			warnf("Could not parse state file %s, starting with empty state: %v", filename, err)
+			s = &state{}
+		}
+	}
+	if s.Hosts == nil {
+		s.Hosts = map[string]*hostState{}
+	}
+	for _, hs := range s.Hosts {
+		hs.IP, hs.IPv6 = canonicalIP(hs.IP), canonicalIP(hs.IPv6)
+	}
+	s.IP = canonicalIP(s.IP)
+	return &Store{filename: filename, state: s}, nil
+}
+
+// IP returns the last IP of the given family published for the hostname, or "" if there is none.
+func (s *Store) IP(hostname string, family Family) string {
+	hs, ok := s.state.Hosts[hostname]
+	if !ok {
+		return ""
+	}
+	return hs.ip(family)
+}
+
+// SetIP records that the given IP is published for the hostname's record of the given family.
+func (s *Store) SetIP(hostname string, family Family, ip string) {
+	if hs := s.state.host(hostname); hs.ip(family) != ip {
+		hs.setIP(family, ip)
+		s.dirty, s.ipDirty = true, true
+	}
+}
+
+// lastUpdate returns the time of the hostname's last successful update, or the zero time if it is not known.
+func (s *Store) lastUpdate(hostname string) time.Time {
+	if hs, ok := s.state.Hosts[hostname]; ok && hs.LastUpdate != nil {
+		return *hs.LastUpdate
+	}
+	return time.Time{}
+}
+
+// recordUpdate records the provider's response to a successful update of the hostname's records, which was forced
+// by force_update_interval_s if forced is set.
+func (s *Store) recordUpdate(hostname string, resp *Response, forced bool) {
+	hs := s.state.host(hostname)
+	now := time.Now()
+	hs.LastUpdate, hs.LastResponse, hs.LastResponseHeaders = &now, resp.Body, resp.Headers
+	if forced {
+		hs.LastForcedUpdate = &now
+	}
+	s.dirty = true
+}
+
+// Flush writes the state to disk if it has changed. To limit writes (e.g. flash wear on embedded devices),
+// a changed IP is written immediately but other changes are only written if minInterval has passed since
+// the last write.
+func (s *Store) Flush(minInterval time.Duration) error {
+	if !s.dirty {
+		return nil
+	}
+	if !s.ipDirty && time.Since(s.lastWrite) < minInterval {
+		return nil
+	}
+	if err := s.state.write(s.filename); err != nil {
+		return err
+	}
+	s.dirty, s.ipDirty = false, false
+	s.lastWrite = time.Now()
+	return nil
+}
+
+// snapshot returns the state as JSON, with any credentials in the providers' responses redacted.
+func (s *Store) snapshot() ([]byte, error) {
+	st := state{Hosts: map[string]*hostState{}, Lifetime: s.state.Lifetime}
+	for h, hs := range s.state.Hosts {
+		c := *hs
+		c.LastResponse = redact(hs.LastResponse)
+		if hs.LastResponseHeaders != nil {
+			c.LastResponseHeaders = map[string]string{}
+			for k, v := range hs.LastResponseHeaders {
+				c.LastResponseHeaders[k] = redact(v)
+			}
+		}
+		st.Hosts[h] = &c
+	}
+	b, err := json.Marshal(st)
+	if err != nil {
+		return nil, fmt.Errorf("could not marshal state: %v", err)
+	}
+	return b, nil
+}
+
+// migrate converts state written by older, single-hostname versions, treating its IP as published for the given
+// hostnames. State that is already per-hostname is left unchanged.
+func (s *state) migrate(hostnames []string) {
+	if s.IP == "" || len(s.Hosts) > 0 {
+		return
+	}
+	for _, h := range hostnames {
+		s.Hosts[h] = &hostState{IP: s.IP}
+	}
+	s.IP = ""
+}
+
+// ip returns the last IP of the given family published for the hostname.
+func (hs *hostState) ip(family Family) string {
+	if family == IPv6 {
+		return hs.IPv6
+	}
+	return hs.IP
+}
+
+// setIP sets the last IP of the given family published for the hostname.
+func (hs *hostState) setIP(family Family, ip string) {
+	if family == IPv6 {
+		hs.IPv6 = ip
+	} else {
+		hs.IP = ip
+	}
+}
+
+// host returns the state of the given hostname, creating it if needed.
+func (s *state) host(hostname string) *hostState {
+	hs, ok := s.Hosts[hostname]
+	if !ok {
+		hs = &hostState{}
+		s.Hosts[hostname] = hs
+	}
+	return hs
+}
+
+// write writes the state to the given file. The state is written to a temporary file which is then renamed over the state
+// file, so that a crash mid-write cannot leave a truncated state file behind.
+func (s *state) write(filename string) (retErr error) {
+	stateBytes, err := json.Marshal(s)
+	if err != nil {
+		return fmt.Errorf("could not marshal state: %v", err)
+	}
+	f, err := ioutil.TempFile(filepath.Dir(filename), filepath.Base(filename)+".tmp")
+	if err != nil {
+		return fmt.Errorf("could not create temporary state file: %v", err)
+	}
+	defer func() {
+		if retErr != nil {
+			f.Close()
+			os.Remove(f.Name())
+		}
+	}()
+	// TempFile creates files with mode 0600, matching the state file's permissions.
+	if _, err := f.Write(stateBytes); err != nil {
+		return fmt.Errorf("could not write state: %v", err)
+	}
+	if err := f.Sync(); err != nil {
+		return fmt.Errorf("could not sync state: %v", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("could not close state: %v", err)
+	}
+	if err := os.Rename(f.Name(), filename); err != nil {
+		return fmt.Errorf("could not rename state: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,123 @@
+package gdddc
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testStore opens a Store backed by a state file holding the given JSON (or no file, if state is empty) in a
+// temporary directory.
+func testStore(t *testing.T, state string) *Store {
+	t.Helper()
+	filename := filepath.Join(t.TempDir(), "gdddcd.state")
+	if state != "" {
+		if err := ioutil.WriteFile(filename, []byte(state), 0600); err != nil {
+			t.Fatalf("Could not write state file: %v", err)
+		}
+	}
+	s, err := OpenStore(filename, ReadOptions{})
+	if err != nil {
+		t.Fatalf("Could not open state: %v", err)
+	}
+	return s
+}
+
+func TestOpenStoreCanonicalizesIPs(t *testing.T) {
+	s := testStore(t, `{"hosts": {"a.example.com": {"ip": "::ffff:203.0.113.7", "ipv6": "2001:DB8:0::1"}}}`)
+	if got, want := s.IP("a.example.com", IPv4), "203.0.113.7"; got != want {
+		t.Errorf("IPv4 of a.example.com = %q, want %q", got, want)
+	}
+	if got, want := s.IP("a.example.com", IPv6), "2001:db8::1"; got != want {
+		t.Errorf("IPv6 of a.example.com = %q, want %q", got, want)
+	}
+
+	// Re-publishing the same IPs does not make the state dirty, so it is not rewritten.
+	s.SetIP("a.example.com", IPv4, "203.0.113.7")
+	s.SetIP("a.example.com", IPv6, "2001:db8::1")
+	if s.dirty || s.ipDirty {
+		t.Errorf("SetIP with unchanged IPs made the state dirty")
+	}
+	s.SetIP("a.example.com", IPv4, "198.51.100.1")
+	if !s.dirty || !s.ipDirty {
+		t.Errorf("SetIP with a changed IP did not make the state dirty")
+	}
+}
+
+func TestOpenStoreMissingFile(t *testing.T) {
+	s := testStore(t, "")
+	if got := s.IP("a.example.com", IPv4); got != "" {
+		t.Errorf("IPv4 of a.example.com in empty state = %q, want none", got)
+	}
+	if _, err := os.Stat(s.filename); !os.IsNotExist(err) {
+		t.Errorf("OpenStore created state file %s before any change", s.filename)
+	}
+}
+
+func TestFlushThrottlesWrites(t *testing.T) {
+	s := testStore(t, "")
+	written := func() bool {
+		t.Helper()
+		_, err := os.Stat(s.filename)
+		if err != nil && !os.IsNotExist(err) {
+			t.Fatalf("Could not stat state file: %v", err)
+		}
+		ok := err == nil
+		os.Remove(s.filename)
+		return ok
+	}
+
+	// A changed IP is written immediately, even if the state was just written.
+	s.SetIP("a.example.com", IPv4, "203.0.113.7")
+	if err := s.Flush(time.Hour); err != nil {
+		t.Fatalf("Flush got unexpected error: %v", err)
+	}
+	if !written() {
+		t.Errorf("Flush did not write changed IP")
+	}
+
+	// Other changes wait for the minimum interval since the last write.
+	s.recordUpdate("a.example.com", &Response{Body: "nochg 203.0.113.7"}, true)
+	if err := s.Flush(time.Hour); err != nil {
+		t.Fatalf("Flush got unexpected error: %v", err)
+	}
+	if written() {
+		t.Errorf("Flush wrote change other than IP within minimum interval")
+	}
+	if err := s.Flush(0); err != nil {
+		t.Fatalf("Flush got unexpected error: %v", err)
+	}
+	if !written() {
+		t.Errorf("Flush did not write change other than IP after minimum interval")
+	}
+
+	// Unchanged state is never written.
+	if err := s.Flush(0); err != nil {
+		t.Fatalf("Flush got unexpected error: %v", err)
+	}
+	if written() {
+		t.Errorf("Flush wrote unchanged state")
+	}
+}
+
+func TestStoreSnapshotRedactsResponses(t *testing.T) {
+	addSecrets("snapshot-secret-token")
+	s := testStore(t, `{"hosts": {"a.example.com": {"ip": "203.0.113.7", "last_response": "good 203.0.113.7 (token snapshot-secret-token)", "last_response_headers": {"X-Token": "snapshot-secret-token"}}}}`)
+	b, err := s.snapshot()
+	if err != nil {
+		t.Fatalf("snapshot got unexpected error: %v", err)
+	}
+	if strings.Contains(string(b), "snapshot-secret-token") {
+		t.Errorf("snapshot contains credentials: %s", b)
+	}
+	if !strings.Contains(string(b), `"ip":"203.0.113.7"`) {
+		t.Errorf("snapshot does not contain published IP: %s", b)
+	}
+	// The in-memory state is not redacted.
+	if got := s.state.Hosts["a.example.com"].LastResponseHeaders["X-Token"]; got != "snapshot-secret-token" {
+		t.Errorf("After snapshot, state header = %q, want it unchanged", got)
+	}
+}
@@ -0,0 +1,74 @@
+package gdddc
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// statsdClient pushes metrics to a statsd (or DogStatsD) server over UDP.
+// Sending is best-effort; a nil *statsdClient discards all metrics.
+type statsdClient struct {
+	conn   net.Conn
+	prefix string
+	tags   string // DogStatsD tag suffix, including the leading "|#"
+}
+
+// newStatsdClient creates a statsd client sending to the given address. Every metric name is prefixed with
+// prefix (if nonempty) and tagged with the given DogStatsD-style tags (e.g. "env:prod").
+func newStatsdClient(addr, prefix string, tags []string) (*statsdClient, error) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("could not dial statsd: %v", err)
+	}
+	if prefix != "" && !strings.HasSuffix(prefix, ".") {
+		prefix += "."
+	}
+	var tagStr string
+	if len(tags) > 0 {
+		tagStr = "|#" + strings.Join(tags, ",")
+	}
+	return &statsdClient{conn: conn, prefix: prefix, tags: tagStr}, nil
+}
+
+// count increments the named counter by n.
+func (c *statsdClient) count(name string, n int) {
+	c.send(name, fmt.Sprintf("%d", n), "c")
+}
+
+// timing records a duration for the named timer.
+func (c *statsdClient) timing(name string, d time.Duration) {
+	c.send(name, fmt.Sprintf("%d", d/time.Millisecond), "ms")
+}
+
+// gauge sets the named gauge to v.
+func (c *statsdClient) gauge(name string, v float64) {
+	c.send(name, fmt.Sprintf("%g", v), "g")
+}
+
+// outcome increments the named success or failure counter depending on err, and records the named timer.
+func (c *statsdClient) outcome(name string, start time.Time, err error) {
+	c.timing(name+".latency", time.Since(start))
+	if err != nil {
+		c.count(name+".failure", 1)
+	} else {
+		c.count(name+".success", 1)
+	}
+}
+
+// close closes the client's connection.
+func (c *statsdClient) close() {
+	if c == nil {
+		return
+	}
+	c.conn.Close()
+}
+
+func (c *statsdClient) send(name, value, typ string) {
+	if c == nil {
+		return
+	}
+	// Errors are ignored: like statsd itself, metrics delivery is fire-and-forget.
+	fmt.Fprintf(c.conn, "%s%s:%s|%s%s", c.prefix, name, value, typ, c.tags)
+}
@@ -0,0 +1,160 @@
+package gdddc
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// STUN (RFC 5389) message types, attributes, & the magic cookie, which is also used to XOR mapped addresses.
+const (
+	stunBindingRequest   = 0x0001
+	stunBindingSuccess   = 0x0101
+	stunBindingError     = 0x0111
+	stunMappedAddress    = 0x0001
+	stunXORMappedAddress = 0x0020
+	stunMagicCookie      = 0x2112A442
+	stunHeaderLen        = 20
+)
+
+// stunRetransmits are the timeouts of each attempt of a STUN request: UDP may drop the request or response, so it is
+// retransmitted with doubling timeouts, per RFC 5389.
+var stunRetransmits = []time.Duration{500 * time.Millisecond, time.Second, 2 * time.Second}
+
+// stunIP returns the IP address of the given family from which the given STUN servers (host:port) see requests,
+// trying each server in turn until one answers.
+func stunIP(ctx context.Context, cfg *Config, servers []string, family Family) (string, error) {
+	var errs []string
+	for _, s := range servers {
+		ip, err := stunBinding(ctx, cfg, s, family)
+		if err == nil {
+			return ip, nil
+		}
+		if len(servers) > 1 {
+			warnf("Could not check %s IP with STUN server %s: %v", family, s, err)
+		}
+		errs = append(errs, fmt.Sprintf("%s: %v", s, err))
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	if len(errs) == 1 {
+		return "", fmt.Errorf("STUN server %s", errs[0])
+	}
+	return "", fmt.Errorf("all STUN servers failed (%s)", strings.Join(errs, "; "))
+}
+
+// stunBinding makes a STUN binding request to the given server over the given family, returning the mapped address.
+func stunBinding(ctx context.Context, cfg *Config, server string, family Family) (string, error) {
+	network := "udp4"
+	if family == IPv6 {
+		network = "udp6"
+	}
+	dialer := &net.Dialer{Resolver: cfg.resolver}
+	conn, err := dialer.DialContext(ctx, network, server)
+	if err != nil {
+		return "", fmt.Errorf("could not connect: %v", err)
+	}
+	defer conn.Close()
+
+	req := make([]byte, stunHeaderLen)
+	binary.BigEndian.PutUint16(req[0:], stunBindingRequest)
+	binary.BigEndian.PutUint32(req[4:], stunMagicCookie)
+	if _, err := rand.Read(req[8:20]); err != nil {
+		return "", fmt.Errorf("could not generate transaction ID: %v", err)
+	}
+	resp, err := udpRoundTrip(ctx, conn, req, stunRetransmits, func(resp []byte) bool {
+		return len(resp) >= stunHeaderLen && bytes.Equal(resp[4:20], req[4:20])
+	})
+	if err != nil {
+		return "", err
+	}
+	return parseSTUNResponse(resp, family)
+}
+
+// parseSTUNResponse returns the mapped address in the given response to a binding request.
+func parseSTUNResponse(resp []byte, family Family) (string, error) {
+	switch typ := binary.BigEndian.Uint16(resp[0:]); typ {
+	case stunBindingSuccess:
+	case stunBindingError:
+		return "", fmt.Errorf("server returned an error response")
+	default:
+		return "", fmt.Errorf("unexpected response type %#04x", typ)
+	}
+	attrs := resp[stunHeaderLen:]
+	if l := int(binary.BigEndian.Uint16(resp[2:])); l <= len(attrs) {
+		attrs = attrs[:l]
+	}
+	var mapped net.IP
+	for len(attrs) >= 4 {
+		typ, l := binary.BigEndian.Uint16(attrs[0:]), int(binary.BigEndian.Uint16(attrs[2:]))
+		if 4+l > len(attrs) {
+			return "", fmt.Errorf("truncated attribute %#04x", typ)
+		}
+		val := attrs[4 : 4+l]
+		switch typ {
+		case stunXORMappedAddress:
+			ip, err := stunAddress(val, resp[4:20])
+			if err != nil {
+				return "", err
+			}
+			return checkSTUNAddress(ip, family)
+		case stunMappedAddress:
+			ip, err := stunAddress(val, nil)
+			if err != nil {
+				return "", err
+			}
+			mapped = ip
+		}
+		next := 4 + (l+3)&^3 // attributes are padded to a multiple of 4 bytes
+		if next > len(attrs) {
+			next = len(attrs)
+		}
+		attrs = attrs[next:]
+	}
+	if mapped == nil {
+		return "", fmt.Errorf("response contains no mapped address")
+	}
+	return checkSTUNAddress(mapped, family)
+}
+
+// stunAddress parses the value of a (XOR-)MAPPED-ADDRESS attribute. If xor is non-nil, it holds the magic cookie &
+// transaction ID with which the address is XORed.
+func stunAddress(val, xor []byte) (net.IP, error) {
+	if len(val) < 4 {
+		return nil, fmt.Errorf("truncated mapped address")
+	}
+	var n int
+	switch val[1] {
+	case 0x01:
+		n = net.IPv4len
+	case 0x02:
+		n = net.IPv6len
+	default:
+		return nil, fmt.Errorf("unknown address family %#02x", val[1])
+	}
+	if len(val) < 4+n {
+		return nil, fmt.Errorf("truncated mapped address")
+	}
+	ip := make(net.IP, n)
+	copy(ip, val[4:])
+	for i := range ip {
+		if xor != nil {
+			ip[i] ^= xor[i]
+		}
+	}
+	return ip, nil
+}
+
+// checkSTUNAddress returns the given mapped address, if it is of the given family.
+func checkSTUNAddress(ip net.IP, family Family) (string, error) {
+	if (ip.To4() != nil) != (family == IPv4) {
+		return "", fmt.Errorf("mapped address %v is not an %s address", ip, family)
+	}
+	return ip.String(), nil
+}
@@ -0,0 +1,87 @@
+package gdddc
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// systemdListenFDsStart is the first file descriptor passed by systemd socket activation.
+const systemdListenFDsStart = 3
+
+// sdNotify sends the given state (e.g. "READY=1") to systemd's notification socket, if the daemon is run as a
+// Type=notify service. Failures are logged, as the daemon runs regardless.
+func sdNotify(state string) {
+	addr := os.Getenv("NOTIFY_SOCKET")
+	if addr == "" {
+		return
+	}
+	if strings.HasPrefix(addr, "@") {
+		addr = "\x00" + addr[1:] // abstract socket
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: addr, Net: "unixgram"})
+	if err != nil {
+		warnf("Could not notify systemd of %q: %v", state, err)
+		return
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(state)); err != nil {
+		warnf("Could not notify systemd of %q: %v", state, err)
+	}
+}
+
+// sdWatchdogInterval returns how often systemd's watchdog must be notified (half its timeout), or 0 if the watchdog
+// is not enabled for this process.
+func sdWatchdogInterval() time.Duration {
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond / 2
+}
+
+// sdListener returns the listening socket passed by systemd socket activation. If several are passed, the one named
+// "admin" (by the socket unit's FileDescriptorName) is used, or else the first.
+func sdListener() (net.Listener, error) {
+	if os.Getenv("LISTEN_PID") != strconv.Itoa(os.Getpid()) {
+		return nil, fmt.Errorf("no socket passed by systemd")
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n < 1 {
+		return nil, fmt.Errorf("no socket passed by systemd")
+	}
+	i := 0
+	for j, name := range strings.Split(os.Getenv("LISTEN_FDNAMES"), ":") {
+		if name == "admin" && j < n {
+			i = j
+		}
+	}
+	f := os.NewFile(uintptr(systemdListenFDsStart+i), "systemd-socket")
+	defer f.Close()
+	l, err := net.FileListener(f)
+	if err != nil {
+		return nil, fmt.Errorf("could not use socket passed by systemd: %v", err)
+	}
+	return l, nil
+}
+
+// systemdCredential returns the path of the named credential passed by systemd (LoadCredential= or SetCredential=),
+// or "" if there is no such credential.
+func systemdCredential(name string) string {
+	dir := os.Getenv("CREDENTIALS_DIRECTORY")
+	if dir == "" {
+		return ""
+	}
+	path := filepath.Join(dir, name)
+	if _, err := os.Stat(path); err != nil {
+		return ""
+	}
+	return path
+}
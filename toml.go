@@ -0,0 +1,354 @@
+package gdddc
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// parseTOML parses a TOML document into maps, slices, strings, numbers, & bools, as encoding/json would decode the
+// equivalent JSON. It supports the subset of TOML useful for configs: tables, arrays of tables, dotted keys, basic &
+// literal strings, integers, floats, bools, arrays, & inline tables. Multi-line strings & dates are not supported.
+func parseTOML(data string) (map[string]interface{}, error) {
+	p := &tomlParser{s: data, line: 1, defined: map[uintptr]bool{}}
+	root := map[string]interface{}{}
+	table := root
+	for {
+		p.skipSpaceAndComments(true)
+		if p.done() {
+			return root, nil
+		}
+		var err error
+		switch {
+		case strings.HasPrefix(p.s[p.pos:], "[["):
+			p.pos += 2
+			table, err = p.tableHeader(root, "]]", true)
+		case p.s[p.pos] == '[':
+			p.pos++
+			table, err = p.tableHeader(root, "]", false)
+		default:
+			err = p.keyValue(table)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", p.line, err)
+		}
+		p.skipSpaceAndComments(false)
+		if !p.done() && p.s[p.pos] != '\n' && p.s[p.pos] != '\r' {
+			return nil, fmt.Errorf("line %d: unexpected %q after value", p.line, p.s[p.pos])
+		}
+	}
+}
+
+// tomlParser holds the position of a parse of a TOML document.
+type tomlParser struct {
+	s    string
+	pos  int
+	line int
+	// defined holds (the map pointers of) the tables defined by [table] headers, which may not be defined again.
+	defined map[uintptr]bool
+}
+
+func (p *tomlParser) done() bool { return p.pos >= len(p.s) }
+
+// skipSpaceAndComments skips spaces, tabs, & comments, and also newlines if newlines is set.
+func (p *tomlParser) skipSpaceAndComments(newlines bool) {
+	for !p.done() {
+		switch c := p.s[p.pos]; {
+		case c == ' ' || c == '\t' || c == '\r':
+			p.pos++
+		case c == '\n' && newlines:
+			p.pos++
+			p.line++
+		case c == '#':
+			for !p.done() && p.s[p.pos] != '\n' {
+				p.pos++
+			}
+		default:
+			return
+		}
+	}
+}
+
+// tableHeader parses the key of a [table] or [[array of tables]] header (up to its closing delimiter) and returns the
+// table it starts.
+func (p *tomlParser) tableHeader(root map[string]interface{}, end string, array bool) (map[string]interface{}, error) {
+	keys, err := p.key()
+	if err != nil {
+		return nil, err
+	}
+	p.skipSpaceAndComments(false)
+	if !strings.HasPrefix(p.s[p.pos:], end) {
+		return nil, fmt.Errorf("expected %q after table name", end)
+	}
+	p.pos += len(end)
+	parent, err := subtable(root, keys[:len(keys)-1])
+	if err != nil {
+		return nil, err
+	}
+	last := keys[len(keys)-1]
+	if array {
+		tables, ok := parent[last].([]interface{})
+		if _, exists := parent[last]; exists && !ok {
+			return nil, fmt.Errorf("%q is not an array of tables", last)
+		}
+		t := map[string]interface{}{}
+		parent[last] = append(tables, t)
+		return t, nil
+	}
+	t, err := subtable(parent, []string{last})
+	if err != nil {
+		return nil, err
+	}
+	ptr := reflect.ValueOf(t).Pointer()
+	if p.defined[ptr] {
+		return nil, fmt.Errorf("table %q is defined more than once", strings.Join(keys, "."))
+	}
+	p.defined[ptr] = true
+	return t, nil
+}
+
+// subtable returns the table at the given keys under t, creating tables as needed. A key naming an array of tables
+// refers to its last table.
+func subtable(t map[string]interface{}, keys []string) (map[string]interface{}, error) {
+	for _, k := range keys {
+		switch v := t[k].(type) {
+		case nil:
+			sub := map[string]interface{}{}
+			t[k], t = sub, sub
+		case map[string]interface{}:
+			t = v
+		case []interface{}:
+			var last map[string]interface{}
+			if len(v) > 0 {
+				last, _ = v[len(v)-1].(map[string]interface{})
+			}
+			if last == nil {
+				return nil, fmt.Errorf("%q is not a table", k)
+			}
+			t = last
+		default:
+			return nil, fmt.Errorf("%q is not a table", k)
+		}
+	}
+	return t, nil
+}
+
+// keyValue parses a key/value pair into the given table.
+func (p *tomlParser) keyValue(t map[string]interface{}) error {
+	keys, err := p.key()
+	if err != nil {
+		return err
+	}
+	p.skipSpaceAndComments(false)
+	if p.done() || p.s[p.pos] != '=' {
+		return fmt.Errorf("expected '=' after key")
+	}
+	p.pos++
+	p.skipSpaceAndComments(false)
+	v, err := p.value()
+	if err != nil {
+		return err
+	}
+	if t, err = subtable(t, keys[:len(keys)-1]); err != nil {
+		return err
+	}
+	last := keys[len(keys)-1]
+	if _, exists := t[last]; exists {
+		return fmt.Errorf("key %q is defined more than once", last)
+	}
+	t[last] = v
+	return nil
+}
+
+// key parses a (possibly dotted) key, returning its parts.
+func (p *tomlParser) key() ([]string, error) {
+	var keys []string
+	for {
+		p.skipSpaceAndComments(false)
+		if p.done() {
+			return nil, fmt.Errorf("expected key")
+		}
+		var k string
+		switch p.s[p.pos] {
+		case '"', '\'':
+			var err error
+			if k, err = p.str(); err != nil {
+				return nil, err
+			}
+		default:
+			start := p.pos
+			for !p.done() && isBareKeyChar(p.s[p.pos]) {
+				p.pos++
+			}
+			if k = p.s[start:p.pos]; k == "" {
+				return nil, fmt.Errorf("expected key")
+			}
+		}
+		keys = append(keys, k)
+		p.skipSpaceAndComments(false)
+		if p.done() || p.s[p.pos] != '.' {
+			return keys, nil
+		}
+		p.pos++
+	}
+}
+
+func isBareKeyChar(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '-'
+}
+
+// value parses a value: a string, number, bool, array, or inline table.
+func (p *tomlParser) value() (interface{}, error) {
+	if p.done() {
+		return nil, fmt.Errorf("expected value")
+	}
+	switch p.s[p.pos] {
+	case '"', '\'':
+		if strings.HasPrefix(p.s[p.pos:], `"""`) || strings.HasPrefix(p.s[p.pos:], "'''") {
+			return nil, fmt.Errorf("multi-line strings are not supported")
+		}
+		return p.str()
+	case '[':
+		return p.array()
+	case '{':
+		return p.inlineTable()
+	}
+	start := p.pos
+	for !p.done() && strings.IndexByte(" \t\r\n#,]}", p.s[p.pos]) < 0 {
+		p.pos++
+	}
+	tok := p.s[start:p.pos]
+	switch tok {
+	case "true":
+		return true, nil
+	case "false":
+		return false, nil
+	}
+	num := strings.Replace(tok, "_", "", -1)
+	if d := strings.TrimLeft(num, "+-"); len(d) > 1 && d[0] == '0' && d[1] >= '0' && d[1] <= '9' {
+		return nil, fmt.Errorf("invalid value %q (leading zeros are not allowed)", tok)
+	}
+	if i, err := strconv.ParseInt(num, 0, 64); err == nil {
+		return i, nil
+	}
+	if strings.Trim(num, "0123456789.eE+-") == "" {
+		if f, err := strconv.ParseFloat(num, 64); err == nil {
+			return f, nil
+		}
+	}
+	return nil, fmt.Errorf("invalid value %q", tok)
+}
+
+// str parses a basic ("...") or literal ('...') string.
+func (p *tomlParser) str() (string, error) {
+	quote := p.s[p.pos]
+	p.pos++
+	var b strings.Builder
+	for {
+		if p.done() || p.s[p.pos] == '\n' {
+			return "", fmt.Errorf("unterminated string")
+		}
+		c := p.s[p.pos]
+		p.pos++
+		switch {
+		case c == quote:
+			return b.String(), nil
+		case c == '\\' && quote == '"':
+			if p.done() {
+				return "", fmt.Errorf("unterminated string")
+			}
+			e := p.s[p.pos]
+			p.pos++
+			switch e {
+			case 'b':
+				b.WriteByte('\b')
+			case 't':
+				b.WriteByte('\t')
+			case 'n':
+				b.WriteByte('\n')
+			case 'f':
+				b.WriteByte('\f')
+			case 'r':
+				b.WriteByte('\r')
+			case '"', '\\':
+				b.WriteByte(e)
+			case 'u', 'U':
+				n := 4
+				if e == 'U' {
+					n = 8
+				}
+				if p.pos+n > len(p.s) {
+					return "", fmt.Errorf("invalid escape in string")
+				}
+				r, err := strconv.ParseUint(p.s[p.pos:p.pos+n], 16, 32)
+				if err != nil || !utf8.ValidRune(rune(r)) {
+					return "", fmt.Errorf("invalid escape in string")
+				}
+				b.WriteRune(rune(r))
+				p.pos += n
+			default:
+				return "", fmt.Errorf("invalid escape \\%c in string", e)
+			}
+		default:
+			b.WriteByte(c)
+		}
+	}
+}
+
+// array parses an array, which may span lines.
+func (p *tomlParser) array() ([]interface{}, error) {
+	p.pos++ // [
+	arr := []interface{}{}
+	for {
+		p.skipSpaceAndComments(true)
+		if p.done() {
+			return nil, fmt.Errorf("unterminated array")
+		}
+		if p.s[p.pos] == ']' {
+			p.pos++
+			return arr, nil
+		}
+		v, err := p.value()
+		if err != nil {
+			return nil, err
+		}
+		arr = append(arr, v)
+		p.skipSpaceAndComments(true)
+		if !p.done() && p.s[p.pos] == ',' {
+			p.pos++
+		} else if p.done() || p.s[p.pos] != ']' {
+			return nil, fmt.Errorf("expected ',' or ']' in array")
+		}
+	}
+}
+
+// inlineTable parses an inline table ({ key = value, ... }).
+func (p *tomlParser) inlineTable() (map[string]interface{}, error) {
+	p.pos++ // {
+	t := map[string]interface{}{}
+	p.skipSpaceAndComments(false)
+	if !p.done() && p.s[p.pos] == '}' {
+		p.pos++
+		return t, nil
+	}
+	for {
+		if err := p.keyValue(t); err != nil {
+			return nil, err
+		}
+		p.skipSpaceAndComments(false)
+		if p.done() {
+			return nil, fmt.Errorf("unterminated inline table")
+		}
+		switch p.s[p.pos] {
+		case ',':
+			p.pos++
+		case '}':
+			p.pos++
+			return t, nil
+		default:
+			return nil, fmt.Errorf("expected ',' or '}' in inline table")
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package gdddc
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseTOML(t *testing.T) {
+	for _, test := range []struct {
+		desc, toml string
+		want       map[string]interface{}
+	}{
+		{"empty", "", obj{}},
+		{"scalars",
+			"s = \"text\"\ni = 42\nneg = -7\nunder = 1_000\nhex = 0x10\nf = 1.5\nexp = 1e3\nt = true\nf2 = false\n",
+			obj{"s": "text", "i": int64(42), "neg": int64(-7), "under": int64(1000), "hex": int64(16), "f": 1.5, "exp": 1000.0, "t": true, "f2": false}},
+		{"quoting",
+			`basic = "tab\there \"q\" \u00e9"` + "\n" + `literal = 'C:\path'` + "\n" + `"quoted key" = 1` + "\n" + `hash = "# not a comment"` + "\n",
+			obj{"basic": "tab\there \"q\" é", "literal": `C:\path`, "quoted key": int64(1), "hash": "# not a comment"}},
+		{"comments",
+			"# leading comment\na = 1 # trailing comment\n\n  # indented comment\nb = 2\n",
+			obj{"a": int64(1), "b": int64(2)}},
+		{"arrays",
+			"hostname = [\"a.example.com\", \"b.example.com\"]\nmultiline = [\n  1, # comment\n  2,\n]\nempty = []\nnested = [[1], [\"x\"]]\n",
+			obj{"hostname": arr{"a.example.com", "b.example.com"}, "multiline": arr{int64(1), int64(2)}, "empty": arr{}, "nested": arr{arr{int64(1)}, arr{"x"}}}},
+		{"tables",
+			"top = 1\n[http]\ntimeout_s = 10\n[http.tls]\nmin = \"1.2\"\n[other]\nx = true\n",
+			obj{"top": int64(1), "http": obj{"timeout_s": int64(10), "tls": obj{"min": "1.2"}}, "other": obj{"x": true}}},
+		{"dotted keys", "http.timeout_s = 10\nhttp.proxy_url = \"http://proxy:3128\"\n",
+			obj{"http": obj{"timeout_s": int64(10), "proxy_url": "http://proxy:3128"}}},
+		{"arrays of tables",
+			"[[hosts]]\nhostname = \"a.example.com\"\n[[hosts]]\nhostname = \"b.example.com\"\n[hosts.retry_policy]\nmax_attempts = 5\n",
+			obj{"hosts": arr{obj{"hostname": "a.example.com"}, obj{"hostname": "b.example.com", "retry_policy": obj{"max_attempts": int64(5)}}}}},
+		{"inline tables", "change_window = { start = \"02:00\", end = \"04:00\", update_freq_s = 10 }\n",
+			obj{"change_window": obj{"start": "02:00", "end": "04:00", "update_freq_s": int64(10)}}},
+		{"CRLF line endings", "a = 1\r\nb = 2\r\n", obj{"a": int64(1), "b": int64(2)}},
+	} {
+		got, err := parseTOML(test.toml)
+		if err != nil {
+			t.Errorf("[%s] parseTOML got unexpected error: %v", test.desc, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("[%s] parseTOML = %#v, want %#v", test.desc, got, test.want)
+		}
+	}
+}
+
+func TestParseTOMLErrors(t *testing.T) {
+	for _, test := range []struct {
+		desc, toml, wantErr string
+	}{
+		{"missing value", "a =\n", "line 1:"},
+		{"missing equals", "a 1\n", "line 1:"},
+		{"duplicate key", "a = 1\na = 2\n", "line 2:"},
+		{"duplicate table", "[t]\na = 1\n[t]\nb = 2\n", "line 3:"},
+		{"leading zeros", "a = 007\n", "leading zeros are not allowed"},
+		{"invalid value", "a = yes\n", `invalid value "yes"`},
+		{"multi-line string", "a = \"\"\"\ntext\"\"\"\n", "multi-line strings are not supported"},
+		{"unterminated string", "a = \"open\n", "line 1:"},
+		{"text after value", "a = 1 2\n", "line 1: unexpected"},
+		{"unterminated array", "a = [1, 2\n", "line 2:"},
+	} {
+		_, err := parseTOML(test.toml)
+		if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+			t.Errorf("[%s] parseTOML got error %v, want error containing %q", test.desc, err, test.wantErr)
+		}
+	}
+}
@@ -0,0 +1,167 @@
+package gdddc
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// upnpClient makes UPnP requests, which go to the router on the local network & so never use a proxy.
+var upnpClient = &http.Client{Timeout: 10 * time.Second, Transport: &http.Transport{}}
+
+// igdService is the WAN connection service of an Internet Gateway Device (i.e. a UPnP router).
+type igdService struct {
+	serviceType string
+	controlURL  string
+}
+
+// discoverIGD finds the router's WAN connection service by SSDP multicast & the router's device description.
+func discoverIGD(ctx context.Context) (igdService, error) {
+	conn, err := net.ListenPacket("udp4", ":0")
+	if err != nil {
+		return igdService{}, fmt.Errorf("could not listen: %v", err)
+	}
+	defer conn.Close()
+	const st = "urn:schemas-upnp-org:device:InternetGatewayDevice:1"
+	req := "M-SEARCH * HTTP/1.1\r\nHOST: 239.255.255.250:1900\r\nMAN: \"ssdp:discover\"\r\nMX: 1\r\nST: " + st + "\r\n\r\n"
+	if _, err := conn.WriteTo([]byte(req), &net.UDPAddr{IP: net.IPv4(239, 255, 255, 250), Port: 1900}); err != nil {
+		return igdService{}, fmt.Errorf("could not send SSDP search: %v", err)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	conn.SetDeadline(deadline)
+
+	// Every UPnP device that answers is tried, in case the first is not a router with a WAN connection.
+	errs := []string{}
+	buf := make([]byte, 2048)
+	seen := map[string]bool{}
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			break
+		}
+		resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(buf[:n])), nil)
+		if err != nil {
+			continue
+		}
+		loc := resp.Header.Get("Location")
+		if loc == "" || seen[loc] {
+			continue
+		}
+		seen[loc] = true
+		svc, err := igdServiceAt(ctx, loc)
+		if err == nil {
+			return svc, nil
+		}
+		errs = append(errs, fmt.Sprintf("%s: %v", loc, err))
+	}
+	if len(errs) == 0 {
+		return igdService{}, fmt.Errorf("no UPnP router answered")
+	}
+	return igdService{}, fmt.Errorf("no UPnP router with a WAN connection found (%s)", strings.Join(errs, "; "))
+}
+
+// upnpDevice is a device (& its embedded devices) of a UPnP device description.
+type upnpDevice struct {
+	Services []struct {
+		ServiceType string `xml:"serviceType"`
+		ControlURL  string `xml:"controlURL"`
+	} `xml:"serviceList>service"`
+	Devices []upnpDevice `xml:"deviceList>device"`
+}
+
+// igdServiceAt returns the WAN connection service described by the device description at the given URL.
+func igdServiceAt(ctx context.Context, location string) (igdService, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", location, nil)
+	if err != nil {
+		return igdService{}, fmt.Errorf("could not create request: %v", err)
+	}
+	resp, err := upnpClient.Do(req)
+	if err != nil {
+		return igdService{}, fmt.Errorf("could not get device description: %v", err)
+	}
+	defer resp.Body.Close()
+	var desc struct {
+		URLBase string     `xml:"URLBase"`
+		Device  upnpDevice `xml:"device"`
+	}
+	if err := xml.NewDecoder(resp.Body).Decode(&desc); err != nil {
+		return igdService{}, fmt.Errorf("could not parse device description: %v", err)
+	}
+	base, err := url.Parse(location)
+	if desc.URLBase != "" {
+		base, err = url.Parse(desc.URLBase)
+	}
+	if err != nil {
+		return igdService{}, fmt.Errorf("could not parse base URL: %v", err)
+	}
+
+	devices := []upnpDevice{desc.Device}
+	for len(devices) > 0 {
+		dev := devices[0]
+		devices = append(devices[1:], dev.Devices...)
+		for _, s := range dev.Services {
+			if !strings.HasPrefix(s.ServiceType, "urn:schemas-upnp-org:service:WANIPConnection:") && !strings.HasPrefix(s.ServiceType, "urn:schemas-upnp-org:service:WANPPPConnection:") {
+				continue
+			}
+			u, err := base.Parse(strings.TrimSpace(s.ControlURL))
+			if err != nil {
+				return igdService{}, fmt.Errorf("could not parse control URL: %v", err)
+			}
+			return igdService{serviceType: s.ServiceType, controlURL: u.String()}, nil
+		}
+	}
+	return igdService{}, fmt.Errorf("device has no WAN connection service")
+}
+
+// externalIP asks the service for the router's external IP address (with the GetExternalIPAddress action).
+func (s igdService) externalIP(ctx context.Context) (string, error) {
+	body := `<?xml version="1.0"?>` +
+		`<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/">` +
+		`<s:Body><u:GetExternalIPAddress xmlns:u="` + s.serviceType + `"/></s:Body></s:Envelope>`
+	req, err := http.NewRequestWithContext(ctx, "POST", s.controlURL, strings.NewReader(body))
+	if err != nil {
+		return "", fmt.Errorf("could not create request: %v", err)
+	}
+	req.Header.Set("Content-Type", `text/xml; charset="utf-8"`)
+	req.Header.Set("SOAPAction", `"`+s.serviceType+`#GetExternalIPAddress"`)
+	resp, err := upnpClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("could not make request: %v", err)
+	}
+	defer resp.Body.Close()
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", fmt.Errorf("could not read response: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("GetExternalIPAddress failed (%v)", resp.Status)
+	}
+	dec := xml.NewDecoder(bytes.NewReader(respBody))
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			return "", fmt.Errorf("response contains no NewExternalIPAddress")
+		}
+		if se, ok := tok.(xml.StartElement); ok && se.Name.Local == "NewExternalIPAddress" {
+			var ip string
+			if err := dec.DecodeElement(&ip, &se); err != nil {
+				return "", fmt.Errorf("could not parse response: %v", err)
+			}
+			if parsed := net.ParseIP(strings.TrimSpace(ip)); parsed != nil && parsed.To4() != nil {
+				return parsed.String(), nil
+			}
+			return "", fmt.Errorf("router reported invalid external address %q", ip)
+		}
+	}
+}
@@ -0,0 +1,377 @@
+package gdddc
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// parseYAML parses a YAML document into maps, slices, strings, numbers, bools, & nils, as encoding/json would decode
+// the equivalent JSON. It supports the subset of YAML useful for configs: block mappings & sequences, single-line flow
+// sequences & mappings, plain & quoted scalars, & comments. Anchors, tags, block scalars, & multiple documents are
+// not supported.
+func parseYAML(data string) (interface{}, error) {
+	var lines []yamlLine
+	for i, l := range strings.Split(data, "\n") {
+		text := strings.TrimRight(stripYAMLComment(strings.TrimRight(l, "\r")), " \t")
+		content := strings.TrimLeft(text, " ")
+		if content == "" || len(lines) == 0 && content == "---" {
+			continue
+		}
+		if strings.HasPrefix(content, "\t") {
+			return nil, fmt.Errorf("line %d: tabs may not be used for indentation", i+1)
+		}
+		if content == "..." || content == "---" {
+			return nil, fmt.Errorf("line %d: multiple documents are not supported", i+1)
+		}
+		lines = append(lines, yamlLine{num: i + 1, indent: len(text) - len(content), text: content})
+	}
+	if len(lines) == 0 {
+		return nil, nil
+	}
+	p := &yamlParser{lines: lines}
+	v, err := p.node(lines[0].indent)
+	if err != nil {
+		return nil, err
+	}
+	if p.i < len(lines) {
+		return nil, fmt.Errorf("line %d: unexpected indentation", lines[p.i].num)
+	}
+	return v, nil
+}
+
+// yamlLine is a non-empty line of a YAML document, without its comment & indentation.
+type yamlLine struct {
+	num    int
+	indent int
+	text   string
+}
+
+// yamlParser holds the position (in lines) of a parse of a YAML document.
+type yamlParser struct {
+	lines []yamlLine
+	i     int
+}
+
+// node parses the block node starting at the current line, which has the given indentation.
+func (p *yamlParser) node(indent int) (interface{}, error) {
+	if l := p.lines[p.i]; isYAMLSeqItem(l.text) {
+		return p.sequence(indent)
+	} else if _, _, ok := splitYAMLKey(l.text); !ok {
+		p.i++
+		v, err := parseYAMLFlow(l.text)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", l.num, err)
+		}
+		return v, nil
+	}
+	return p.mapping(indent)
+}
+
+// sequence parses a block sequence, whose items ("- ...") have the given indentation.
+func (p *yamlParser) sequence(indent int) ([]interface{}, error) {
+	seq := []interface{}{}
+	for p.i < len(p.lines) && p.lines[p.i].indent == indent && isYAMLSeqItem(p.lines[p.i].text) {
+		l := p.lines[p.i]
+		rest := strings.TrimLeft(l.text[1:], " ")
+		if rest == "" {
+			// The item is the block node on the following lines.
+			p.i++
+			v, err := p.child(indent, false)
+			if err != nil {
+				return nil, err
+			}
+			seq = append(seq, v)
+			continue
+		}
+		// The item starts on this line; treat its content as a line of its own, indented to where it starts.
+		p.lines[p.i] = yamlLine{num: l.num, indent: l.indent + len(l.text) - len(rest), text: rest}
+		v, err := p.node(p.lines[p.i].indent)
+		if err != nil {
+			return nil, err
+		}
+		seq = append(seq, v)
+	}
+	return seq, nil
+}
+
+// mapping parses a block mapping, whose keys have the given indentation.
+func (p *yamlParser) mapping(indent int) (map[string]interface{}, error) {
+	m := map[string]interface{}{}
+	for p.i < len(p.lines) && p.lines[p.i].indent == indent && !isYAMLSeqItem(p.lines[p.i].text) {
+		l := p.lines[p.i]
+		k, rest, ok := splitYAMLKey(l.text)
+		if !ok {
+			return nil, fmt.Errorf("line %d: expected \"key: value\"", l.num)
+		}
+		key, err := parseYAMLScalar(k)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", l.num, err)
+		}
+		ks := fmt.Sprint(key)
+		if _, exists := m[ks]; exists {
+			return nil, fmt.Errorf("line %d: key %q is defined more than once", l.num, ks)
+		}
+		p.i++
+		var v interface{}
+		if rest == "" {
+			// A sequence may be indented by as much as its parent's key.
+			if v, err = p.child(indent, true); err != nil {
+				return nil, err
+			}
+		} else if v, err = parseYAMLFlow(rest); err != nil {
+			return nil, fmt.Errorf("line %d: %v", l.num, err)
+		}
+		m[ks] = v
+	}
+	return m, nil
+}
+
+// child parses the block node nested under a line with the given indentation, or returns nil if there is none. If
+// seqAtIndent is set, the node may be a sequence at the same indentation.
+func (p *yamlParser) child(indent int, seqAtIndent bool) (interface{}, error) {
+	if p.i >= len(p.lines) {
+		return nil, nil
+	}
+	l := p.lines[p.i]
+	if l.indent > indent || l.indent == indent && seqAtIndent && isYAMLSeqItem(l.text) {
+		return p.node(l.indent)
+	}
+	return nil, nil
+}
+
+func isYAMLSeqItem(text string) bool {
+	return text == "-" || strings.HasPrefix(text, "- ")
+}
+
+// stripYAMLComment removes the comment, if any, from a line.
+func stripYAMLComment(line string) string {
+	var quote byte
+	for i := 0; i < len(line); i++ {
+		switch c := line[i]; {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			} else if c == '\\' && quote == '"' {
+				i++
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '#' && (i == 0 || line[i-1] == ' ' || line[i-1] == '\t'):
+			return line[:i]
+		}
+	}
+	return line
+}
+
+// splitYAMLKey splits a "key: value" line into its key & value (which may be empty). It reports false if the line
+// is not a mapping entry.
+func splitYAMLKey(text string) (key, value string, ok bool) {
+	if text == "" || strings.IndexByte("[{", text[0]) >= 0 {
+		return "", "", false
+	}
+	i := 0
+	if text[0] == '"' || text[0] == '\'' {
+		if _, n, err := yamlQuoted(text); err == nil {
+			i = n
+		}
+	}
+	for ; i < len(text); i++ {
+		if text[i] == ':' && (i+1 == len(text) || text[i+1] == ' ') {
+			return strings.TrimSpace(text[:i]), strings.TrimSpace(text[i+1:]), true
+		}
+	}
+	return "", "", false
+}
+
+// parseYAMLFlow parses a value given on a single line: a scalar, or a flow sequence ([...]) or mapping ({...}).
+func parseYAMLFlow(text string) (interface{}, error) {
+	if text == "" || strings.IndexByte("[{", text[0]) < 0 {
+		return parseYAMLScalar(text)
+	}
+	f := &yamlFlowParser{s: text}
+	v, err := f.value()
+	if err != nil {
+		return nil, err
+	}
+	if f.skipSpace(); f.pos < len(f.s) {
+		return nil, fmt.Errorf("unexpected %q after value", f.s[f.pos:])
+	}
+	return v, nil
+}
+
+// parseYAMLScalar parses a quoted or plain scalar. Plain scalars are resolved as YAML's core schema does: null, bools,
+// integers, & floats are recognized, and anything else is a string.
+func parseYAMLScalar(text string) (interface{}, error) {
+	if text == "" {
+		return nil, nil
+	}
+	switch text[0] {
+	case '"', '\'':
+		s, n, err := yamlQuoted(text)
+		if err != nil {
+			return nil, err
+		}
+		if strings.TrimSpace(text[n:]) != "" {
+			return nil, fmt.Errorf("unexpected %q after string", text[n:])
+		}
+		return s, nil
+	case '&', '*', '!', '|', '>', '@', '`':
+		return nil, fmt.Errorf("%q is not supported", text[:1])
+	}
+	switch text {
+	case "~", "null", "Null", "NULL":
+		return nil, nil
+	case "true", "True", "TRUE":
+		return true, nil
+	case "false", "False", "FALSE":
+		return false, nil
+	}
+	if i, err := strconv.ParseInt(text, 10, 64); err == nil {
+		return i, nil
+	}
+	if strings.Trim(text, "0123456789.eE+-") == "" && strings.ContainsAny(text, "0123456789") {
+		if f, err := strconv.ParseFloat(text, 64); err == nil {
+			return f, nil
+		}
+	}
+	return text, nil
+}
+
+// yamlQuoted parses the single- or double-quoted string at the start of text, returning it & its length in text.
+func yamlQuoted(text string) (string, int, error) {
+	quote := text[0]
+	var b strings.Builder
+	for i := 1; i < len(text); i++ {
+		c := text[i]
+		switch {
+		case c == quote && quote == '\'' && i+1 < len(text) && text[i+1] == '\'':
+			b.WriteByte('\'')
+			i++
+		case c == quote:
+			return b.String(), i + 1, nil
+		case c == '\\' && quote == '"':
+			if i+1 == len(text) {
+				return "", 0, fmt.Errorf("unterminated string")
+			}
+			i++
+			switch e := text[i]; e {
+			case '0':
+				b.WriteByte(0)
+			case 't':
+				b.WriteByte('\t')
+			case 'n':
+				b.WriteByte('\n')
+			case 'r':
+				b.WriteByte('\r')
+			case '"', '\\', '/', ' ':
+				b.WriteByte(e)
+			case 'x', 'u', 'U':
+				n := map[byte]int{'x': 2, 'u': 4, 'U': 8}[e]
+				if i+n >= len(text) {
+					return "", 0, fmt.Errorf("invalid escape in string")
+				}
+				r, err := strconv.ParseUint(text[i+1:i+1+n], 16, 32)
+				if err != nil {
+					return "", 0, fmt.Errorf("invalid escape in string")
+				}
+				b.WriteRune(rune(r))
+				i += n
+			default:
+				return "", 0, fmt.Errorf("invalid escape \\%c in string", e)
+			}
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return "", 0, fmt.Errorf("unterminated string")
+}
+
+// yamlFlowParser holds the position of a parse of a single-line flow collection.
+type yamlFlowParser struct {
+	s   string
+	pos int
+}
+
+func (f *yamlFlowParser) skipSpace() {
+	for f.pos < len(f.s) && f.s[f.pos] == ' ' {
+		f.pos++
+	}
+}
+
+// value parses a flow collection or a scalar within one.
+func (f *yamlFlowParser) value() (interface{}, error) {
+	f.skipSpace()
+	if f.pos == len(f.s) {
+		return nil, fmt.Errorf("unterminated flow collection (flow collections must be on one line)")
+	}
+	switch f.s[f.pos] {
+	case '[':
+		f.pos++
+		seq := []interface{}{}
+		for {
+			if f.skipSpace(); f.pos < len(f.s) && f.s[f.pos] == ']' {
+				f.pos++
+				return seq, nil
+			}
+			v, err := f.value()
+			if err != nil {
+				return nil, err
+			}
+			seq = append(seq, v)
+			if err := f.separator(']'); err != nil {
+				return nil, err
+			}
+		}
+	case '{':
+		f.pos++
+		m := map[string]interface{}{}
+		for {
+			if f.skipSpace(); f.pos < len(f.s) && f.s[f.pos] == '}' {
+				f.pos++
+				return m, nil
+			}
+			k, err := f.value()
+			if err != nil {
+				return nil, err
+			}
+			if f.skipSpace(); f.pos == len(f.s) || f.s[f.pos] != ':' {
+				return nil, fmt.Errorf("expected ':' in flow mapping")
+			}
+			f.pos++
+			v, err := f.value()
+			if err != nil {
+				return nil, err
+			}
+			m[fmt.Sprint(k)] = v
+			if err := f.separator('}'); err != nil {
+				return nil, err
+			}
+		}
+	case '"', '\'':
+		s, n, err := yamlQuoted(f.s[f.pos:])
+		if err != nil {
+			return nil, err
+		}
+		f.pos += n
+		return s, nil
+	}
+	start := f.pos
+	for f.pos < len(f.s) && strings.IndexByte(",]}", f.s[f.pos]) < 0 && !(f.s[f.pos] == ':' && (f.pos+1 == len(f.s) || f.s[f.pos+1] == ' ')) {
+		f.pos++
+	}
+	return parseYAMLScalar(strings.TrimSpace(f.s[start:f.pos]))
+}
+
+// separator consumes the ',' between items of a flow collection, leaving its closing delimiter.
+func (f *yamlFlowParser) separator(end byte) error {
+	f.skipSpace()
+	switch {
+	case f.pos < len(f.s) && f.s[f.pos] == ',':
+		f.pos++
+		return nil
+	case f.pos < len(f.s) && f.s[f.pos] == end:
+		return nil
+	}
+	return fmt.Errorf("expected ',' or %q in flow collection", end)
+}
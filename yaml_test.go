@@ -0,0 +1,80 @@
+package gdddc
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// obj is shorthand for a parsed mapping or table.
+type obj = map[string]interface{}
+
+// arr is shorthand for a parsed sequence or array.
+type arr = []interface{}
+
+func TestParseYAML(t *testing.T) {
+	for _, test := range []struct {
+		desc, yaml string
+		want       interface{}
+	}{
+		{"empty", "", nil},
+		{"comments only", "# comment\n\n  # indented comment\n", nil},
+		{"scalars",
+			"s: plain text\ni: 42\nneg: -7\nf: 1.5\nexp: 1e3\nt: true\nf2: False\nn: null\ntilde: ~\nempty:\n",
+			obj{"s": "plain text", "i": int64(42), "neg": int64(-7), "f": 1.5, "exp": 1000.0, "t": true, "f2": false, "n": nil, "tilde": nil, "empty": nil}},
+		{"quoting",
+			`a: "quoted: # not a comment"` + "\n" + `b: 'it''s'` + "\n" + `c: "tab\there \"q\""` + "\n" + `d: "42"` + "\n" + `"quoted key": x` + "\n",
+			obj{"a": "quoted: # not a comment", "b": "it's", "c": "tab\there \"q\"", "d": "42", "quoted key": "x"}},
+		{"comments",
+			"---\na: b # trailing comment\nc: d#not a comment\n# whole-line comment\ne: f\n",
+			obj{"a": "b", "c": "d#not a comment", "e": "f"}},
+		{"block sequence",
+			"hostname:\n  - a.example.com\n  - b.example.com\n",
+			obj{"hostname": arr{"a.example.com", "b.example.com"}}},
+		{"sequence at key indentation",
+			"hostname:\n- a.example.com\n- b.example.com\nprotocol: both\n",
+			obj{"hostname": arr{"a.example.com", "b.example.com"}, "protocol": "both"}},
+		{"flow collections",
+			"urls: [https://a.example.com/ip, 'b']\nempty: []\nm: {x: 1, y: [true, false]}\n",
+			obj{"urls": arr{"https://a.example.com/ip", "b"}, "empty": arr{}, "m": obj{"x": int64(1), "y": arr{true, false}}}},
+		{"nested mappings",
+			"http:\n  timeout_s: 10\n  tls:\n    min: \"1.2\"\nafter: 1\n",
+			obj{"http": obj{"timeout_s": int64(10), "tls": obj{"min": "1.2"}}, "after": int64(1)}},
+		{"sequence of mappings",
+			"hosts:\n  - hostname: a.example.com\n    provider: duckdns\n  -\n    hostname: b.example.com\n",
+			obj{"hosts": arr{obj{"hostname": "a.example.com", "provider": "duckdns"}, obj{"hostname": "b.example.com"}}}},
+		{"top-level sequence", "- 1\n- two\n", arr{int64(1), "two"}},
+		{"CRLF line endings", "a: 1\r\nb: 2\r\n", obj{"a": int64(1), "b": int64(2)}},
+	} {
+		got, err := parseYAML(test.yaml)
+		if err != nil {
+			t.Errorf("[%s] parseYAML got unexpected error: %v", test.desc, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("[%s] parseYAML = %#v, want %#v", test.desc, got, test.want)
+		}
+	}
+}
+
+func TestParseYAMLErrors(t *testing.T) {
+	for _, test := range []struct {
+		desc, yaml, wantErr string
+	}{
+		{"tab indentation", "a:\n\t- b\n", "line 2: tabs may not be used"},
+		{"multiple documents", "a: 1\n---\nb: 2\n", "line 2: multiple documents are not supported"},
+		{"duplicate key", "a: 1\na: 2\n", `line 2: key "a" is defined more than once`},
+		{"bad indentation", "a:\n    b: 1\n  c: 2\n", "line 3: unexpected indentation"},
+		{"not a mapping entry", "a: 1\njust text\n", `line 2: expected "key: value"`},
+		{"unterminated string", `a: "open` + "\n", "line 1:"},
+		{"text after string", `a: "x" y` + "\n", "line 1:"},
+		{"anchor", "a: &anchor 1\n", `"&" is not supported`},
+		{"block scalar", "a: |\n  text\n", `"|" is not supported`},
+		{"unterminated flow sequence", "a: [1, 2\n", "line 1:"},
+	} {
+		_, err := parseYAML(test.yaml)
+		if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+			t.Errorf("[%s] parseYAML got error %v, want error containing %q", test.desc, err, test.wantErr)
+		}
+	}
+}